@@ -0,0 +1,442 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const minPasswordLength = 8
+
+var validUsername = regexp.MustCompile(`^[A-Za-z0-9_.-]{3,32}$`)
+
+type AccountData struct {
+	LoggedIn    bool
+	Username    string
+	DisplayName string
+	Role        string
+	IsAdmin     bool
+	Backend     string
+	Created     string
+	Sessions    []SessionInfo
+	Tokens      []APIToken
+	Scopes      []string
+	NewToken    string //Token just created, shown only once
+
+	TOTPEnabled   bool
+	TOTPSetup     bool         //Enrollment has started and is waiting for a code
+	TOTPSecret    string       //Secret being enrolled, for typing in by hand
+	TOTPQR        template.URL //QR code of the secret being enrolled
+	RecoveryLeft  int          //Unused recovery codes
+	RecoveryCodes []string     //Recovery codes just generated, shown only once
+	Storage       QuotaInfo    //Storage used by the user's images, only on the profile page
+	CSRFToken     string
+	Message       string //Confirmation shown after a successful change
+	Error         string //Error shown after a failed change
+}
+
+//Checks cookie data to see is user is logged in.
+//Also loads the account details of logged in users.
+func (data *AccountData) GetLoginData(r *http.Request) {
+	session, _ := store.Get(r, "userData")
+	data.CSRFToken = CSRFToken(r)
+
+	if IsNil(session.Values["username"]) { //If cookie not found or user logged out
+		data.LoggedIn = false
+		return
+	}
+
+	data.LoggedIn = true
+	data.Username = session.Values["username"].(string)
+
+	user, err := users.Get(data.Username)
+	if err == nil {
+		data.DisplayName = user.Name()
+		data.Role = user.Role
+		data.IsAdmin = user.HasRole(RoleAdmin)
+		data.Backend = user.BackendName()
+		data.TOTPEnabled = user.TOTPEnabled
+		data.RecoveryLeft = len(user.RecoveryCodes)
+		data.Created = user.Created.Format("January 2, 2006")
+	}
+}
+
+//Checks a new username and password before an account is created or changed
+func ValidateCredentials(username string, password string, confirm string) error {
+	if !validUsername.MatchString(username) {
+		return errors.New("Usernames must be 3-32 characters long and may only contain letters, numbers, '.', '_' and '-'")
+	}
+	if len(password) < minPasswordLength {
+		return errors.New("Passwords must be at least 8 characters long")
+	}
+	if password != confirm {
+		return errors.New("The passwords entered do not match")
+	}
+	return nil
+}
+
+//Refuses usernames of users from an external backend, who could no longer
+//log in if a local account took their name
+func checkExternalName(username string) error {
+	finder, ok := authenticator.(UserFinder)
+	if !ok {
+		return nil
+	}
+
+	found, err := finder.HasUser(username)
+	if err != nil {
+		Log("could not look up " + username + " for registration: " + err.Error())
+		return errors.New("Registration is not available right now, please try again later")
+	}
+	if found {
+		return ErrUserExists
+	}
+	return nil
+}
+
+//Generates the registration page and creates new accounts from its form data.
+//New users are logged in and sent to the gallery.
+func getRegister(w http.ResponseWriter, r *http.Request) {
+	tmpl := template.Must(template.ParseFiles("assets/register.html", "assets/Templates.html"))
+	var data AccountData
+	data.GetLoginData(r)
+
+	if data.LoggedIn {
+		http.Redirect(w, r, "/gallery", http.StatusSeeOther)
+		return
+	}
+
+	//First request:
+	if r.Method != http.MethodPost {
+		DisplayError(w, r, tmpl.Execute(w, data))
+		return
+	}
+
+	username := r.FormValue("username")
+	password := r.FormValue("password")
+
+	err := ValidateCredentials(username, password, r.FormValue("confirm"))
+	if err == nil {
+		err = checkExternalName(username)
+	}
+	if err == nil {
+		err = users.Add(username, password, registerRole)
+	}
+	if err == ErrUserExists {
+		err = errors.New("That username is already taken")
+	}
+	if err != nil {
+		data.Error = err.Error()
+		DisplayError(w, r, tmpl.Execute(w, data))
+		return
+	}
+
+	Log(username + " registered")
+	Audit(r, AuditRegister, username, username, "")
+	StartSession(w, r, username, false)
+	http.Redirect(w, r, "/gallery", http.StatusSeeOther)
+}
+
+//Generates the profile page of the logged in user
+func getProfile(w http.ResponseWriter, r *http.Request) {
+	tmpl := template.Must(template.ParseFiles("assets/profile.html", "assets/Templates.html"))
+	var data AccountData
+	data.GetLoginData(r)
+
+	if !data.LoggedIn {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	data.Storage = QuotaInfoFor(data.Username, data.IsAdmin)
+
+	DisplayError(w, r, tmpl.Execute(w, data))
+}
+
+//Generates the settings page and applies the submitted change.
+//The "action" form value selects which setting is changed.
+func getSettings(w http.ResponseWriter, r *http.Request) {
+	tmpl := template.Must(template.ParseFiles("assets/settings.html", "assets/Templates.html"))
+	var data AccountData
+	data.GetLoginData(r)
+
+	if !data.LoggedIn {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	//First request:
+	if r.Method != http.MethodPost {
+		renderSettings(w, r, tmpl, data)
+		return
+	}
+
+	var err error
+	switch r.FormValue("action") {
+	case "displayName":
+		name := r.FormValue("displayName")
+		if len(name) > 64 {
+			err = errors.New("Display names may be at most 64 characters long")
+			break
+		}
+		err = users.Update(data.Username, func(u *User) error {
+			u.DisplayName = name
+			return nil
+		})
+		if err == nil {
+			data.Message = "Your display name has been changed"
+		}
+
+	case "password":
+		if data.Backend != localBackend {
+			err = errors.New("Your password is managed by " + data.Backend)
+			break
+		}
+		err = ConfirmPassword(data.Username, r.FormValue("current"))
+		if err != nil {
+			break
+		}
+		password := r.FormValue("password")
+		err = ValidateCredentials(data.Username, password, r.FormValue("confirm"))
+		if err == nil {
+			err = users.SetPassword(data.Username, password)
+		}
+		if err == nil {
+			Log(data.Username + " changed their password")
+			Audit(r, AuditPasswordChange, data.Username, data.Username, "")
+
+			//Anyone who had the old password may still be logged in elsewhere
+			session, _ := store.Get(r, "userData")
+			if _, err := store.RevokeOthers(data.Username, session.ID); err != nil {
+				Log("Failed to end the other sessions of " + data.Username + ": " + err.Error())
+			}
+			if err := tokens.RevokeUser(data.Username); err != nil {
+				Log("Failed to revoke the API tokens of " + data.Username + ": " + err.Error())
+			}
+			data.Message = "Your password has been changed. Your other sessions and API tokens have been ended"
+		}
+
+	case "delete":
+		err = ConfirmUser(r, data.Username, r.FormValue("current"))
+		if err != nil {
+			break
+		}
+		//Images are handed to the admins first, so a new account
+		//with the same username never gets them
+		var disowned int
+		disowned, err = imageMeta.Disown(data.Username)
+		if err != nil {
+			Log("Failed to clear the owner of images uploaded by " + data.Username + ": " + err.Error())
+			err = errors.New("Could not delete the account")
+			break
+		}
+		err = users.Delete(data.Username)
+		if err == nil {
+			Log(data.Username + " deleted their account")
+			Audit(r, AuditAccountDelete, data.Username, data.Username, "")
+			if disowned > 0 {
+				Log(fmt.Sprintf("%d images uploaded by %s are now managed by the admins", disowned, data.Username))
+			}
+			store.RevokeUser(data.Username)
+			tokens.RevokeUser(data.Username)
+			EndSession(w, r)
+			http.Redirect(w, r, "/gallery", http.StatusSeeOther)
+			return
+		}
+
+	case "revokeSession":
+		var found bool
+		found, err = store.Revoke(data.Username, r.FormValue("session"))
+		if err == nil && !found {
+			err = errors.New("That session has already ended")
+		}
+		if err == nil {
+			Log(data.Username + " revoked a session")
+			Audit(r, AuditSessionRevoke, data.Username, data.Username, "session "+r.FormValue("session"))
+			data.Message = "The session has been logged out"
+		}
+
+	case "revokeAll":
+		_, err = store.RevokeUser(data.Username)
+		if err == nil {
+			Log(data.Username + " logged out everywhere")
+			Audit(r, AuditSessionRevoke, data.Username, data.Username, "all sessions")
+			EndSession(w, r)
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+
+	case "createToken":
+		name := r.FormValue("tokenName")
+		if name == "" || len(name) > 64 {
+			err = errors.New("Token names must be 1-64 characters long")
+			break
+		}
+		r.ParseForm()
+		data.NewToken, err = tokens.Create(data.Username, name, r.Form["scope"])
+		if err == nil {
+			Log(data.Username + " created API token " + name)
+			Audit(r, AuditTokenCreate, data.Username, name, strings.Join(r.Form["scope"], ","))
+			data.Message = "Your new token has been created. Copy it now, it will not be shown again"
+		}
+
+	case "revokeToken":
+		err = tokens.Revoke(data.Username, r.FormValue("token"))
+		if err == nil {
+			Log(data.Username + " revoked API token " + r.FormValue("token"))
+			Audit(r, AuditTokenRevoke, data.Username, r.FormValue("token"), "")
+			data.Message = "The token has been revoked"
+		}
+
+	case "totpSetup":
+		if data.TOTPEnabled {
+			err = errors.New("Two factor authentication is already on")
+			break
+		}
+		err = ConfirmUser(r, data.Username, r.FormValue("current"))
+		if err != nil {
+			break
+		}
+		err = setupTOTP(w, r, &data)
+
+	case "totpEnable":
+		err = enableTOTP(w, r, &data)
+
+	case "totpDisable":
+		err = ConfirmUser(r, data.Username, r.FormValue("current"))
+		if err != nil {
+			break
+		}
+		err = users.Update(data.Username, func(u *User) error {
+			u.TOTPEnabled = false
+			u.TOTPSecret = ""
+			u.RecoveryCodes = nil
+			return nil
+		})
+		if err == nil {
+			Log(data.Username + " disabled two factor authentication")
+			Audit(r, AuditTwoFactor, data.Username, data.Username, "disabled")
+			data.Message = "Two factor authentication has been turned off"
+		}
+
+	case "recoveryCodes":
+		err = ConfirmUser(r, data.Username, r.FormValue("current"))
+		if err != nil {
+			break
+		}
+		var hashes []string
+		data.RecoveryCodes, hashes, err = NewRecoveryCodes()
+		if err == nil {
+			err = users.Update(data.Username, func(u *User) error {
+				u.RecoveryCodes = hashes
+				return nil
+			})
+		}
+		if err == nil {
+			Log(data.Username + " generated new recovery codes")
+			Audit(r, AuditTwoFactor, data.Username, data.Username, "new recovery codes")
+			data.Message = "New recovery codes have been generated. Your old codes no longer work"
+		}
+
+	default:
+		err = errors.New("Unknown setting")
+	}
+
+	if err != nil {
+		data.Error = err.Error()
+	}
+
+	//Reload the account details so the page shows the change
+	data.GetLoginData(r)
+	renderSettings(w, r, tmpl, data)
+}
+
+//Renders the settings page along with the user's active sessions and API tokens
+func renderSettings(w http.ResponseWriter, r *http.Request, tmpl *template.Template, data AccountData) {
+	session, _ := store.Get(r, "userData")
+	data.Sessions = store.UserSessions(data.Username, session.ID)
+	data.Tokens = tokens.List(data.Username)
+	data.Scopes = scopes
+
+	DisplayError(w, r, tmpl.Execute(w, data))
+}
+
+//Starts two factor enrollment by showing a new secret and its QR code.
+//The secret is kept in the session until it is confirmed with a code.
+func setupTOTP(w http.ResponseWriter, r *http.Request, data *AccountData) error {
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		return err
+	}
+
+	session, _ := store.Get(r, "userData")
+	session.Values["totpSetup"] = secret
+	if err := session.Save(r, w); err != nil {
+		return err
+	}
+
+	return showTOTPSetup(data, secret)
+}
+
+//Fills in the enrollment part of the settings page
+func showTOTPSetup(data *AccountData, secret string) error {
+	qr, err := TOTPQRCode(data.Username, secret)
+	if err != nil {
+		return err
+	}
+
+	data.TOTPSetup = true
+	data.TOTPSecret = secret
+	data.TOTPQR = qr
+	return nil
+}
+
+//Finishes enrollment once the user enters a valid code for the new secret,
+//then shows their recovery codes
+func enableTOTP(w http.ResponseWriter, r *http.Request, data *AccountData) error {
+	session, _ := store.Get(r, "userData")
+	secret, _ := session.Values["totpSetup"].(string)
+	if secret == "" {
+		return errors.New("Two factor setup has expired, please start again")
+	}
+	if data.TOTPEnabled {
+		return errors.New("Two factor authentication is already on")
+	}
+	if err := ConfirmUser(r, data.Username, r.FormValue("current")); err != nil {
+		showTOTPSetup(data, secret)
+		return err
+	}
+
+	step, ok := VerifyTOTP(secret, r.FormValue("code"), 0)
+	if !ok {
+		showTOTPSetup(data, secret)
+		return errors.New("The code entered is not valid")
+	}
+
+	codes, hashes, err := NewRecoveryCodes()
+	if err != nil {
+		return err
+	}
+
+	err = users.Update(data.Username, func(u *User) error {
+		u.TOTPEnabled = true
+		u.TOTPSecret = secret
+		u.TOTPLastStep = step
+		u.RecoveryCodes = hashes
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	delete(session.Values, "totpSetup")
+	session.Save(r, w)
+
+	Log(data.Username + " enabled two factor authentication")
+	Audit(r, AuditTwoFactor, data.Username, data.Username, "enabled")
+	data.RecoveryCodes = codes
+	data.Message = "Two factor authentication is now on"
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestValidateCredentials(t *testing.T) {
+	tests := []struct {
+		username string
+		password string
+		confirm  string
+		ok       bool
+	}{
+		{"alice", "password1", "password1", true},
+		{"a.b_c-d", "password1", "password1", true},
+		{strings.Repeat("a", 32), "password1", "password1", true},
+		{"al", "password1", "password1", false},
+		{strings.Repeat("a", 33), "password1", "password1", false},
+		{"alice smith", "password1", "password1", false},
+		{"alice/..", "password1", "password1", false},
+		{"", "password1", "password1", false},
+		{"alice", "short", "short", false},
+		{"alice", "12345678", "12345678", true},
+		{"alice", "password1", "password2", false},
+	}
+	for _, test := range tests {
+		if err := ValidateCredentials(test.username, test.password, test.confirm); (err == nil) != test.ok {
+			t.Errorf("%q/%q/%q: got %v", test.username, test.password, test.confirm, err)
+		}
+	}
+}
+
+func TestDeleteAccountDisownsImages(t *testing.T) {
+	dir := testGallery(t)
+	testTemplates(t, dir, "settings.html", "error.html")
+	testUsers(t)
+	testSessions(t)
+	testTokens(t)
+	testAuditLog(t)
+
+	oldAuthenticator := authenticator
+	t.Cleanup(func() {
+		authenticator = oldAuthenticator
+	})
+	authenticator = ChainAuthenticator{&LocalAuthenticator{Users: users}}
+
+	if err := users.Add("alice", "alice password", RoleUploader); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []ImageMeta{
+		{Filename: "mine.png", Owner: "alice", Visibility: VisibilityPrivate},
+		{Filename: "other.png", Owner: "bob", Visibility: VisibilityPrivate},
+	} {
+		if err := imageMeta.Add(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cookie := saveTestSession(t, store, map[interface{}]interface{}{"username": "alice"})
+	form := url.Values{"action": {"delete"}, "current": {"alice password"}}
+	r := httptest.NewRequest(http.MethodPost, "/settings", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	getSettings(w, r)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("deleting the account got %d", w.Code)
+	}
+	if _, err := users.Get("alice"); err != ErrUserNotFound {
+		t.Fatalf("the account was not deleted: %v", err)
+	}
+
+	//Someone else registering the same name gets none of the old images
+	if err := users.Add("alice", "new password", RoleUploader); err != nil {
+		t.Fatal(err)
+	}
+	newAlice, _ := users.Get("alice")
+	r = httptest.NewRequest(http.MethodGet, "/gallery", nil)
+	r.AddCookie(saveTestSession(t, store, map[interface{}]interface{}{"username": "alice"}))
+	meta, _ := imageMeta.Get("mine.png")
+	if meta.Owner != "" {
+		t.Errorf("the image is still owned by %q", meta.Owner)
+	}
+	if CanViewImage(r, "mine.png") || ImageListed(r, "mine.png") || ownsImage(r, meta) {
+		t.Error("the new account can see the deleted account's private image")
+	}
+	if CanDeleteImage(newAlice, "mine.png") {
+		t.Error("the new account can delete the deleted account's image")
+	}
+
+	//Other users' images are left alone
+	if meta, _ := imageMeta.Get("other.png"); meta.Owner != "bob" {
+		t.Errorf("another user's image is now owned by %q", meta.Owner)
+	}
+}
+
+func TestPasswordChangeEndsOtherSessions(t *testing.T) {
+	testUsers(t)
+	testSessions(t)
+	testTokens(t)
+	testAuditLog(t)
+
+	oldAuthenticator := authenticator
+	t.Cleanup(func() {
+		authenticator = oldAuthenticator
+	})
+	authenticator = ChainAuthenticator{&LocalAuthenticator{Users: users}}
+
+	for _, name := range []string{"alice", "bob"} {
+		if err := users.Add(name, "old password", RoleUploader); err != nil {
+			t.Fatal(err)
+		}
+	}
+	current := saveTestSession(t, store, map[interface{}]interface{}{"username": "alice"})
+	stolen := saveTestSession(t, store, map[interface{}]interface{}{"username": "alice"})
+	bob := saveTestSession(t, store, map[interface{}]interface{}{"username": "bob"})
+	token, err := tokens.Create("alice", "script", []string{ScopeRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	form := url.Values{"action": {"password"}, "current": {"old password"}, "password": {"new password"}, "confirm": {"new password"}}
+	r := httptest.NewRequest(http.MethodPost, "/settings", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(current)
+	getSettings(httptest.NewRecorder(), r)
+	if _, err := users.Verify("alice", "new password"); err != nil {
+		t.Fatalf("the password was not changed: %v", err)
+	}
+
+	if username := testSessionUser(t, store, current); username != "alice" {
+		t.Error("the session the password was changed in was logged out")
+	}
+	if username := testSessionUser(t, store, stolen); username != "" {
+		t.Errorf("another session still belongs to %q", username)
+	}
+	if _, err := tokens.Authenticate(token); err != ErrBadToken {
+		t.Errorf("an API token still works after the password change: %v", err)
+	}
+	if username := testSessionUser(t, store, bob); username != "bob" {
+		t.Errorf("bob's session belongs to %q", username)
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const auditPath = "./data/audit.log"
+
+//Most events shown on the audit page, exports include every match
+const auditPageLimit = 500
+
+//Longest user agent and detail kept in an event, since both can come from users
+const auditFieldLimit = 512
+
+//Longest line read from the log. Events are far shorter since their fields are
+//cut to auditFieldLimit, so longer lines are skipped as damaged.
+const auditLineLimit = 64 * 1024
+
+//Audit event actions
+const (
+	AuditLogin          = "login"
+	AuditLoginFailed    = "login_failed"
+	AuditLoginLocked    = "login_locked"
+	AuditLogout         = "logout"
+	AuditRegister       = "register"
+	AuditPasswordChange = "password_change"
+	AuditAccountDelete  = "account_delete"
+	AuditTwoFactor      = "two_factor"
+	AuditSessionRevoke  = "session_revoke"
+	AuditRoleChange     = "role_change"
+	AuditTokenCreate    = "token_create"
+	AuditTokenRevoke    = "token_revoke"
+	AuditTokenUse       = "token_use"
+	AuditTokenRejected  = "token_rejected"
+	AuditUpload         = "upload"
+	AuditDelete         = "delete"
+	AuditRestore        = "restore"
+	AuditPurge          = "purge"
+	AuditVisibility     = "visibility"
+	AuditVersion        = "version"
+	AuditShareCreate    = "share_create"
+	AuditShareRevoke    = "share_revoke"
+	AuditRepair         = "repair"
+)
+
+var auditActions = []string{
+	AuditLogin, AuditLoginFailed, AuditLoginLocked, AuditLogout, AuditRegister,
+	AuditPasswordChange, AuditAccountDelete, AuditTwoFactor, AuditSessionRevoke,
+	AuditRoleChange, AuditTokenCreate, AuditTokenRevoke, AuditTokenUse, AuditTokenRejected,
+	AuditUpload, AuditDelete, AuditRestore, AuditPurge, AuditVisibility, AuditVersion, AuditShareCreate, AuditShareRevoke,
+	AuditRepair,
+}
+
+//One line of the audit log
+type AuditEvent struct {
+	Time      time.Time `json:"time"`
+	Action    string    `json:"action"`
+	Actor     string    `json:"actor"` //User who did it, "" if nobody is logged in
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	Target    string    `json:"target"` //User, image or token it was done to
+	Detail    string    `json:"detail,omitempty"`
+}
+
+//Append only log of security events, one JSON object per line.
+//Kept apart from Log.txt so it can be filtered and exported.
+type AuditLog struct {
+	mu   sync.Mutex
+	path string
+}
+
+//Global audit log
+var auditLog = &AuditLog{path: auditPath}
+
+//Appends an event to the log
+func (a *AuditLog) Record(event AuditEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(a.path), os.ModePerm); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(a.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+//Returns the events matching the filter, newest first
+func (a *AuditLog) Read(filter AuditFilter) ([]AuditEvent, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	file, err := os.Open(a.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var events []AuditEvent
+	reader := bufio.NewReaderSize(file, auditLineLimit)
+	for {
+		line, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			//Skip the rest of a line too long to be an event
+			for err == bufio.ErrBufferFull {
+				_, err = reader.ReadSlice('\n')
+			}
+			line = nil
+		}
+
+		var event AuditEvent
+		if len(line) > 0 && json.Unmarshal(line, &event) == nil && filter.Match(event) {
+			events = append(events, event)
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+	return events, nil
+}
+
+//Records an event done by actor to target, taking the IP and user agent from the request.
+//Errors writing the audit log are written to Log.txt instead.
+func Audit(r *http.Request, action string, actor string, target string, detail string) {
+	err := auditLog.Record(AuditEvent{
+		Time:      time.Now(),
+		Action:    action,
+		Actor:     actor,
+		IP:        clientIP(r),
+		UserAgent: cutAuditField(r.UserAgent()),
+		Target:    cutAuditField(target),
+		Detail:    cutAuditField(detail),
+	})
+	if err != nil {
+		Log("could not write audit log: " + err.Error())
+	}
+}
+
+//Cuts a value to auditFieldLimit bytes, without splitting a character
+func cutAuditField(value string) string {
+	if len(value) <= auditFieldLimit {
+		return value
+	}
+	cut := auditFieldLimit
+	for cut > 0 && !utf8.RuneStart(value[cut]) {
+		cut--
+	}
+	return value[:cut] + "..."
+}
+
+//Which events to show on the audit page. Empty fields match everything.
+type AuditFilter struct {
+	Action string
+	Actor  string
+	Target string //Matches any target containing it
+	From   time.Time
+	To     time.Time //Events before this time
+}
+
+//Reads the filter from the query string.
+//Dates are "2006-01-02", and the "to" day is included.
+func AuditFilterFromRequest(r *http.Request) AuditFilter {
+	q := r.URL.Query()
+	filter := AuditFilter{
+		Action: q.Get("action"),
+		Actor:  strings.TrimSpace(q.Get("actor")),
+		Target: strings.TrimSpace(q.Get("target")),
+	}
+	if from, err := time.ParseInLocation("2006-01-02", q.Get("from"), time.Local); err == nil {
+		filter.From = from
+	}
+	if to, err := time.ParseInLocation("2006-01-02", q.Get("to"), time.Local); err == nil {
+		filter.To = to.AddDate(0, 0, 1)
+	}
+	return filter
+}
+
+//Returns true if the event passes the filter
+func (f AuditFilter) Match(event AuditEvent) bool {
+	if f.Action != "" && event.Action != f.Action {
+		return false
+	}
+	if f.Actor != "" && !strings.EqualFold(event.Actor, f.Actor) {
+		return false
+	}
+	if f.Target != "" && !strings.Contains(strings.ToLower(event.Target), strings.ToLower(f.Target)) {
+		return false
+	}
+	if !f.From.IsZero() && event.Time.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !event.Time.Before(f.To) {
+		return false
+	}
+	return true
+}
+
+type AdminAuditData struct {
+	LoggedIn  bool
+	Username  string
+	CSRFToken string
+	Actions   []string
+	Events    []AuditEvent
+	Total     int //Number of matching events, more than len(Events) if cut off
+	Query     template.URL
+	Action    string
+	Actor     string
+	Target    string
+	From      string
+	To        string
+	Error     string
+}
+
+//Checks cookie data to see is user is logged in.
+func (data *AdminAuditData) GetLoginData(r *http.Request) {
+	session, _ := store.Get(r, "userData")
+	data.CSRFToken = CSRFToken(r)
+
+	if IsNil(session.Values["username"]) { //If cookie not found or user logged out
+		data.LoggedIn = false
+	} else {
+		data.Username = session.Values["username"].(string)
+		data.LoggedIn = true
+	}
+}
+
+//Generates the audit log page, showing the newest events matching the filter
+func getAdminAudit(w http.ResponseWriter, r *http.Request) {
+	tmpl := template.Must(template.ParseFiles("assets/admin_audit.html", "assets/Templates.html"))
+	q := r.URL.Query()
+	query := url.Values{}
+	for _, key := range []string{"action", "actor", "target", "from", "to"} {
+		if value := q.Get(key); value != "" {
+			query.Set(key, value)
+		}
+	}
+	data := AdminAuditData{
+		Actions: auditActions,
+		Query:   template.URL(query.Encode()),
+		Action:  q.Get("action"),
+		Actor:   q.Get("actor"),
+		Target:  q.Get("target"),
+		From:    q.Get("from"),
+		To:      q.Get("to"),
+	}
+	data.GetLoginData(r)
+
+	events, err := auditLog.Read(AuditFilterFromRequest(r))
+	if err != nil {
+		data.Error = err.Error()
+	}
+	data.Total = len(events)
+	if len(events) > auditPageLimit {
+		events = events[:auditPageLimit]
+	}
+	data.Events = events
+
+	DisplayError(w, r, tmpl.Execute(w, data))
+}
+
+//Downloads every event matching the filter as JSON lines, or as CSV with format=csv
+func auditExportHandler(w http.ResponseWriter, r *http.Request) {
+	events, err := auditLog.Read(AuditFilterFromRequest(r))
+	if err != nil {
+		DisplayError(w, r, err)
+		return
+	}
+
+	user, _ := CurrentUser(r)
+	Log(user.Username + " exported the audit log")
+
+	name := "audit-" + time.Now().Format("20060102-150405")
+	if r.URL.Query().Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.csv"`)
+
+		out := csv.NewWriter(w)
+		out.Write([]string{"time", "action", "actor", "ip", "user_agent", "target", "detail"})
+		for _, e := range events {
+			out.Write([]string{
+				e.Time.Format(time.RFC3339), e.Action, csvCell(e.Actor), csvCell(e.IP),
+				csvCell(e.UserAgent), csvCell(e.Target), csvCell(e.Detail),
+			})
+		}
+		out.Flush()
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`.jsonl"`)
+	encoder := json.NewEncoder(w)
+	for _, e := range events {
+		encoder.Encode(e)
+	}
+}
+
+//Stops spreadsheet programs reading a CSV cell as a formula.
+//User agents, usernames and forwarded IPs come from users, so they cannot be trusted.
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
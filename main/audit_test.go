@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+//Points the global audit log at an empty log in a temporary folder
+func testAuditLog(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "audit.log")
+	oldLog := auditLog
+	auditLog = &AuditLog{path: path}
+	t.Cleanup(func() {
+		auditLog = oldLog
+	})
+	return path
+}
+
+func TestAuditLongLines(t *testing.T) {
+	path := testAuditLog(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/login", nil)
+	r.Header.Set("User-Agent", strings.Repeat("a", 2*1024*1024))
+	Audit(r, AuditLogin, "alice", "alice", strings.Repeat("é", auditFieldLimit))
+	Audit(r, AuditLogout, "alice", "alice", "")
+
+	//A damaged line longer than any event, between two good ones
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"action":"` + strings.Repeat("x", 2*auditLineLimit) + "\"}\n")
+	file.Close()
+	if err := auditLog.Record(AuditEvent{Time: time.Now(), Action: AuditUpload, Actor: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+
+	events, err := auditLog.Read(AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 {
+		t.Fatalf("read %d events, want 3", len(events))
+	}
+	if events[0].Action != AuditUpload || events[2].Action != AuditLogin {
+		t.Errorf("events out of order: %+v", events)
+	}
+	for _, e := range events {
+		if len(e.UserAgent) > auditFieldLimit+3 || len(e.Detail) > auditFieldLimit+3 {
+			t.Errorf("%s: fields were not cut, user agent %d and detail %d bytes", e.Action, len(e.UserAgent), len(e.Detail))
+		}
+		if !utf8.ValidString(e.Detail) {
+			t.Errorf("%s: detail was cut inside a character", e.Action)
+		}
+	}
+}
+
+func TestAuditLongTarget(t *testing.T) {
+	testAuditLog(t)
+
+	//Failed logins record whatever username was sent
+	r := httptest.NewRequest(http.MethodPost, "/login", nil)
+	Audit(r, AuditLoginFailed, "", strings.Repeat("a", 2*1024*1024), "wrong username or password")
+
+	events, err := auditLog.Read(AuditFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("read %d events, want 1", len(events))
+	}
+	if len(events[0].Target) > auditFieldLimit+3 {
+		t.Errorf("target was not cut, %d bytes", len(events[0].Target))
+	}
+}
+
+func TestCSVCell(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"alice", "alice"},
+		{"", ""},
+		{"=HYPERLINK(\"x\")", "'=HYPERLINK(\"x\")"},
+		{"+1", "'+1"},
+		{"-1", "'-1"},
+		{"@SUM(A1)", "'@SUM(A1)"},
+		{"\t=1", "'\t=1"},
+		{"\r=1", "'\r=1"},
+		{"a=1", "a=1"},
+		{"192.168.0.1", "192.168.0.1"},
+	}
+	for _, test := range tests {
+		if got := csvCell(test.value); got != test.want {
+			t.Errorf("csvCell(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+func TestAuditFilter(t *testing.T) {
+	day := time.Date(2021, 6, 1, 12, 0, 0, 0, time.Local)
+	event := AuditEvent{Time: day, Action: AuditUpload, Actor: "Alice", Target: "Arch.jpg"}
+
+	tests := []struct {
+		filter AuditFilter
+		match  bool
+	}{
+		{AuditFilter{}, true},
+		{AuditFilter{Action: AuditUpload}, true},
+		{AuditFilter{Action: AuditDelete}, false},
+		{AuditFilter{Actor: "alice"}, true},
+		{AuditFilter{Actor: "ali"}, false},
+		{AuditFilter{Target: "arch"}, true},
+		{AuditFilter{Target: "bridge"}, false},
+		{AuditFilter{From: day}, true},
+		{AuditFilter{From: day.Add(time.Second)}, false},
+		{AuditFilter{To: day}, false},
+		{AuditFilter{To: day.Add(time.Second)}, true},
+	}
+	for _, test := range tests {
+		if match := test.filter.Match(event); match != test.match {
+			t.Errorf("%+v: got %v, want %v", test.filter, match, test.match)
+		}
+	}
+}
@@ -0,0 +1,584 @@
+package main
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	"golang.org/x/crypto/bcrypt"
+)
+
+//Checks a username and password against some account source
+type Authenticator interface {
+	//Name of the backend, stored on users it creates
+	Name() string
+	//Returns the verified identity, or ErrBadCredentials if the password is wrong
+	Authenticate(username string, password string) (Identity, error)
+}
+
+//Implemented by authenticators that can tell whether a username is one of theirs
+//without its password
+type UserFinder interface {
+	HasUser(username string) (bool, error)
+}
+
+//An account verified by an Authenticator
+type Identity struct {
+	Username    string
+	DisplayName string
+	Backend     string
+	Subject     string //Fixed ID of the user at the backend, if its usernames can change
+}
+
+//Global authenticator, set up from the config in main
+var authenticator Authenticator
+
+//Backend name of accounts stored in the local user store
+const localBackend = "local"
+
+//Authenticates against the local user store
+type LocalAuthenticator struct {
+	Users *UserStore
+}
+
+func (a *LocalAuthenticator) Name() string {
+	return localBackend
+}
+
+func (a *LocalAuthenticator) Authenticate(username string, password string) (Identity, error) {
+	user, err := a.Users.Verify(username, password)
+	if err != nil {
+		return Identity{}, err
+	}
+	return Identity{Username: user.Username, DisplayName: user.DisplayName, Backend: localBackend}, nil
+}
+
+//Authenticates against an Apache htpasswd file.
+//Supports bcrypt, apr1 (MD5) and {SHA} hashes. The file is reread when it changes.
+type HtpasswdAuthenticator struct {
+	Path string
+
+	mu       sync.Mutex
+	modified time.Time
+	hashes   map[string]string
+}
+
+func (a *HtpasswdAuthenticator) Name() string {
+	return "htpasswd"
+}
+
+//Rereads the file if it changed since it was last read.
+//Caller must hold the lock.
+func (a *HtpasswdAuthenticator) load() error {
+	info, err := os.Stat(a.Path)
+	if err != nil {
+		return err
+	}
+	if a.hashes != nil && info.ModTime().Equal(a.modified) {
+		return nil
+	}
+
+	file, err := os.Open(a.Path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	hashes := make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 2 {
+			hashes[parts[0]] = parts[1]
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	a.hashes = hashes
+	a.modified = info.ModTime()
+	return nil
+}
+
+func (a *HtpasswdAuthenticator) Authenticate(username string, password string) (Identity, error) {
+	a.mu.Lock()
+	err := a.load()
+	hash, ok := a.hashes[username]
+	a.mu.Unlock()
+
+	if err != nil {
+		return Identity{}, err
+	}
+	if !ok || !checkHtpasswdHash(hash, password) {
+		return Identity{}, ErrBadCredentials
+	}
+	return Identity{Username: username, Backend: a.Name()}, nil
+}
+
+func (a *HtpasswdAuthenticator) HasUser(username string) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.load(); err != nil {
+		return false, err
+	}
+	_, ok := a.hashes[username]
+	return ok, nil
+}
+
+//Checks a password against one htpasswd hash
+func checkHtpasswdHash(hash string, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2y$"), strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+
+	case strings.HasPrefix(hash, "$apr1$"):
+		parts := strings.Split(hash, "$")
+		if len(parts) != 4 {
+			return false
+		}
+		return subtle.ConstantTimeCompare([]byte(apr1Hash(password, parts[2])), []byte(hash)) == 1
+
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		return subtle.ConstantTimeCompare([]byte(base64.StdEncoding.EncodeToString(sum[:])), []byte(hash[5:])) == 1
+	}
+
+	//crypt() and plain text hashes are not supported
+	return false
+}
+
+//Apache's MD5 based password hash, as made by "htpasswd -m"
+func apr1Hash(password string, salt string) string {
+	const magic = "$apr1$"
+	const itoa64 = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.Sum([]byte(password + salt + password))
+
+	ctx := md5.New()
+	ctx.Write([]byte(password + magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		if i > 16 {
+			ctx.Write(alt[:16])
+		} else {
+			ctx.Write(alt[:i])
+		}
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		round := md5.New()
+		if i&1 != 0 {
+			round.Write(pw)
+		} else {
+			round.Write(final)
+		}
+		if i%3 != 0 {
+			round.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			round.Write(pw)
+		}
+		if i&1 != 0 {
+			round.Write(final)
+		} else {
+			round.Write(pw)
+		}
+		final = round.Sum(nil)
+	}
+
+	var out strings.Builder
+	to64 := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out.WriteByte(itoa64[v&0x3f])
+			v >>= 6
+		}
+	}
+	to64(uint32(final[0])<<16|uint32(final[6])<<8|uint32(final[12]), 4)
+	to64(uint32(final[1])<<16|uint32(final[7])<<8|uint32(final[13]), 4)
+	to64(uint32(final[2])<<16|uint32(final[8])<<8|uint32(final[14]), 4)
+	to64(uint32(final[3])<<16|uint32(final[9])<<8|uint32(final[15]), 4)
+	to64(uint32(final[4])<<16|uint32(final[10])<<8|uint32(final[5]), 4)
+	to64(uint32(final[11]), 2)
+
+	return magic + salt + "$" + out.String()
+}
+
+//Settings for LDAP logins.
+//Either UserDN is set to bind directly as "uid=%s,ou=people,dc=example,dc=com",
+//or BaseDN and UserFilter are used to search for the user's DN first,
+//binding as BindDN for the search if the directory needs it.
+type LDAPConfig struct {
+	URL                string `json:"url"`       //ldap://host:389 or ldaps://host:636
+	StartTLS           bool   `json:"start_tls"` //Upgrade ldap:// connections to TLS
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+
+	UserDN string `json:"user_dn"` //DN template, %s is replaced by the escaped username
+
+	BindDN       string `json:"bind_dn"`
+	BindPassword string `json:"bind_password"`
+	BaseDN       string `json:"base_dn"`
+	UserFilter   string `json:"user_filter"` //Such as "(uid=%s)"
+
+	DisplayNameAttr string `json:"display_name_attr"` //Such as "cn" or "displayName"
+}
+
+//Authenticates by binding to an LDAP directory as the user
+type LDAPAuthenticator struct {
+	Config  LDAPConfig
+	Timeout time.Duration
+}
+
+func (a *LDAPAuthenticator) Name() string {
+	return "ldap"
+}
+
+//Opens a connection to the directory, upgrading it to TLS if configured
+func (a *LDAPAuthenticator) dial() (*ldap.Conn, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: a.Config.InsecureSkipVerify}
+
+	conn, err := ldap.DialURL(a.Config.URL,
+		ldap.DialWithDialer(&net.Dialer{Timeout: a.Timeout}),
+		ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, err
+	}
+	conn.SetTimeout(a.Timeout)
+
+	if a.Config.StartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (a *LDAPAuthenticator) Authenticate(username string, password string) (Identity, error) {
+	//An empty password would be an anonymous bind, which always succeeds
+	if username == "" || password == "" {
+		return Identity{}, ErrBadCredentials
+	}
+
+	conn, err := a.dial()
+	if err != nil {
+		return Identity{}, err
+	}
+	defer conn.Close()
+
+	userDN := ""
+	var entry *ldap.Entry
+
+	if a.Config.UserDN != "" {
+		userDN = fmt.Sprintf(a.Config.UserDN, escapeDN(username))
+	} else {
+		if a.Config.BindDN != "" {
+			if err := conn.Bind(a.Config.BindDN, a.Config.BindPassword); err != nil {
+				return Identity{}, fmt.Errorf("ldap service bind: %v", err)
+			}
+		}
+
+		entry, err = a.search(conn, username)
+		if err != nil {
+			return Identity{}, err
+		}
+		userDN = entry.DN
+	}
+
+	if err := conn.Bind(userDN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			return Identity{}, ErrBadCredentials
+		}
+		return Identity{}, err
+	}
+
+	ident := Identity{Username: username, Backend: a.Name()}
+
+	//Read the display name as the user if it was not found by the search
+	if entry == nil && a.Config.DisplayNameAttr != "" {
+		result, err := conn.Search(ldap.NewSearchRequest(userDN, ldap.ScopeBaseObject, ldap.NeverDerefAliases,
+			1, int(a.Timeout.Seconds()), false, "(objectClass=*)", []string{a.Config.DisplayNameAttr}, nil))
+		if err == nil && len(result.Entries) == 1 {
+			entry = result.Entries[0]
+		}
+	}
+	if entry != nil && a.Config.DisplayNameAttr != "" {
+		ident.DisplayName = entry.GetAttributeValue(a.Config.DisplayNameAttr)
+	}
+
+	return ident, nil
+}
+
+//Looks the user up in the directory, binding as BindDN if set.
+//With a UserDN template the directory must let that bind, or anonymous users, read the entry.
+func (a *LDAPAuthenticator) HasUser(username string) (bool, error) {
+	if username == "" {
+		return false, nil
+	}
+
+	conn, err := a.dial()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if a.Config.BindDN != "" {
+		if err := conn.Bind(a.Config.BindDN, a.Config.BindPassword); err != nil {
+			return false, fmt.Errorf("ldap service bind: %v", err)
+		}
+	}
+
+	if a.Config.UserDN != "" {
+		userDN := fmt.Sprintf(a.Config.UserDN, escapeDN(username))
+		_, err := conn.Search(ldap.NewSearchRequest(userDN, ldap.ScopeBaseObject, ldap.NeverDerefAliases,
+			1, int(a.Timeout.Seconds()), false, "(objectClass=*)", []string{"dn"}, nil))
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	//Ambiguous usernames cannot log in, so they are not counted
+	_, err = a.search(conn, username)
+	if err == ErrBadCredentials {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+//Finds the entry of the user below BaseDN
+func (a *LDAPAuthenticator) search(conn *ldap.Conn, username string) (*ldap.Entry, error) {
+	attributes := []string{"dn"}
+	if a.Config.DisplayNameAttr != "" {
+		attributes = append(attributes, a.Config.DisplayNameAttr)
+	}
+
+	filter := fmt.Sprintf(a.Config.UserFilter, ldap.EscapeFilter(username))
+	result, err := conn.Search(ldap.NewSearchRequest(a.Config.BaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases,
+		2, int(a.Timeout.Seconds()), false, filter, attributes, nil))
+	if err != nil {
+		return nil, fmt.Errorf("ldap search: %v", err)
+	}
+
+	//Unknown and ambiguous usernames are both treated as wrong credentials
+	if len(result.Entries) != 1 {
+		return nil, ErrBadCredentials
+	}
+	return result.Entries[0], nil
+}
+
+//Escapes a value for use in a DN (RFC 4514)
+func escapeDN(value string) string {
+	var out strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case strings.IndexByte(",+\"\\<>;=", c) >= 0,
+			c == '#' && i == 0,
+			c == ' ' && (i == 0 || i == len(value)-1):
+			out.WriteByte('\\')
+			out.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&out, "\\%02x", c)
+		default:
+			out.WriteByte(c)
+		}
+	}
+	return out.String()
+}
+
+//Tries each authenticator in order until one accepts the password
+type ChainAuthenticator []Authenticator
+
+func (c ChainAuthenticator) Name() string {
+	return "chain"
+}
+
+func (c ChainAuthenticator) Authenticate(username string, password string) (Identity, error) {
+	for _, a := range c {
+		ident, err := a.Authenticate(username, password)
+		if err == nil {
+			return ident, nil
+		}
+		//Backends that are down are skipped so the others can still be used
+		if err != ErrBadCredentials {
+			Log(a.Name() + " login error: " + err.Error())
+		}
+	}
+	return Identity{}, ErrBadCredentials
+}
+
+//Returns true if any backend that can look users up has the user.
+//A backend that cannot be asked is an error, since it might have the user.
+func (c ChainAuthenticator) HasUser(username string) (bool, error) {
+	for _, a := range c {
+		finder, ok := a.(UserFinder)
+		if !ok {
+			continue
+		}
+		found, err := finder.HasUser(username)
+		if err != nil {
+			return false, fmt.Errorf("%s: %v", a.Name(), err)
+		}
+		if found {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+//Creates the global authenticator from the backends listed in the config
+func SetupAuthenticator() error {
+	var chain ChainAuthenticator
+
+	for _, backend := range config.AuthBackends {
+		switch backend {
+		case localBackend:
+			chain = append(chain, &LocalAuthenticator{Users: users})
+		case "htpasswd":
+			if config.HtpasswdFile == "" {
+				return errors.New("the htpasswd backend needs htpasswd_file")
+			}
+			chain = append(chain, &HtpasswdAuthenticator{Path: config.HtpasswdFile})
+		case "ldap":
+			if config.LDAP.URL == "" {
+				return errors.New("the ldap backend needs ldap.url")
+			}
+			if config.LDAP.UserDN == "" && (config.LDAP.BaseDN == "" || config.LDAP.UserFilter == "") {
+				return errors.New("the ldap backend needs ldap.user_dn, or ldap.base_dn and ldap.user_filter")
+			}
+			chain = append(chain, &LDAPAuthenticator{Config: config.LDAP, Timeout: 10 * time.Second})
+		default:
+			return fmt.Errorf("unknown auth backend %q", backend)
+		}
+	}
+
+	if len(chain) == 0 {
+		return errors.New("no auth backends configured")
+	}
+	authenticator = chain
+	return nil
+}
+
+//Returns the local user for a verified identity, creating it the first time
+//someone logs in through an external backend.
+//A username already taken by another backend is refused.
+//Identities with a subject are matched on it rather than on their username.
+func ProvisionUser(ident Identity) (User, error) {
+	if ident.Subject != "" {
+		return provisionSubject(ident)
+	}
+
+	user, err := users.Get(ident.Username)
+	if err == ErrUserNotFound && ident.Backend != localBackend {
+		err = users.AddExternal(ident, config.ExternalRole)
+		if err == nil {
+			Log(ident.Username + " signed in for the first time through " + ident.Backend)
+			user, err = users.Get(ident.Username)
+		}
+	}
+	if err != nil {
+		return User{}, err
+	}
+
+	if user.BackendName() != ident.Backend {
+		Log(fmt.Sprintf("refused %s login for %s, account belongs to %s", ident.Backend, ident.Username, user.BackendName()))
+		return User{}, ErrBadCredentials
+	}
+	return user, nil
+}
+
+//Returns the local user bound to the identity's subject, creating it the first time.
+//The username is only used when creating the account, so a user renamed at the
+//backend to someone else's name still gets their own account. A username taken by
+//an account of another subject is refused.
+func provisionSubject(ident Identity) (User, error) {
+	user, err := users.FindSubject(ident.Subject)
+	if err == nil {
+		return user, nil
+	}
+
+	existing, err := users.Get(ident.Username)
+	if err == ErrUserNotFound {
+		err = users.AddExternal(ident, config.ExternalRole)
+		if err == nil {
+			Log(ident.Username + " signed in for the first time through " + ident.Backend)
+			return users.FindSubject(ident.Subject)
+		}
+	}
+	if err != nil && err != ErrUserExists {
+		return User{}, err
+	}
+
+	if existing.BackendName() == ident.Backend && existing.Subject == "" {
+		//Made before subjects were stored. Deleting the account lets its user sign in again.
+		Log(fmt.Sprintf("refused %s login for %s, the account has no subject to match", ident.Backend, ident.Username))
+	} else {
+		Log(fmt.Sprintf("refused %s login for %s, the username belongs to another account", ident.Backend, ident.Username))
+	}
+	return User{}, ErrBadCredentials
+}
+
+//How long after logging in single sign on users can confirm sensitive changes
+const recentLogin = 5 * time.Minute
+
+//Confirms a sensitive change on the settings page by the logged in user.
+//Users with a password type it again. Single sign on users have no password here,
+//so they must have logged in at their provider within the last few minutes.
+func ConfirmUser(r *http.Request, username string, password string) error {
+	user, err := users.Get(username)
+	if err != nil {
+		return err
+	}
+	if user.BackendName() != oidcBackend {
+		return ConfirmPassword(username, password)
+	}
+
+	session, _ := store.Get(r, "userData")
+	loggedIn, _ := session.Values["loginTime"].(int64)
+	if time.Since(time.Unix(loggedIn, 0)) > recentLogin {
+		return errors.New("Please log in again through single sign on to confirm this change")
+	}
+	return nil
+}
+
+//Checks the password of a logged in user through the backend their account came from
+func ConfirmPassword(username string, password string) error {
+	ident, err := authenticator.Authenticate(username, password)
+	if err != nil || ident.Username != username {
+		return errors.New("The current password is incorrect")
+	}
+	if _, err := ProvisionUser(ident); err != nil {
+		return errors.New("The current password is incorrect")
+	}
+	return nil
+}
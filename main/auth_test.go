@@ -0,0 +1,447 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestCheckHtpasswdHash(t *testing.T) {
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("secret pass"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//apr1 and SHA hashes made with "openssl passwd -apr1" and "htpasswd -s"
+	tests := []struct {
+		hash     string
+		password string
+		ok       bool
+	}{
+		{"$apr1$r31M9aF8$8tseqkRNVHoiqDdFPMWVm.", "secret pass", true},
+		{"$apr1$r31M9aF8$8tseqkRNVHoiqDdFPMWVm.", "secret Pass", false},
+		{"$apr1$abcdefgh$CWmSdRXg6.q2WlUC6/oKv1", "a much longer password than sixteen", true},
+		{"$apr1$abcdefgh$CWmSdRXg6.q2WlUC6/oKv1", "a much longer password than sixteeN", false},
+		{"$apr1$broken", "secret pass", false},
+		{"{SHA}O1hAcUlX7zkBbV+/3rmbDfUlbNM=", "secret pass", true},
+		{"{SHA}O1hAcUlX7zkBbV+/3rmbDfUlbNM=", "secret", false},
+		{string(bcryptHash), "secret pass", true},
+		{string(bcryptHash), "wrong pass", false},
+		{"$2y$" + string(bcryptHash[4:]), "secret pass", true},
+		{"secret pass", "secret pass", false}, //Plain text is not supported
+		{"rqXexS6ZhobKA", "secret pass", false},
+	}
+	for _, test := range tests {
+		if ok := checkHtpasswdHash(test.hash, test.password); ok != test.ok {
+			t.Errorf("%s with %q: got %v, want %v", test.hash, test.password, ok, test.ok)
+		}
+	}
+}
+
+func TestHtpasswdAuthenticator(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	data := "# comment\n\nalice:$apr1$r31M9aF8$8tseqkRNVHoiqDdFPMWVm.\nbob:{SHA}O1hAcUlX7zkBbV+/3rmbDfUlbNM=\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a := &HtpasswdAuthenticator{Path: path}
+
+	ident, err := a.Authenticate("alice", "secret pass")
+	if err != nil || ident.Username != "alice" || ident.Backend != "htpasswd" {
+		t.Errorf("got %+v, %v", ident, err)
+	}
+	if _, err := a.Authenticate("alice", "wrong pass"); err != ErrBadCredentials {
+		t.Errorf("wrong password: got %v", err)
+	}
+	if _, err := a.Authenticate("carol", "secret pass"); err != ErrBadCredentials {
+		t.Errorf("unknown user: got %v", err)
+	}
+
+	if found, err := a.HasUser("bob"); !found || err != nil {
+		t.Errorf("bob: got %v, %v", found, err)
+	}
+	if found, err := a.HasUser("carol"); found || err != nil {
+		t.Errorf("carol: got %v, %v", found, err)
+	}
+
+	//Changes to the file are picked up
+	later := time.Now().Add(time.Second)
+	if err := ioutil.WriteFile(path, []byte("carol:{SHA}O1hAcUlX7zkBbV+/3rmbDfUlbNM=\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Authenticate("carol", "secret pass"); err != nil {
+		t.Errorf("added user: got %v", err)
+	}
+	if _, err := a.Authenticate("alice", "secret pass"); err != ErrBadCredentials {
+		t.Errorf("removed user: got %v", err)
+	}
+}
+
+func TestEscapeDN(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"alice", "alice"},
+		{"a,b", `a\,b`},
+		{`a+b"c\d<e>f;g=h`, `a\+b\"c\\d\<e\>f\;g\=h`},
+		{"#alice", `\#alice`},
+		{"al#ice", "al#ice"},
+		{" alice ", `\ alice\ `},
+		{"al ice", "al ice"},
+		{"a\x00b\nc\x7f", `a\00b\0ac\7f`},
+		{"admin,ou=admins", `admin\,ou\=admins`},
+	}
+	for _, test := range tests {
+		if got := escapeDN(test.value); got != test.want {
+			t.Errorf("escapeDN(%q) = %q, want %q", test.value, got, test.want)
+		}
+	}
+}
+
+//Authenticator accepting one user, or failing every request
+type testAuthenticator struct {
+	name     string
+	username string
+	password string
+	err      error
+}
+
+func (a *testAuthenticator) Name() string {
+	return a.name
+}
+
+func (a *testAuthenticator) Authenticate(username string, password string) (Identity, error) {
+	if a.err != nil {
+		return Identity{}, a.err
+	}
+	if username != a.username || password != a.password {
+		return Identity{}, ErrBadCredentials
+	}
+	return Identity{Username: username, Backend: a.name}, nil
+}
+
+func (a *testAuthenticator) HasUser(username string) (bool, error) {
+	return username == a.username, a.err
+}
+
+func TestChainAuthenticator(t *testing.T) {
+	testGallery(t)
+
+	down := &testAuthenticator{name: "down", err: errors.New("connection refused")}
+	chain := ChainAuthenticator{
+		&testAuthenticator{name: "first", username: "alice", password: "first pass"},
+		down,
+		&testAuthenticator{name: "second", username: "bob", password: "second pass"},
+	}
+
+	tests := []struct {
+		username string
+		password string
+		backend  string
+	}{
+		{"alice", "first pass", "first"},
+		{"bob", "second pass", "second"}, //Reached past a backend that is down
+		{"alice", "second pass", ""},
+		{"carol", "first pass", ""},
+	}
+	for _, test := range tests {
+		ident, err := chain.Authenticate(test.username, test.password)
+		if test.backend == "" {
+			if err != ErrBadCredentials {
+				t.Errorf("%s: got %+v, %v, want bad credentials", test.username, ident, err)
+			}
+		} else if err != nil || ident.Backend != test.backend {
+			t.Errorf("%s: got %+v, %v, want backend %s", test.username, ident, err, test.backend)
+		}
+	}
+
+	//Looking users up stops at a backend that cannot answer, since it might have them
+	if found, err := chain.HasUser("alice"); !found || err != nil {
+		t.Errorf("alice: got %v, %v", found, err)
+	}
+	if _, err := chain.HasUser("bob"); err == nil {
+		t.Error("bob: a backend that is down was skipped")
+	}
+	down.err = nil
+	if found, err := chain.HasUser("bob"); !found || err != nil {
+		t.Errorf("bob: got %v, %v", found, err)
+	}
+	if found, err := chain.HasUser("carol"); found || err != nil {
+		t.Errorf("carol: got %v, %v", found, err)
+	}
+}
+
+func TestCheckExternalName(t *testing.T) {
+	testGallery(t)
+	testUsers(t)
+
+	oldAuthenticator := authenticator
+	defer func() { authenticator = oldAuthenticator }()
+	authenticator = ChainAuthenticator{
+		&LocalAuthenticator{Users: users},
+		&testAuthenticator{name: "ldap", username: "alice", password: "secret pass"},
+	}
+
+	if err := checkExternalName("alice"); err != ErrUserExists {
+		t.Errorf("alice: got %v", err)
+	}
+	if err := checkExternalName("bob"); err != nil {
+		t.Errorf("bob: got %v", err)
+	}
+
+	authenticator = ChainAuthenticator{&testAuthenticator{name: "ldap", err: errors.New("connection refused")}}
+	if err := checkExternalName("bob"); err == nil {
+		t.Error("registration allowed while a backend is down")
+	}
+}
+
+func TestConfirmUser(t *testing.T) {
+	testGallery(t)
+	testUsers(t)
+	testSessions(t)
+
+	oldAuthenticator := authenticator
+	defer func() { authenticator = oldAuthenticator }()
+	authenticator = ChainAuthenticator{&LocalAuthenticator{Users: users}}
+
+	if err := users.Add("alice", "secret pass", RoleViewer); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.AddExternal(Identity{Username: "bob", Backend: oidcBackend, Subject: "https://idp.test 1"}, RoleViewer); err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/settings", nil)
+	if err := ConfirmUser(r, "alice", "secret pass"); err != nil {
+		t.Errorf("local user with the password: got %v", err)
+	}
+	if err := ConfirmUser(r, "alice", "wrong pass"); err == nil {
+		t.Error("local user confirmed with a wrong password")
+	}
+
+	//Single sign on users have no password, so they need a recent login
+	session, _ := store.Get(r, "userData")
+	session.Values["username"] = "bob"
+	session.Values["loginTime"] = time.Now().Add(-time.Hour).Unix()
+	if err := ConfirmUser(r, "bob", ""); err == nil {
+		t.Error("single sign on user confirmed an hour after logging in")
+	}
+	session.Values["loginTime"] = time.Now().Unix()
+	if err := ConfirmUser(r, "bob", ""); err != nil {
+		t.Errorf("single sign on user who just logged in: got %v", err)
+	}
+}
+
+//Directory entry of the LDAP stand-in
+type testLDAPEntry struct {
+	password string
+	attrs    map[string]string
+}
+
+//Minimal LDAP server for testing, answering simple binds and searches.
+//Searches need a bind unless anonymous is set.
+type testLDAPServer struct {
+	entries   map[string]testLDAPEntry
+	anonymous bool
+	listener  net.Listener
+}
+
+func newTestLDAPServer(t *testing.T, entries map[string]testLDAPEntry, anonymous bool) *testLDAPServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testLDAPServer{entries: entries, anonymous: anonymous, listener: listener}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *testLDAPServer) URL() string {
+	return "ldap://" + s.listener.Addr().String()
+}
+
+//Answers the requests of one connection
+func (s *testLDAPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	bound := ""
+
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+		id := packet.Children[0].Value.(int64)
+		op := packet.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].Data.String()
+			password := op.Children[2].Data.String()
+			code := uint16(ldap.LDAPResultInvalidCredentials)
+			if entry, ok := s.entries[dn]; ok && password != "" && password == entry.password {
+				code = ldap.LDAPResultSuccess
+				bound = dn
+			}
+			s.reply(conn, id, ldap.ApplicationBindResponse, code)
+
+		case ldap.ApplicationSearchRequest:
+			if bound == "" && !s.anonymous {
+				s.reply(conn, id, ldap.ApplicationSearchResultDone, ldap.LDAPResultInsufficientAccessRights)
+				continue
+			}
+			base := op.Children[0].Data.String()
+			scope := op.Children[1].Value.(int64)
+			filter := op.Children[6]
+
+			if scope == ldap.ScopeBaseObject {
+				entry, ok := s.entries[base]
+				if !ok {
+					s.reply(conn, id, ldap.ApplicationSearchResultDone, ldap.LDAPResultNoSuchObject)
+					continue
+				}
+				s.sendEntry(conn, id, base, entry)
+			} else if filter.Tag == ldap.FilterEqualityMatch {
+				attr, value := filter.Children[0].Data.String(), filter.Children[1].Data.String()
+				for dn, entry := range s.entries {
+					if strings.HasSuffix(dn, ","+base) && entry.attrs[attr] == value {
+						s.sendEntry(conn, id, dn, entry)
+					}
+				}
+			}
+			s.reply(conn, id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess)
+
+		case ldap.ApplicationUnbindRequest:
+			return
+		}
+	}
+}
+
+//Sends a message with the given protocol operation and result code
+func (s *testLDAPServer) reply(conn net.Conn, id int64, tag ber.Tag, code uint16) {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, int64(code), ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", ""))
+	s.send(conn, id, op)
+}
+
+//Sends one search result
+func (s *testLDAPServer) sendEntry(conn net.Conn, id int64, dn string, entry testLDAPEntry) {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, dn, ""))
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	for name, value := range entry.attrs {
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, ""))
+		values := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "")
+		values.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, ""))
+		attr.AppendChild(values)
+		attrs.AppendChild(attr)
+	}
+	op.AppendChild(attrs)
+	s.send(conn, id, op)
+}
+
+func (s *testLDAPServer) send(conn net.Conn, id int64, op *ber.Packet) {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, ""))
+	packet.AppendChild(op)
+	conn.Write(packet.Bytes())
+}
+
+func TestLDAPAuthenticator(t *testing.T) {
+	entries := map[string]testLDAPEntry{
+		"uid=alice,ou=people,dc=example,dc=com": {"alice pass", map[string]string{"uid": "alice", "cn": "Alice Example"}},
+		"uid=bob,ou=people,dc=example,dc=com":   {"bob pass", map[string]string{"uid": "bob", "cn": "Bob Example"}},
+		"cn=gallery,dc=example,dc=com":          {"service pass", map[string]string{"cn": "gallery"}},
+	}
+	server := newTestLDAPServer(t, entries, false)
+
+	direct := &LDAPAuthenticator{Timeout: 5 * time.Second, Config: LDAPConfig{
+		URL:             server.URL(),
+		UserDN:          "uid=%s,ou=people,dc=example,dc=com",
+		DisplayNameAttr: "cn",
+	}}
+	search := &LDAPAuthenticator{Timeout: 5 * time.Second, Config: LDAPConfig{
+		URL:             server.URL(),
+		BindDN:          "cn=gallery,dc=example,dc=com",
+		BindPassword:    "service pass",
+		BaseDN:          "ou=people,dc=example,dc=com",
+		UserFilter:      "(uid=%s)",
+		DisplayNameAttr: "cn",
+	}}
+
+	for name, a := range map[string]*LDAPAuthenticator{"direct": direct, "search": search} {
+		ident, err := a.Authenticate("alice", "alice pass")
+		if err != nil || ident.Username != "alice" || ident.DisplayName != "Alice Example" || ident.Backend != "ldap" {
+			t.Errorf("%s: got %+v, %v", name, ident, err)
+		}
+
+		tests := []struct {
+			username string
+			password string
+		}{
+			{"alice", "bob pass"},
+			{"alice", ""}, //Would be an anonymous bind
+			{"carol", "alice pass"},
+			{"alice,ou=people,dc=example,dc=com", "alice pass"},
+			{"*", "alice pass"},
+		}
+		for _, test := range tests {
+			if ident, err := a.Authenticate(test.username, test.password); err != ErrBadCredentials {
+				t.Errorf("%s: %q with %q got %+v, %v", name, test.username, test.password, ident, err)
+			}
+		}
+	}
+
+	//Looking users up needs a bind, which only the search config has
+	if found, err := search.HasUser("bob"); !found || err != nil {
+		t.Errorf("search bob: got %v, %v", found, err)
+	}
+	if found, err := search.HasUser("carol"); found || err != nil {
+		t.Errorf("search carol: got %v, %v", found, err)
+	}
+	if _, err := direct.HasUser("bob"); err == nil {
+		t.Error("direct lookup succeeded without access")
+	}
+	direct.Config.URL = newTestLDAPServer(t, entries, true).URL()
+	if found, err := direct.HasUser("bob"); !found || err != nil {
+		t.Errorf("direct bob: got %v, %v", found, err)
+	}
+	if found, err := direct.HasUser("carol"); found || err != nil {
+		t.Errorf("direct carol: got %v, %v", found, err)
+	}
+
+	//A directory that is down is an error, not wrong credentials
+	server.listener.Close()
+	direct.Config.URL = server.URL()
+	if _, err := direct.Authenticate("alice", "alice pass"); err == nil || err == ErrBadCredentials {
+		t.Errorf("directory down: got %v", err)
+	}
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//Kinds of problem found by the gallery check
+const (
+	ProblemOrphan  = "orphan"  //A file no image uses
+	ProblemMissing = "missing" //A file an image needs is not there
+	ProblemCorrupt = "corrupt" //A file that is empty or does not decode
+)
+
+//Files changed more recently than this are not reported as orphans,
+//since uploads move their files into place before the image is recorded
+const checkGracePeriod = 10 * time.Minute
+
+//Stops two repairs running at once
+var checkMu sync.Mutex
+
+//A problem found by the gallery check
+type Problem struct {
+	Kind   string
+	File   string //Storage name, such as "thumbnails/arch_thumb.jpg"
+	Detail string
+	Fixed  bool
+	Error  string //Why the problem could not be fixed
+}
+
+//Returns whether the problem was fixed, "" if no repair was tried
+func (p Problem) Status() string {
+	switch {
+	case p.Fixed:
+		return "fixed"
+	case p.Error != "":
+		return "not fixed: " + p.Error
+	}
+	return ""
+}
+
+//What a gallery check found
+type CheckReport struct {
+	Images   int //Image records checked
+	Files    int //Stored files checked
+	Problems []Problem
+	Repaired bool
+}
+
+//Returns the number of problems left
+func (c CheckReport) Unfixed() int {
+	count := 0
+	for _, p := range c.Problems {
+		if !p.Fixed {
+			count++
+		}
+	}
+	return count
+}
+
+type AdminCheckData struct {
+	LoggedIn  bool
+	Username  string
+	CSRFToken string
+	Report    CheckReport
+	Message   string
+	Error     string
+}
+
+//Checks cookie data to see is user is logged in.
+func (data *AdminCheckData) GetLoginData(r *http.Request) {
+	session, _ := store.Get(r, "userData")
+	data.CSRFToken = CSRFToken(r)
+
+	if IsNil(session.Values["username"]) { //If cookie not found or user logged out
+		data.LoggedIn = false
+	} else {
+		data.Username = session.Values["username"].(string)
+		data.LoggedIn = true
+	}
+}
+
+//The state of one run of the gallery check
+type galleryCheck struct {
+	repair bool
+	report CheckReport
+}
+
+//Records a problem, fixing it first if the check repairs problems
+func (c *galleryCheck) problem(kind string, file string, detail string, fix func() error) {
+	p := Problem{Kind: kind, File: file, Detail: detail}
+	if c.repair {
+		if err := fix(); err != nil {
+			p.Error = err.Error()
+		} else {
+			p.Fixed = true
+			Log("repaired " + kind + " file " + file + ": " + detail)
+		}
+	}
+	c.report.Problems = append(c.report.Problems, p)
+}
+
+//Lists a storage folder, returning the files in name order and by name
+func listChecked(folder string) ([]FileInfo, map[string]FileInfo, error) {
+	files, err := storage.List(folder)
+	if err != nil {
+		return nil, nil, err
+	}
+	byName := make(map[string]FileInfo, len(files))
+	for _, f := range files {
+		byName[f.Name] = f
+	}
+	return files, byName, nil
+}
+
+//Returns why a stored image cannot be used, or "" if it decodes
+func brokenImage(name string, info FileInfo) string {
+	if info.Size == 0 {
+		return "the file is empty"
+	}
+	if _, err := LoadImage(name); err != nil {
+		return "the file does not decode: " + err.Error()
+	}
+	return ""
+}
+
+//Checks that the images, thumbnails, resized copies and earlier versions in storage
+//match the image records: every image has all its files, every file decodes and
+//every file belongs to an image. If repair is set the problems found are fixed:
+//  - orphaned thumbnails, resized copies, versions and staged uploads are deleted, and
+//    image files without a record are added to the gallery as they would be on startup,
+//    with their thumbnail and resized copies
+//  - missing or broken thumbnails and resized copies are made again
+//  - missing or broken versions are dropped from their image
+//  - an image whose file is missing or broken goes back to its latest earlier version,
+//    or is deleted with the images sharing its file if it has none
+func CheckGallery(repair bool) (CheckReport, error) {
+	if repair {
+		checkMu.Lock()
+		defer checkMu.Unlock()
+	}
+	c := &galleryCheck{repair: repair}
+	c.report.Repaired = repair
+
+	images, imagesByName, err := listChecked(ImagesFolder)
+	if err != nil {
+		return c.report, err
+	}
+	thumbnails, thumbnailsByName, err := listChecked(ThumbnailsFolder)
+	if err != nil {
+		return c.report, err
+	}
+	resized, resizedByName, err := listChecked(ResizedFolder)
+	if err != nil {
+		return c.report, err
+	}
+	versions, versionsByName, err := listChecked(VersionsFolder)
+	if err != nil {
+		return c.report, err
+	}
+	staging, _, err := listChecked(StagingFolder)
+	if err != nil {
+		return c.report, err
+	}
+	c.report.Files = len(images) + len(thumbnails) + len(resized) + len(versions) + len(staging)
+
+	records := imageMeta.List()
+	c.report.Images = len(records)
+
+	//Every file an image uses, by storage name. Image files without a record
+	//keep their thumbnail and resized copies, since repairing adds them.
+	used := make(map[string]bool)
+	for _, f := range images {
+		for _, name := range derivativeNames(f.Name) {
+			used[name] = true
+		}
+	}
+	for _, m := range records {
+		used[StorageName(ImagesFolder, m.Filename)] = true
+		if m.Blob == "" {
+			for _, name := range derivativeNames(m.Filename) {
+				used[name] = true
+			}
+		}
+		for _, v := range m.Versions {
+			used[StorageName(VersionsFolder, v.File)] = true
+		}
+	}
+
+	for _, m := range records {
+		c.checkVersions(m, versionsByName)
+
+		if m.Blob != "" {
+			if _, ok := imagesByName[m.Blob]; !ok {
+				filename := m.Filename
+				c.problem(ProblemMissing, StorageName(ImagesFolder, m.Blob), filename+" shares the file of "+m.Blob+", which is missing", func() error {
+					return removeImageRecord(filename)
+				})
+			}
+			continue
+		}
+
+		name := StorageName(ImagesFolder, m.Filename)
+		info, ok := imagesByName[m.Filename]
+		if !ok {
+			c.problem(ProblemMissing, name, "the image has a record but no file", c.restoreImage(m.Filename))
+			continue
+		}
+		if reason := brokenImage(name, info); reason != "" {
+			c.problem(ProblemCorrupt, name, reason, c.restoreImage(m.Filename))
+			continue
+		}
+		c.checkDerivatives(m.Filename, thumbnailsByName, resizedByName)
+	}
+
+	//Image files without a record are added by the scan run on startup,
+	//unless they cannot be read
+	now := time.Now()
+	scanned := false
+	for _, f := range images {
+		name := StorageName(ImagesFolder, f.Name)
+		if used[name] || now.Sub(f.ModTime) < checkGracePeriod {
+			continue
+		}
+		if reason := brokenImage(name, f); reason != "" {
+			c.problem(ProblemCorrupt, name, reason+" and it has no record", func() error {
+				return storage.Delete(name)
+			})
+			continue
+		}
+		filename := f.Name
+		c.problem(ProblemOrphan, name, "the image file has no record", func() error {
+			if !scanned {
+				scanned = true
+				if err := imageMeta.Scan(); err != nil {
+					return err
+				}
+			}
+			if _, found := imageMeta.Get(filename); !found {
+				return errors.New("the image could not be added")
+			}
+			GenerateThumnail(filename)
+			GenerateAllSizes(filename)
+			return nil
+		})
+	}
+
+	for _, folder := range []struct {
+		name  string
+		files []FileInfo
+	}{{ThumbnailsFolder, thumbnails}, {ResizedFolder, resized}, {VersionsFolder, versions}} {
+		for _, f := range folder.files {
+			name := StorageName(folder.name, f.Name)
+			if used[name] || now.Sub(f.ModTime) < checkGracePeriod {
+				continue
+			}
+			c.problem(ProblemOrphan, name, "no image uses this file", func() error {
+				return storage.Delete(name)
+			})
+		}
+	}
+
+	//Uploads still being saved are in the staging folder, so only old files there are left over
+	for _, f := range staging {
+		name := StorageName(StagingFolder, f.Name)
+		if now.Sub(f.ModTime) < checkGracePeriod {
+			continue
+		}
+		c.problem(ProblemOrphan, name, "an upload that never finished left this file", func() error {
+			return storage.Delete(name)
+		})
+	}
+
+	return c.report, nil
+}
+
+//Checks the thumbnail and resized copies of an image, making missing or broken ones again
+func (c *galleryCheck) checkDerivatives(filename string, thumbnails map[string]FileInfo, resized map[string]FileInfo) {
+	c.checkDerivative(ThumbnailsFolder, FormatName(filename, "thumb"), thumbnails, "the thumbnail of "+filename, func() {
+		GenerateThumnail(filename)
+	})
+	for _, size := range imageSizes {
+		c.checkDerivative(ResizedFolder, FormatName(filename, fmt.Sprintf("%v", size)), resized, fmt.Sprintf("the %vpx copy of %s", size, filename), func() {
+			GenerateAllSizes(filename)
+		})
+	}
+}
+
+//Checks a thumbnail or resized copy, which generate makes again
+func (c *galleryCheck) checkDerivative(folder string, file string, files map[string]FileInfo, what string, generate func()) {
+	name := StorageName(folder, file)
+	remake := func() error {
+		generate()
+		if !StorageExists(name) {
+			return errors.New("it could not be made again")
+		}
+		return nil
+	}
+
+	info, ok := files[file]
+	if !ok {
+		c.problem(ProblemMissing, name, what+" is missing", remake)
+		return
+	}
+	if reason := brokenImage(name, info); reason != "" {
+		c.problem(ProblemCorrupt, name, reason, func() error {
+			if err := storage.Delete(name); err != nil {
+				return err
+			}
+			return remake()
+		})
+	}
+}
+
+//Checks the earlier versions of an image, dropping missing or broken ones
+func (c *galleryCheck) checkVersions(m ImageMeta, versions map[string]FileInfo) {
+	for _, v := range m.Versions {
+		name := StorageName(VersionsFolder, v.File)
+		filename, number := m.Filename, v.Number
+		drop := func() error {
+			return dropVersion(filename, number)
+		}
+
+		info, ok := versions[v.File]
+		if !ok {
+			c.problem(ProblemMissing, name, fmt.Sprintf("version %v of %s is missing", number, filename), drop)
+			continue
+		}
+		if reason := brokenImage(name, info); reason != "" {
+			c.problem(ProblemCorrupt, name, reason, drop)
+		}
+	}
+}
+
+//Returns a fix for an image whose file is missing or broken. The image goes back to
+//its latest earlier version, or is deleted if it has none.
+func (c *galleryCheck) restoreImage(filename string) func() error {
+	return func() error {
+		//Versions found broken earlier in the check have been dropped by now
+		m, found := imageMeta.Get(filename)
+		if !found {
+			return nil
+		}
+		if len(m.Versions) == 0 {
+			return removeBrokenImage(filename)
+		}
+		return restoreLatestVersion(m)
+	}
+}
+
+//Deletes an earlier version of an image and its record
+func dropVersion(filename string, number int) error {
+	m, _ := imageMeta.Get(filename)
+	if v, found := m.FindVersion(number); found {
+		if err := storage.Delete(StorageName(VersionsFolder, v.File)); err != nil {
+			return err
+		}
+	}
+	return imageMeta.Update(filename, func(m *ImageMeta) {
+		for i, v := range m.Versions {
+			if v.Number == number {
+				m.Versions = append(m.Versions[:i:i], m.Versions[i+1:]...)
+				return
+			}
+		}
+	})
+}
+
+//Makes the latest earlier version of an image its current file
+func restoreLatestVersion(m ImageMeta) error {
+	v := m.Versions[len(m.Versions)-1]
+	if err := copyStorageFile(StorageName(VersionsFolder, v.File), StorageName(ImagesFolder, m.Filename)); err != nil {
+		return err
+	}
+	deleteDerivatives(m.Filename)
+
+	err := imageMeta.Update(m.Filename, func(m *ImageMeta) {
+		m.Versions = m.Versions[:len(m.Versions)-1]
+		m.Version = v.Number
+		m.VersionBy, m.VersionUploaded = v.By, v.Uploaded
+		m.OriginalName = v.OriginalName
+		m.Format, m.Width, m.Height, m.Size = v.Format, v.Width, v.Height, v.Size
+		m.SHA256 = v.SHA256
+		m.Thumbnail, m.Resized, m.DerivedSize = false, nil, 0
+	})
+	if err != nil {
+		return err
+	}
+	storage.Delete(StorageName(VersionsFolder, v.File))
+
+	GenerateThumnail(m.Filename)
+	GenerateAllSizes(m.Filename)
+	return nil
+}
+
+//Deletes an image whose file is missing or broken, along with the images sharing its file
+func removeBrokenImage(filename string) error {
+	for _, link := range imageMeta.Links(filename) {
+		if err := removeImageRecord(link.Filename); err != nil {
+			return err
+		}
+	}
+	shares.DeleteImage(filename)
+	return DeleteImage(filename)
+}
+
+//Deletes the record, share links and earlier versions of an image without touching its file.
+//Versions listed on an image sharing another image's files belong to that image.
+func removeImageRecord(filename string) error {
+	if m, _ := imageMeta.Get(filename); m.Blob == "" {
+		deleteVersions(m)
+	}
+	shares.DeleteImage(filename)
+	return imageMeta.Delete(filename)
+}
+
+//Runs the check subcommand: "check" reports problems with the gallery's files
+//and "check -repair" fixes them too. Returns the exit code, 1 if problems are left.
+func checkCommand(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "fix the problems found")
+	flags.Parse(args)
+
+	report, err := CheckGallery(*repair)
+	if err != nil {
+		fmt.Println("Could not check the gallery:", err)
+		return 1
+	}
+
+	for _, p := range report.Problems {
+		line := fmt.Sprintf("%-8s %s: %s", p.Kind, p.File, p.Detail)
+		if status := p.Status(); status != "" {
+			line += " (" + status + ")"
+		}
+		fmt.Println(line)
+	}
+	fmt.Printf("Checked %d images and %d files: %d problems found, %d left\n",
+		report.Images, report.Files, len(report.Problems), report.Unfixed())
+
+	if report.Unfixed() > 0 {
+		return 1
+	}
+	return 0
+}
+
+//Generates the gallery check page and repairs the problems found when asked
+func getAdminCheck(w http.ResponseWriter, r *http.Request) {
+	tmpl := template.Must(template.ParseFiles("assets/admin_check.html", "assets/Templates.html"))
+	var data AdminCheckData
+	data.GetLoginData(r)
+
+	repair := false
+	if r.Method == http.MethodPost {
+		if r.FormValue("action") == "repair" {
+			repair = true
+		} else {
+			data.Error = "Unknown action"
+		}
+	}
+
+	report, err := CheckGallery(repair)
+	if err != nil {
+		data.Error = err.Error()
+	}
+	data.Report = report
+
+	if repair && err == nil {
+		fixed := len(report.Problems) - report.Unfixed()
+		data.Message = fmt.Sprintf("Fixed %v of %v problems", fixed, len(report.Problems))
+		Log(data.Username + " repaired the gallery: " + data.Message)
+		Audit(r, AuditRepair, data.Username, "gallery", fmt.Sprintf("fixed %v of %v problems", fixed, len(report.Problems)))
+	}
+
+	DisplayError(w, r, tmpl.Execute(w, data))
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//Makes a stored file look older than the check's grace period
+func ageTestFile(t *testing.T, dir string, name string) {
+	t.Helper()
+	old := time.Now().Add(-2 * checkGracePeriod)
+	if err := os.Chtimes(filepath.Join(dir, "assets", filepath.FromSlash(name)), old, old); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//Returns the problems of a report by file
+func problemsByFile(report CheckReport) map[string]Problem {
+	problems := make(map[string]Problem)
+	for _, p := range report.Problems {
+		problems[p.File] = p
+	}
+	return problems
+}
+
+func TestCheckGallery(t *testing.T) {
+	dir := testGallery(t)
+
+	//A complete image
+	putTestFile(t, StorageName(ImagesFolder, "arch.png"), testPNG(t, 1))
+	if err := imageMeta.Add(ImageMeta{Filename: "arch.png"}); err != nil {
+		t.Fatal(err)
+	}
+	GenerateThumnail("arch.png")
+	GenerateAllSizes("arch.png")
+
+	//An image missing its file, a broken thumbnail, an orphaned thumbnail and a staged file left over
+	if err := imageMeta.Add(ImageMeta{Filename: "gone.png"}); err != nil {
+		t.Fatal(err)
+	}
+	putTestFile(t, StorageName(ThumbnailsFolder, "arch_thumb.jpg"), nil)
+	putTestFile(t, StorageName(ThumbnailsFolder, "stray_thumb.jpg"), testPNG(t, 2))
+	ageTestFile(t, dir, StorageName(ThumbnailsFolder, "stray_thumb.jpg"))
+	putTestFile(t, StorageName(StagingFolder, "abc.png"), testPNG(t, 3))
+	ageTestFile(t, dir, StorageName(StagingFolder, "abc.png"))
+	//A recent orphan may belong to an upload being saved
+	putTestFile(t, StorageName(ThumbnailsFolder, "new_thumb.jpg"), testPNG(t, 4))
+	//An image file without a record keeps its thumbnail, since repairing adds it
+	putTestFile(t, StorageName(ImagesFolder, "found.png"), testPNG(t, 5))
+	ageTestFile(t, dir, StorageName(ImagesFolder, "found.png"))
+	putTestFile(t, StorageName(ThumbnailsFolder, "found_thumb.jpg"), testPNG(t, 6))
+	ageTestFile(t, dir, StorageName(ThumbnailsFolder, "found_thumb.jpg"))
+
+	tests := []struct {
+		file string
+		kind string
+	}{
+		{StorageName(ImagesFolder, "gone.png"), ProblemMissing},
+		{StorageName(ThumbnailsFolder, "arch_thumb.jpg"), ProblemCorrupt},
+		{StorageName(ThumbnailsFolder, "stray_thumb.jpg"), ProblemOrphan},
+		{StorageName(StagingFolder, "abc.png"), ProblemOrphan},
+		{StorageName(ImagesFolder, "found.png"), ProblemOrphan},
+	}
+
+	report, err := CheckGallery(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	problems := problemsByFile(report)
+	for _, test := range tests {
+		if p, found := problems[test.file]; !found || p.Kind != test.kind {
+			t.Errorf("%s: got %+v, want a %s problem", test.file, p, test.kind)
+		}
+	}
+	if len(report.Problems) != len(tests) {
+		t.Errorf("found %d problems, want %d: %+v", len(report.Problems), len(tests), report.Problems)
+	}
+	//Checking without repairing changes nothing
+	if _, found := imageMeta.Get("gone.png"); !found {
+		t.Error("the check removed a record without repairing")
+	}
+	if !StorageExists(StorageName(ThumbnailsFolder, "stray_thumb.jpg")) {
+		t.Error("the check deleted an orphan without repairing")
+	}
+
+	report, err = CheckGallery(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left := report.Unfixed(); left != 0 {
+		t.Errorf("%d problems left after repairing: %+v", left, report.Problems)
+	}
+	if _, found := imageMeta.Get("gone.png"); found {
+		t.Error("the record without a file was kept")
+	}
+	if StorageExists(StorageName(ThumbnailsFolder, "stray_thumb.jpg")) || StorageExists(StorageName(StagingFolder, "abc.png")) {
+		t.Error("orphans were kept")
+	}
+	if !StorageExists(StorageName(ThumbnailsFolder, "new_thumb.jpg")) {
+		t.Error("a recent file was deleted")
+	}
+	if _, found := imageMeta.Get("found.png"); !found {
+		t.Error("the image file without a record was not added")
+	}
+	if !StorageExists(StorageName(ThumbnailsFolder, "found_thumb.jpg")) {
+		t.Error("the thumbnail of an image file without a record was deleted")
+	}
+
+	report, err = CheckGallery(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Problems) != 0 {
+		t.Errorf("problems left after repairing: %+v", report.Problems)
+	}
+}
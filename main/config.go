@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+const (
+	defaultConfigPath = "./config.json"
+	generatedKeyPath  = "./data/session.key"
+)
+
+//Settings read from config.json, with some overridable through environment variables
+type Config struct {
+	//Session keys as "hashKey:blockKey" base64 pairs.
+	//The first pair signs new cookies, later pairs are only used to read old ones
+	//so keys can be rotated without logging everybody out.
+	//The block key may be left out to sign cookies without encrypting them.
+	SessionKeys []string `json:"session_keys"`
+
+	CookieSecure   bool   `json:"cookie_secure"`    //Only send cookies over https
+	CookieSameSite string `json:"cookie_same_site"` //"lax", "strict" or "none"
+	CookieMaxAge   int    `json:"cookie_max_age"`   //Cookie lifetime in seconds
+
+	//Logged in sessions end after session_idle_timeout seconds without a request,
+	//or session_absolute_timeout seconds after logging in. 0 turns a timeout off.
+	//Logins with "remember me" ignore both and last remember_me_max_age seconds.
+	SessionIdleTimeout     int `json:"session_idle_timeout"`
+	SessionAbsoluteTimeout int `json:"session_absolute_timeout"`
+	RememberMeMaxAge       int `json:"remember_me_max_age"`
+
+	//Failed logins allowed per username and per IP address before logins are delayed.
+	//Every further failure doubles the lockout, starting at login_lockout_base seconds
+	//up to login_lockout_max seconds.
+	LoginAttemptsUser int `json:"login_attempts_user"`
+	LoginAttemptsIP   int `json:"login_attempts_ip"`
+	LoginLockoutBase  int `json:"login_lockout_base"`
+	LoginLockoutMax   int `json:"login_lockout_max"`
+
+	//Reverse proxies, as IP addresses or CIDR ranges, trusted to give the client's
+	//IP address in the client_ip_header, such as "X-Forwarded-For" or "X-Real-IP".
+	//Requests from any other address use the address they came from, so without
+	//this every user behind a proxy shares the proxy's address and login lockout.
+	TrustedProxies []string `json:"trusted_proxies"`
+	ClientIPHeader string   `json:"client_ip_header"`
+
+	//Where passwords are checked, tried in order: "local", "htpasswd" and "ldap"
+	AuthBackends []string   `json:"auth_backends"`
+	HtpasswdFile string     `json:"htpasswd_file"`
+	LDAP         LDAPConfig `json:"ldap"`
+	//Role given to users the first time they log in through htpasswd or ldap
+	ExternalRole string `json:"external_role"`
+
+	//Single sign on, turned on by setting oidc.issuer
+	OIDC OIDCConfig `json:"oidc"`
+
+	//Where image files are kept
+	Storage StorageConfig `json:"storage"`
+
+	//What to do with an upload identical to an image already in the gallery:
+	//"reject" it, or "link" the new name to the existing image's files
+	DuplicateUploads string `json:"duplicate_uploads"`
+	//What to do with an upload named like an image already in the gallery:
+	//"rename" it with a number, or "replace" the image if the uploader may delete it
+	UploadCollisions string `json:"upload_collisions"`
+
+	//Seconds deleted images stay in the trash before they are deleted for good, 0 keeps them
+	TrashRetention int `json:"trash_retention"`
+
+	//Megabytes of storage each user's images and the whole gallery may use, 0 for no limit.
+	//Thumbnails, resized copies, earlier versions and the trash all count.
+	UserQuotaMB  int `json:"user_quota_mb"`
+	TotalQuotaMB int `json:"total_quota_mb"`
+}
+
+//Global configuration, loaded in main
+var config = Config{
+	CookieSameSite: "lax",
+	CookieMaxAge:   86400 * 7,
+
+	SessionIdleTimeout:     60 * 30,
+	SessionAbsoluteTimeout: 3600 * 12,
+	RememberMeMaxAge:       86400 * 30,
+
+	LoginAttemptsUser: 5,
+	LoginAttemptsIP:   20,
+	LoginLockoutBase:  30,
+	LoginLockoutMax:   3600,
+
+	ClientIPHeader: "X-Forwarded-For",
+
+	AuthBackends: []string{localBackend},
+	LDAP: LDAPConfig{
+		UserFilter:      "(uid=%s)",
+		DisplayNameAttr: "cn",
+	},
+	ExternalRole: RoleViewer,
+	OIDC: OIDCConfig{
+		Scopes:           []string{"profile", "email"},
+		Label:            "Single Sign On",
+		UsernameClaim:    "preferred_username",
+		DisplayNameClaim: "name",
+	},
+	Storage: StorageConfig{
+		Type:      "local",
+		LocalPath: "assets",
+	},
+	DuplicateUploads: DuplicateReject,
+	UploadCollisions: CollisionRename,
+	TrashRetention:   86400 * 30,
+}
+
+//Loads the config file, if there is one, and applies environment overrides:
+//GALLERY_CONFIG          path of the config file
+//GALLERY_SESSION_KEYS    comma separated session key pairs
+//GALLERY_COOKIE_SECURE   "true" to only send cookies over https
+//GALLERY_TRUSTED_PROXIES comma separated trusted proxy addresses
+//GALLERY_S3_ACCESS_KEY   access key of the s3 storage
+//GALLERY_S3_SECRET_KEY   secret key of the s3 storage
+func LoadConfig() error {
+	path := os.Getenv("GALLERY_CONFIG")
+	if path == "" {
+		path = defaultConfigPath
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(data, &config); err != nil {
+			return fmt.Errorf("reading %s: %v", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if keys := os.Getenv("GALLERY_SESSION_KEYS"); keys != "" {
+		config.SessionKeys = strings.Split(keys, ",")
+	}
+	if secure := os.Getenv("GALLERY_COOKIE_SECURE"); secure != "" {
+		config.CookieSecure, err = strconv.ParseBool(secure)
+		if err != nil {
+			return fmt.Errorf("GALLERY_COOKIE_SECURE: %v", err)
+		}
+	}
+	if proxies := os.Getenv("GALLERY_TRUSTED_PROXIES"); proxies != "" {
+		config.TrustedProxies = strings.Split(proxies, ",")
+	}
+	if key := os.Getenv("GALLERY_S3_ACCESS_KEY"); key != "" {
+		config.Storage.S3.AccessKey = key
+	}
+	if key := os.Getenv("GALLERY_S3_SECRET_KEY"); key != "" {
+		config.Storage.S3.SecretKey = key
+	}
+
+	if config.DuplicateUploads != DuplicateReject && config.DuplicateUploads != DuplicateLink {
+		return fmt.Errorf("unknown duplicate_uploads value %q", config.DuplicateUploads)
+	}
+	if config.UploadCollisions != CollisionRename && config.UploadCollisions != CollisionReplace {
+		return fmt.Errorf("unknown upload_collisions value %q", config.UploadCollisions)
+	}
+	trustedProxies, err = parseTrustedProxies(config.TrustedProxies)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+//Decodes the configured session keys into the flat hash/block list gorilla/sessions expects.
+//If none are configured a key pair is generated once and kept in the data folder.
+func SessionKeyPairs() ([][]byte, error) {
+	keys := config.SessionKeys
+	if len(keys) == 0 {
+		generated, err := generatedSessionKey()
+		if err != nil {
+			return nil, err
+		}
+		keys = []string{generated}
+	}
+
+	var pairs [][]byte
+	for i, pair := range keys {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+
+		hashKey, err := base64.StdEncoding.DecodeString(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("session key %d: %v", i+1, err)
+		}
+		if len(hashKey) < 32 {
+			return nil, fmt.Errorf("session key %d: hash key must be at least 32 bytes", i+1)
+		}
+
+		var blockKey []byte
+		if len(parts) == 2 && parts[1] != "" {
+			blockKey, err = base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				return nil, fmt.Errorf("session key %d: %v", i+1, err)
+			}
+			if l := len(blockKey); l != 16 && l != 24 && l != 32 {
+				return nil, fmt.Errorf("session key %d: block key must be 16, 24 or 32 bytes", i+1)
+			}
+		}
+
+		pairs = append(pairs, hashKey, blockKey)
+	}
+
+	return pairs, nil
+}
+
+//Reads the generated session key pair, creating it on first use
+func generatedSessionKey() (string, error) {
+	data, err := ioutil.ReadFile(generatedKeyPath)
+	if err == nil {
+		return strings.TrimSpace(string(data)), nil
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	hashKey := securecookie.GenerateRandomKey(64)
+	blockKey := securecookie.GenerateRandomKey(32)
+	if hashKey == nil || blockKey == nil {
+		return "", errors.New("could not generate session keys")
+	}
+	key := base64.StdEncoding.EncodeToString(hashKey) + ":" + base64.StdEncoding.EncodeToString(blockKey)
+
+	if err := os.MkdirAll(filepath.Dir(generatedKeyPath), os.ModePerm); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(generatedKeyPath, []byte(key+"\n"), 0600); err != nil {
+		return "", err
+	}
+
+	fmt.Println("No session keys configured, generated new keys in " + generatedKeyPath)
+	return key, nil
+}
+
+//Returns the cookie options built from the config
+func CookieOptions() (*sessions.Options, error) {
+	options := &sessions.Options{
+		Path:     "/",
+		MaxAge:   config.CookieMaxAge,
+		Secure:   config.CookieSecure,
+		HttpOnly: true,
+	}
+
+	switch strings.ToLower(config.CookieSameSite) {
+	case "", "lax":
+		options.SameSite = http.SameSiteLaxMode
+	case "strict":
+		options.SameSite = http.SameSiteStrictMode
+	case "none":
+		//Browsers reject SameSite=None cookies that are not also Secure
+		if !config.CookieSecure {
+			return nil, errors.New("cookie_same_site \"none\" requires cookie_secure")
+		}
+		options.SameSite = http.SameSiteNoneMode
+	default:
+		return nil, fmt.Errorf("unknown cookie_same_site value %q", config.CookieSameSite)
+	}
+
+	return options, nil
+}
+
+//Creates the global session store from the configured keys and options
+func SetupSessionStore() error {
+	pairs, err := SessionKeyPairs()
+	if err != nil {
+		return err
+	}
+
+	options, err := CookieOptions()
+	if err != nil {
+		return err
+	}
+
+	serverStore, err := NewServerStore(sessionsPath, pairs...)
+	if err != nil {
+		return err
+	}
+	serverStore.Options = options
+	serverStore.MaxAge(options.MaxAge)
+	serverStore.SetTimeouts(
+		time.Duration(config.SessionIdleTimeout)*time.Second,
+		time.Duration(config.SessionAbsoluteTimeout)*time.Second,
+		time.Duration(config.RememberMeMaxAge)*time.Second,
+	)
+	store = serverStore
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+
+	"github.com/gorilla/securecookie"
+)
+
+func TestSessionKeyPairs(t *testing.T) {
+	testGallery(t)
+	key := func(n int) string {
+		return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, n))
+	}
+
+	tests := []struct {
+		name  string
+		keys  []string
+		pairs int
+	}{
+		{"hash and block key", []string{key(64) + ":" + key(32)}, 1},
+		{"hash key only", []string{key(32)}, 1},
+		{"empty block key", []string{key(32) + ":"}, 1},
+		{"rotated keys", []string{key(64) + ":" + key(16), " " + key(32) + ":" + key(24) + " "}, 2},
+		{"short hash key", []string{key(16)}, 0},
+		{"odd block key", []string{key(32) + ":" + key(20)}, 0},
+		{"not base64", []string{"not base64!"}, 0},
+		{"bad second key", []string{key(32), key(8)}, 0},
+	}
+	for _, test := range tests {
+		config.SessionKeys = test.keys
+		pairs, err := SessionKeyPairs()
+		if test.pairs == 0 {
+			if err == nil {
+				t.Errorf("%s: accepted", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if len(pairs) != 2*test.pairs {
+			t.Errorf("%s: got %d keys, want %d", test.name, len(pairs), 2*test.pairs)
+		}
+	}
+
+	//Without configured keys one pair is generated and kept
+	config.SessionKeys = nil
+	first, err := SessionKeyPairs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := SessionKeyPairs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(first) != 2 || !bytes.Equal(first[0], second[0]) || !bytes.Equal(first[1], second[1]) {
+		t.Error("the generated key changed between loads")
+	}
+}
+
+func TestSessionKeyRotation(t *testing.T) {
+	testGallery(t)
+	oldKey := base64.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)) + ":" + base64.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+	newKey := base64.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)) + ":" + base64.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+
+	config.SessionKeys = []string{oldKey}
+	pairs, err := SessionKeyPairs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie, err := securecookie.EncodeMulti("userData", "session id", securecookie.CodecsFromPairs(pairs...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		keys []string
+		ok   bool
+	}{
+		{"old key kept after the new one", []string{newKey, oldKey}, true},
+		{"old key dropped", []string{newKey}, false},
+	}
+	for _, test := range tests {
+		config.SessionKeys = test.keys
+		pairs, err := SessionKeyPairs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var value string
+		err = securecookie.DecodeMulti("userData", cookie, &value, securecookie.CodecsFromPairs(pairs...)...)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got %v", test.name, err)
+		}
+	}
+}
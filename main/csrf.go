@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+const csrfField = "csrf_token"    //Form field holding the token
+const csrfHeader = "X-CSRF-Token" //Header holding the token for scripted requests
+const csrfCookie = "csrf"         //Cookie holding the token of visitors without a session
+
+//Context key for a token issued by the middleware during the current request
+type csrfContextKey struct{}
+
+//Returns the CSRF token of the request's session, or of its CSRF cookie if it
+//has no session. Returns "" if it has neither yet.
+func CSRFToken(r *http.Request) string {
+	session, _ := store.Get(r, "userData")
+	if token, _ := session.Values["csrf"].(string); token != "" {
+		return token
+	}
+
+	if token, ok := r.Context().Value(csrfContextKey{}).(string); ok {
+		return token
+	}
+	c, err := r.Cookie(csrfCookie)
+	if err != nil {
+		return ""
+	}
+	var token string
+	if err := securecookie.DecodeMulti(csrfCookie, c.Value, &token, store.Codecs...); err != nil {
+		return ""
+	}
+	return token
+}
+
+//Stores a new random CSRF token in the session, replacing any old one.
+//The session still needs to be saved by the caller.
+func newCSRFToken(r *http.Request) {
+	session, _ := store.Get(r, "userData")
+
+	session.Values["csrf"] = base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+}
+
+//Gives a visitor without a session a CSRF token in a signed cookie, so that
+//anonymous page views, bots included, do not add sessions to the store.
+//Returns the request carrying the new token for the handlers after it.
+func issueCSRFCookie(w http.ResponseWriter, r *http.Request) (*http.Request, error) {
+	token := base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+	encoded, err := securecookie.EncodeMulti(csrfCookie, token, store.Codecs...)
+	if err != nil {
+		return r, err
+	}
+
+	opts := *store.Options
+	http.SetCookie(w, sessions.NewCookie(csrfCookie, encoded, &opts))
+	return r.WithContext(context.WithValue(r.Context(), csrfContextKey{}, token)), nil
+}
+
+//Returns true for methods that must not change anything
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+//Router middleware issuing a CSRF token to every visitor viewing a page,
+//and refusing any other request that does not send the visitor's token back.
+//Visitors with a session keep the token in it, others get it in a cookie.
+func CSRFMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		//Browsers cannot be tricked into sending API tokens, so token requests need no CSRF token
+		if _, ok := RequestToken(r); ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if safeMethod(r.Method) {
+			//Static files never render forms, so they do not need a session
+			if CSRFToken(r) == "" && !strings.HasPrefix(r.URL.Path, "/assets/") {
+				session, _ := store.Get(r, "userData")
+				if session.IsNew {
+					if issued, err := issueCSRFCookie(w, r); err == nil {
+						r = issued
+					}
+				} else {
+					newCSRFToken(r)
+					session.Save(r, w)
+				}
+			}
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		expected := CSRFToken(r)
+		sent := r.Header.Get(csrfHeader)
+		if sent == "" {
+			sent = r.FormValue(csrfField)
+		}
+
+		if expected == "" || subtle.ConstantTimeCompare([]byte(expected), []byte(sent)) != 1 {
+			Log("rejected " + r.Method + " " + r.URL.Path + " from " + clientIP(r) + ": bad CSRF token")
+			w.WriteHeader(http.StatusForbidden)
+			DisplayError(w, r, errors.New("This form has expired. Please go back, reload the page and try again."))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCSRFMiddlewareAnonymous(t *testing.T) {
+	path := testSessions(t)
+
+	var rendered string
+	handler := CSRFMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rendered = CSRFToken(r)
+	}))
+
+	//Every anonymous page view gets a token without a session being stored
+	var cookie *http.Cookie
+	for i := 0; i < 5; i++ {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/login", nil))
+		if rendered == "" {
+			t.Fatal("the page got no CSRF token")
+		}
+		for _, c := range w.Result().Cookies() {
+			if c.Name == "userData" {
+				t.Error("an anonymous page view was given a session")
+			} else if c.Name == csrfCookie {
+				cookie = c
+			}
+		}
+	}
+	if len(store.records) != 0 {
+		t.Errorf("anonymous page views added %d sessions", len(store.records))
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("anonymous page views wrote the session store")
+	}
+	if cookie == nil {
+		t.Fatal("no CSRF cookie was set")
+	}
+
+	//The cookie's token is the one the form sends back
+	r := httptest.NewRequest(http.MethodGet, "/login", nil)
+	r.AddCookie(cookie)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	token := rendered
+
+	form := url.Values{csrfField: {token}}
+	r = httptest.NewRequest(http.MethodPost, "/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(cookie)
+	rendered = ""
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK || rendered != token {
+		t.Errorf("a form sending the cookie's token was refused with %d", w.Code)
+	}
+
+	//A forged cookie is not accepted as a token
+	forged := &http.Cookie{Name: csrfCookie, Value: token}
+	r = httptest.NewRequest(http.MethodGet, "/login", nil)
+	r.AddCookie(forged)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if rendered == token {
+		t.Error("an unsigned cookie was used as the token")
+	}
+}
+
+//Folder of the package, where the page templates are. Tests may change the working folder.
+var testSourceDir, _ = os.Getwd()
+
+//Copies the page templates into the test's working folder, so handlers can render errors
+func testTemplates(t *testing.T, dir string, names ...string) {
+	t.Helper()
+	for _, name := range append(names, "Templates.html") {
+		data, err := ioutil.ReadFile(filepath.Join(testSourceDir, "assets", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Join(dir, "assets"), os.ModePerm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "assets", name), data, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCSRFMiddlewareRejects(t *testing.T) {
+	dir := t.TempDir()
+	testTemplates(t, dir, "error.html")
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	testSessions(t)
+
+	alice := saveTestSession(t, store, map[interface{}]interface{}{"username": "alice", "csrf": "alice's token"})
+	bob := saveTestSession(t, store, map[interface{}]interface{}{"username": "bob", "csrf": "bob's token"})
+	handler := CSRFMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	tests := []struct {
+		name   string
+		method string
+		cookie *http.Cookie
+		form   string
+		header string
+		status int
+	}{
+		{"page view", http.MethodGet, alice, "", "", http.StatusOK},
+		{"form token", http.MethodPost, alice, "alice's token", "", http.StatusOK},
+		{"header token", http.MethodDelete, alice, "", "alice's token", http.StatusOK},
+		{"no token", http.MethodPost, alice, "", "", http.StatusForbidden},
+		{"wrong token", http.MethodPost, alice, "alice's toke", "", http.StatusForbidden},
+		{"another session's token", http.MethodPost, alice, "bob's token", "", http.StatusForbidden},
+		{"own token, other session", http.MethodPost, bob, "alice's token", "", http.StatusForbidden},
+		{"no session", http.MethodPost, nil, "alice's token", "", http.StatusForbidden},
+		{"empty token, no session", http.MethodPost, nil, "", "", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		form := url.Values{}
+		if test.form != "" {
+			form.Set(csrfField, test.form)
+		}
+		r := httptest.NewRequest(test.method, "/settings", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if test.header != "" {
+			r.Header.Set(csrfHeader, test.header)
+		}
+		if test.cookie != nil {
+			r.AddCookie(test.cookie)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("%s: got %d, want %d", test.name, w.Code, test.status)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+//Longest name, without extension, given to uploaded files
+const maxSlugLength = 80
+
+//Longest uploaded file name kept for display
+const maxOriginalNameLength = 200
+
+//What to do when an upload has the name of an image already in the gallery
+const (
+	CollisionRename  = "rename"  //Add a number to the new name, such as "arch-2.jpg"
+	CollisionReplace = "replace" //Replace the existing image if the uploader may delete it, otherwise rename
+)
+
+//Extension given to uploads of each allowed file type
+var uploadExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+}
+
+//Returns the last part of a file name sent by a client, whichever path separator it used
+func clientBaseName(name string) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == "/" {
+		return ""
+	}
+	return name
+}
+
+//Turns an uploaded file name into a safe one made of lowercase letters, digits
+//and dashes, such as "cafe-au-lait.jpg" for "../Café au lait.JPEG".
+//The extension of the name is replaced with ext.
+func SlugFilename(name string, ext string) string {
+	name = clientBaseName(name)
+	name = strings.TrimSuffix(name, path.Ext(name))
+
+	var slug strings.Builder
+	dash := false
+	//NFKD splits accents from their letters, so dropping the accents turns "é" into "e"
+	for _, r := range norm.NFKD.String(name) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+		case r <= unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			if dash && slug.Len() > 0 {
+				slug.WriteByte('-')
+			}
+			dash = false
+			slug.WriteRune(unicode.ToLower(r))
+		default:
+			dash = true
+		}
+	}
+
+	s := slug.String()
+	if len(s) > maxSlugLength {
+		s = strings.TrimRight(s[:maxSlugLength], "-")
+	}
+	if s == "" {
+		s = "image"
+	}
+	return s + ext
+}
+
+//Cleans an uploaded file name for display, keeping its spelling
+//but dropping folders and control characters
+func CleanOriginalName(name string) string {
+	name = strings.ToValidUTF8(clientBaseName(name), "")
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+
+	if runes := []rune(name); len(runes) > maxOriginalNameLength {
+		name = string(runes[:maxOriginalNameLength])
+	}
+	return name
+}
+
+//Returns the image using a name, ignoring its extension and case,
+//since image pages are found by the name without extension.
+//Returns false if no image has the name.
+func imageNamed(name string) (ImageMeta, bool) {
+	for _, m := range imageMeta.List() {
+		if strings.EqualFold(strings.TrimSuffix(m.Filename, filepath.Ext(m.Filename)), name) {
+			return m, true
+		}
+	}
+	return ImageMeta{}, false
+}
+
+//Names of uploads that are not recorded yet, lowercase and without extension,
+//so two uploads at once are never given the same name
+var (
+	uploadNamesMu sync.Mutex
+	uploadNames   = make(map[string]bool)
+)
+
+//Returns the lowercase name without extension that tells images apart
+func nameKey(filename string) string {
+	return strings.ToLower(strings.TrimSuffix(filename, filepath.Ext(filename)))
+}
+
+//Returns the file name with a number added if an image or another upload already
+//has the name, such as "arch-2.jpg" if "arch.jpg" or "arch.png" exists.
+//The name is kept for the upload until ReleaseFilename is called.
+func ReserveFilename(filename string) string {
+	uploadNamesMu.Lock()
+	defer uploadNamesMu.Unlock()
+
+	ext := filepath.Ext(filename)
+	base := strings.TrimSuffix(filename, ext)
+
+	name := base
+	for i := 2; ; i++ {
+		if _, taken := imageNamed(name); !taken && !uploadNames[strings.ToLower(name)] {
+			uploadNames[strings.ToLower(name)] = true
+			return name + ext
+		}
+		name = fmt.Sprintf("%s-%d", base, i)
+	}
+}
+
+//Keeps the name of an image an upload replaces for the upload until ReleaseFilename
+//is called. Returns false if another upload is already using the name.
+func ReserveReplacement(filename string) bool {
+	uploadNamesMu.Lock()
+	defer uploadNamesMu.Unlock()
+
+	if uploadNames[nameKey(filename)] {
+		return false
+	}
+	uploadNames[nameKey(filename)] = true
+	return true
+}
+
+//Frees a name kept for an upload, once the upload is recorded or has failed
+func ReleaseFilename(filename string) {
+	uploadNamesMu.Lock()
+	defer uploadNamesMu.Unlock()
+	delete(uploadNames, nameKey(filename))
+}
+
+//Records an upload, taking the place of the image named replacing if it is set.
+//The replaced image's versions and share links are deleted once the upload is recorded,
+//and its files too unless the upload took them over by having its own files under the same name.
+//Images sharing the replaced image's files must have been given their own copy first.
+func recordUpload(meta ImageMeta, replacing string) error {
+	if replacing == "" {
+		return imageMeta.Add(meta)
+	}
+
+	old, _ := imageMeta.Get(replacing)
+	if err := imageMeta.Replace(replacing, meta); err != nil {
+		return err
+	}
+	shares.DeleteImage(replacing)
+	if old.Blob != "" {
+		return nil
+	}
+
+	deleteVersions(old)
+	ownFiles := meta.Blob == ""
+	if !ownFiles || replacing != meta.Filename {
+		storage.Delete(StorageName(ImagesFolder, replacing))
+	}
+	//Thumbnail names leave out the extension, so "arch.png" and "arch.jpg" share them
+	if !ownFiles || FormatName(replacing, "thumb") != FormatName(meta.Filename, "thumb") {
+		deleteDerivatives(replacing)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSlugFilename(t *testing.T) {
+	tests := []struct {
+		name string
+		ext  string
+		want string
+	}{
+		{"Café au lait.JPEG", ".jpg", "cafe-au-lait.jpg"},
+		{"../../etc/passwd", ".png", "passwd.png"},
+		{`C:\Users\me\Holiday Photo (1).png`, ".png", "holiday-photo-1.png"},
+		{"  --Arch__Bridge--.jpg", ".jpg", "arch-bridge.jpg"},
+		{"photo.tar.gz", ".jpg", "photo-tar.jpg"},
+		{"ﬁle①.png", ".png", "file1.png"},
+		{"写真.jpg", ".jpg", "image.jpg"},
+		{"..", ".jpg", "image.jpg"},
+		{"", ".png", "image.png"},
+		{".hidden", ".png", "image.png"},
+		{"a/" + strings.Repeat("ab ", 50) + ".jpg", ".jpg", strings.TrimSuffix(strings.Repeat("ab-", 27), "-") + ".jpg"},
+	}
+	for _, test := range tests {
+		if got := SlugFilename(test.name, test.ext); got != test.want {
+			t.Errorf("SlugFilename(%q, %q) = %q, want %q", test.name, test.ext, got, test.want)
+		}
+	}
+}
+
+func TestCleanOriginalName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"Café au lait.JPEG", "Café au lait.JPEG"},
+		{"../../secret/Arch.jpg", "Arch.jpg"},
+		{`C:\Users\me\Arch.jpg`, "Arch.jpg"},
+		{"  Arch\x00\r\n.jpg  ", "Arch.jpg"},
+		{"evil\u202egpj.exe", "evilgpj.exe"},
+		{"bad\xffutf8.png", "badutf8.png"},
+		{"/", ""},
+		{strings.Repeat("é", 250), strings.Repeat("é", maxOriginalNameLength)},
+	}
+	for _, test := range tests {
+		if got := CleanOriginalName(test.name); got != test.want {
+			t.Errorf("CleanOriginalName(%q) = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,748 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	imagesDBPath = "./data/gallery.db"
+	imagesPath   = "./data/images.json" //Image details before the database, imported once
+)
+
+var imagesBucket = []byte("images")
+
+var ErrImageNotFound = errors.New("image not found")
+
+//Image visibility levels
+const (
+	VisibilityPublic   = "public"   //Listed in the gallery and viewable by everyone
+	VisibilityUnlisted = "unlisted" //Viewable by anyone with the link, but not listed
+	VisibilityPrivate  = "private"  //Only viewable by the owner and admins
+)
+
+var visibilities = []string{VisibilityPublic, VisibilityUnlisted, VisibilityPrivate}
+
+//What to do with uploads identical to an image already in the gallery
+const (
+	DuplicateReject = "reject" //Refuse the upload and link to the existing image
+	DuplicateLink   = "link"   //Keep the new name, sharing the existing image's files
+)
+
+//Details recorded about an image, one record per file in the images folder
+//and per name sharing another image's files
+type ImageMeta struct {
+	ID           uint64
+	Filename     string
+	OriginalName string //Name of the file the uploader sent, shown instead of Filename
+	Format       string //"jpeg" or "png"
+	Width        int
+	Height       int
+	Size         int64 //Bytes
+	Owner        string
+	Uploaded     time.Time
+	Modified     time.Time //Last change to the record
+	Visibility   string
+	SHA256       string //Hex digest of the file, used to find duplicate uploads
+
+	//Image whose files hold this image's content, for identical images uploaded
+	//under another name. "" if the image has its own files.
+	Blob string
+
+	Thumbnail   bool  //The thumbnail has been made
+	Resized     []int //Widths of the resized copies that have been made
+	DerivedSize int64 //Bytes used by the thumbnail and resized copies
+
+	Deleted   time.Time //When the image was moved to the trash, zero if it is not in the trash
+	DeletedBy string
+
+	Version         int //Number of the current version, 0 for images that were never replaced
+	VersionBy       string
+	VersionUploaded time.Time
+	Versions        []ImageVersion //Earlier versions, oldest first
+}
+
+//Returns the visibility of the image, images without one are public
+func (m ImageMeta) VisibilityLevel() string {
+	if m.Visibility == "" {
+		return VisibilityPublic
+	}
+	return m.Visibility
+}
+
+//Returns the number of the image's current version, starting at 1
+func (m ImageMeta) CurrentVersion() int {
+	if m.Version < 1 {
+		return 1
+	}
+	return m.Version
+}
+
+//Returns true if the image is in the trash
+func (m ImageMeta) InTrash() bool {
+	return !m.Deleted.IsZero()
+}
+
+//Returns the name to show for the image, without extension
+func (m ImageMeta) DisplayName() string {
+	name := m.OriginalName
+	if name == "" {
+		name = m.Filename
+	}
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+//Returns the name of the file in the images folder holding the image
+func (m ImageMeta) BlobName() string {
+	if m.Blob == "" {
+		return m.Filename
+	}
+	return m.Blob
+}
+
+//Returns true once the thumbnail and every resized copy have been made
+func (m ImageMeta) DerivativesDone() bool {
+	return m.Thumbnail && len(m.Resized) >= len(imageSizes)
+}
+
+//Image details kept in a bbolt database, keyed by file name.
+//Listing images reads the database instead of the images folder.
+type ImageStore struct {
+	db *bolt.DB
+}
+
+//Global image store, loaded in main
+var imageMeta *ImageStore
+
+//Opens the image database at the given path, creating it if needed
+func OpenImageStore(path string) (*ImageStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %v", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(imagesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &ImageStore{db: db}, nil
+}
+
+//Closes the database
+func (s *ImageStore) Close() error {
+	return s.db.Close()
+}
+
+//Returns the details of an image.
+//Returns false if there is no such image.
+func (s *ImageStore) Get(filename string) (ImageMeta, bool) {
+	var m ImageMeta
+	found := false
+	s.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(imagesBucket).Get([]byte(filename))
+		if data != nil {
+			found = json.Unmarshal(data, &m) == nil
+		}
+		return nil
+	})
+	return m, found
+}
+
+//Returns every image sorted by file name
+func (s *ImageStore) List() []ImageMeta {
+	var list []ImageMeta
+	s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(imagesBucket).ForEach(func(k, v []byte) error {
+			var m ImageMeta
+			if err := json.Unmarshal(v, &m); err != nil {
+				Log("skipping broken image record " + string(k) + ": " + err.Error())
+				return nil
+			}
+			list = append(list, m)
+			return nil
+		})
+	})
+	return list
+}
+
+//Returns an image with the given content digest, leaving out images in the trash.
+//Returns false if there is no such image.
+func (s *ImageStore) FindHash(sum string) (ImageMeta, bool) {
+	//Images not hashed yet have no digest to match
+	if sum == "" {
+		return ImageMeta{}, false
+	}
+	for _, m := range s.List() {
+		if m.SHA256 == sum && !m.InTrash() {
+			return m, true
+		}
+	}
+	return ImageMeta{}, false
+}
+
+//Returns the images sharing the files of the given image
+func (s *ImageStore) Links(filename string) []ImageMeta {
+	var links []ImageMeta
+	for _, m := range s.List() {
+		if m.Blob == filename {
+			links = append(links, m)
+		}
+	}
+	return links
+}
+
+//Writes a record, giving new images an ID. Must be called in an update transaction.
+func putImage(b *bolt.Bucket, m *ImageMeta) error {
+	if m.ID == 0 {
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		m.ID = id
+	}
+	m.Modified = time.Now()
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(m.Filename), data)
+}
+
+//Records a new image
+func (s *ImageStore) Add(m ImageMeta) error {
+	if m.Uploaded.IsZero() {
+		m.Uploaded = time.Now()
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(imagesBucket)
+		if b.Get([]byte(m.Filename)) != nil {
+			return fmt.Errorf("an image named %s already exists", m.Filename)
+		}
+		return putImage(b, &m)
+	})
+}
+
+//Records a new image in place of an existing one, in one step
+//so the name is never free in between
+func (s *ImageStore) Replace(old string, m ImageMeta) error {
+	if m.Uploaded.IsZero() {
+		m.Uploaded = time.Now()
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(imagesBucket)
+		if m.Filename != old && b.Get([]byte(m.Filename)) != nil {
+			return fmt.Errorf("an image named %s already exists", m.Filename)
+		}
+		if err := b.Delete([]byte(old)); err != nil {
+			return err
+		}
+		return putImage(b, &m)
+	})
+}
+
+//Changes the record of an image
+func (s *ImageStore) Update(filename string, fn func(m *ImageMeta)) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(imagesBucket)
+		data := b.Get([]byte(filename))
+		if data == nil {
+			return ErrImageNotFound
+		}
+
+		var m ImageMeta
+		if err := json.Unmarshal(data, &m); err != nil {
+			return err
+		}
+		fn(&m)
+		m.Filename = filename
+		return putImage(b, &m)
+	})
+}
+
+//Changes who may see an image
+func (s *ImageStore) SetVisibility(filename string, visibility string) error {
+	return s.Update(filename, func(m *ImageMeta) {
+		m.Visibility = visibility
+	})
+}
+
+//Moves an image to the trash, hiding it until it is restored or purged
+func (s *ImageStore) Trash(filename string, by string) error {
+	return s.Update(filename, func(m *ImageMeta) {
+		m.Deleted = time.Now()
+		m.DeletedBy = by
+	})
+}
+
+//Takes an image out of the trash
+func (s *ImageStore) Restore(filename string) error {
+	return s.Update(filename, func(m *ImageMeta) {
+		m.Deleted = time.Time{}
+		m.DeletedBy = ""
+	})
+}
+
+//Returns the images in the trash, most recently deleted first
+func (s *ImageStore) Trashed() []ImageMeta {
+	var list []ImageMeta
+	for _, m := range s.List() {
+		if m.InTrash() {
+			list = append(list, m)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Deleted.After(list[j].Deleted)
+	})
+	return list
+}
+
+//Clears the owner of every image a user uploaded, leaving them to the admins.
+//Used when an account is deleted, so anyone who later takes the same
+//username does not get the old account's images.
+//Returns the number of images changed.
+func (s *ImageStore) Disown(username string) (int, error) {
+	count := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(imagesBucket)
+		var changed []ImageMeta
+		err := b.ForEach(func(k, v []byte) error {
+			var m ImageMeta
+			if err := json.Unmarshal(v, &m); err != nil || m.Owner != username {
+				return nil
+			}
+			m.Owner = ""
+			changed = append(changed, m)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i := range changed {
+			if err := putImage(b, &changed[i]); err != nil {
+				return err
+			}
+		}
+		count = len(changed)
+		return nil
+	})
+	return count, err
+}
+
+//Forgets a deleted image
+func (s *ImageStore) Delete(filename string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(imagesBucket).Delete([]byte(filename))
+	})
+}
+
+//Imports the uploaders and visibility kept in images.json by older versions.
+//The file is renamed afterwards so it is only imported once.
+func (s *ImageStore) Migrate(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var list []ImageMeta
+	if err := json.Unmarshal(data, &list); err != nil {
+		return fmt.Errorf("reading %s: %v", path, err)
+	}
+
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(imagesBucket)
+		for _, old := range list {
+			m := ImageMeta{}
+			if data := b.Get([]byte(old.Filename)); data != nil {
+				json.Unmarshal(data, &m)
+			}
+			m.Filename = old.Filename
+			m.Owner = old.Owner
+			m.Uploaded = old.Uploaded
+			m.Visibility = old.Visibility
+			if err := putImage(b, &m); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Imported %d image records from %s\n", len(list), path)
+	return os.Rename(path, path+".migrated")
+}
+
+//Reads the format, size and dimensions of an image in the images folder
+func DescribeImage(filename string) (ImageMeta, error) {
+	meta, err := describeFile(StorageName(ImagesFolder, filename))
+	meta.Filename = filename
+	return meta, err
+}
+
+//Reads the format, size and dimensions of a stored image file
+func describeFile(name string) (ImageMeta, error) {
+	info, err := storage.Stat(name)
+	if err != nil {
+		return ImageMeta{}, err
+	}
+
+	file, err := storage.Get(name)
+	if err != nil {
+		return ImageMeta{}, err
+	}
+	defer file.Close()
+
+	cfg, format, err := image.DecodeConfig(file)
+	if err != nil {
+		return ImageMeta{}, fmt.Errorf("%s: %v", path.Base(name), err)
+	}
+
+	return ImageMeta{
+		Format:   format,
+		Width:    cfg.Width,
+		Height:   cfg.Height,
+		Size:     info.Size,
+		Uploaded: info.ModTime,
+	}, nil
+}
+
+//Returns the hex SHA-256 digest of a stored file
+func HashFile(name string) (string, error) {
+	file, err := storage.Get(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+//Brings the database in line with the images folder: images added outside
+//the gallery get a record. Records of missing images are kept, so their owner,
+//visibility and versions are not lost, and are reported for the check to repair.
+//Records that only lack details, such as ones imported from images.json
+//or made before duplicates were checked, are filled in.
+func (s *ImageStore) Scan() error {
+	files, err := storage.List(ImagesFolder)
+	if err != nil {
+		return err
+	}
+
+	present := make(map[string]bool, len(files))
+	added := 0
+	for _, f := range files {
+		present[f.Name] = true
+
+		m, found := s.Get(f.Name)
+		if found && m.Format != "" && m.SHA256 != "" {
+			//Records made before storage use was tracked
+			if m.DerivedSize == 0 && (m.Thumbnail || len(m.Resized) > 0) {
+				recordDerivedSize(f.Name)
+			}
+			continue
+		}
+
+		details, err := DescribeImage(f.Name)
+		if err == nil {
+			details.SHA256, err = HashFile(StorageName(ImagesFolder, f.Name))
+		}
+		if err != nil {
+			Log("could not scan image " + f.Name + ": " + err.Error())
+			continue
+		}
+		details.Thumbnail = StorageExists(StorageName(ThumbnailsFolder, FormatName(f.Name, "thumb")))
+		for _, size := range imageSizes {
+			if StorageExists(StorageName(ResizedFolder, FormatName(f.Name, fmt.Sprintf("%v", size)))) {
+				details.Resized = append(details.Resized, size)
+			}
+		}
+
+		if found {
+			err = s.Update(f.Name, func(m *ImageMeta) {
+				m.Format, m.Width, m.Height, m.Size = details.Format, details.Width, details.Height, details.Size
+				m.Thumbnail, m.Resized = details.Thumbnail, details.Resized
+				m.SHA256 = details.SHA256
+			})
+		} else {
+			err = s.Add(details)
+			added++
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	missing := 0
+	for _, m := range s.List() {
+		//Links recorded before versions were kept apart hold a copy of the
+		//version history of the image they share files with
+		if m.Blob != "" && (len(m.Versions) > 0 || m.Version != 0) {
+			err := s.Update(m.Filename, func(m *ImageMeta) {
+				m.Version, m.VersionBy, m.VersionUploaded, m.Versions = 0, "", time.Time{}, nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if !present[m.BlobName()] {
+			Log("image " + m.Filename + " is missing its file " + m.BlobName())
+			missing++
+		}
+	}
+
+	if added > 0 {
+		fmt.Printf("Image scan added %d records\n", added)
+	}
+	if missing > 0 {
+		fmt.Printf("%d images are missing their files, run \"main check\" for details\n", missing)
+	}
+	return nil
+}
+
+//Copies a stored file
+func copyStorageFile(from string, to string) error {
+	file, err := storage.Get(from)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return storage.Put(to, file)
+}
+
+//Gives the images sharing an image's files their own copy, so the image's files
+//can be deleted or changed. The files are copied to the first of them, which the others then share.
+func detachLinks(filename string) error {
+	links := imageMeta.Links(filename)
+	if len(links) == 0 {
+		return nil
+	}
+	meta, _ := imageMeta.Get(filename)
+
+	heir := links[0].Filename
+	if err := copyStorageFile(StorageName(ImagesFolder, filename), StorageName(ImagesFolder, heir)); err != nil {
+		return err
+	}
+	//Thumbnails and resized copies are made again by the heir if they are missing
+	thumb := StorageName(ThumbnailsFolder, FormatName(filename, "thumb"))
+	if copyStorageFile(thumb, StorageName(ThumbnailsFolder, FormatName(heir, "thumb"))) != nil {
+		meta.Thumbnail = false
+	}
+	var resized []int
+	for _, size := range meta.Resized {
+		from := StorageName(ResizedFolder, FormatName(filename, fmt.Sprintf("%v", size)))
+		if copyStorageFile(from, StorageName(ResizedFolder, FormatName(heir, fmt.Sprintf("%v", size)))) == nil {
+			resized = append(resized, size)
+		}
+	}
+
+	for _, l := range links {
+		err := imageMeta.Update(l.Filename, func(m *ImageMeta) {
+			if m.Filename == heir {
+				m.Blob = ""
+				m.Thumbnail, m.Resized = meta.Thumbnail, resized
+				m.DerivedSize = meta.DerivedSize
+			} else {
+				m.Blob = heir
+			}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Deletes the thumbnail and every resized copy of an image
+func deleteDerivatives(filename string) {
+	storage.Delete(StorageName(ThumbnailsFolder, FormatName(filename, "thumb")))
+
+	for _, size := range imageSizes {
+		path := FormatName(filename, fmt.Sprintf("%v", size))
+		storage.Delete(StorageName(ResizedFolder, path))
+	}
+}
+
+//Deletes an image's record, files and earlier versions. An image sharing another
+//image's files keeps those files, and has no versions of its own. If other images
+//share the deleted image's files, the files are first copied to the first of them,
+//which the others then share.
+func DeleteImage(filename string) error {
+	meta, found := imageMeta.Get(filename)
+	if found && meta.Blob != "" {
+		return imageMeta.Delete(filename)
+	}
+	deleteVersions(meta)
+
+	if err := detachLinks(filename); err != nil {
+		return err
+	}
+	deleteDerivatives(filename)
+
+	if err := storage.Delete(StorageName(ImagesFolder, filename)); err != nil {
+		return err
+	}
+	return imageMeta.Delete(filename)
+}
+
+//Returns true if the user may delete the image.
+//Admins may delete anything, uploaders only the images they uploaded.
+func CanDeleteImage(user User, filename string) bool {
+	if user.HasRole(RoleAdmin) {
+		return true
+	}
+
+	meta, ok := imageMeta.Get(filename)
+	return ok && user.HasRole(RoleUploader) && meta.Owner != "" && meta.Owner == user.Username
+}
+
+//Returns true if the visibility level exists
+func ValidVisibility(visibility string) bool {
+	for _, v := range visibilities {
+		if v == visibility {
+			return true
+		}
+	}
+	return false
+}
+
+//Returns true if the request's user may always see the image:
+//admins and the image's owner
+func ownsImage(r *http.Request, meta ImageMeta) bool {
+	user, ok := CurrentUser(r)
+	return ok && (user.HasRole(RoleAdmin) || (meta.Owner != "" && meta.Owner == user.Username))
+}
+
+//Returns true if the request's user may view or download the image.
+//Images in the trash are treated as private.
+func CanViewImage(r *http.Request, filename string) bool {
+	meta, _ := imageMeta.Get(filename)
+	if meta.VisibilityLevel() != VisibilityPrivate && !meta.InTrash() {
+		return true
+	}
+	return ownsImage(r, meta)
+}
+
+//Returns true if the image should be listed in the gallery and search results
+//shown to the request's user. Users also see their own unlisted and private images.
+//Images in the trash are only listed on the trash page.
+func ImageListed(r *http.Request, filename string) bool {
+	meta, _ := imageMeta.Get(filename)
+	if meta.InTrash() {
+		return false
+	}
+	if meta.VisibilityLevel() == VisibilityPublic {
+		return true
+	}
+	return ownsImage(r, meta)
+}
+
+//Finds the file of an image from its name without extension.
+//Returns false if there is no such image.
+func FindImage(name string) (string, bool) {
+	for _, ex := range extensions {
+		if _, found := imageMeta.Get(name + ex); found {
+			return name + ex, true
+		}
+	}
+	return "", false
+}
+
+//Returns the original image a thumbnail or resized file was made from,
+//such as "Arch.jpg" for "Arch_thumb.jpg" or "Arch_400.jpg"
+func DerivativeSource(derivative string) (string, bool) {
+	name := strings.TrimSuffix(derivative, filepath.Ext(derivative))
+	i := strings.LastIndex(name, "_")
+	if i < 0 {
+		return "", false
+	}
+	if original, found := FindImage(name[:i]); found {
+		return original, true
+	}
+	//Originals with other extensions, such as .jpeg
+	m, found := imageNamed(name[:i])
+	return m.Filename, found
+}
+
+//Returns the stored file to send for an image, or for a thumbnail or resized copy
+//of it. Images sharing another image's files are sent that image's files.
+func ContentFile(file string, original string) string {
+	meta, _ := imageMeta.Get(original)
+	if meta.Blob == "" {
+		return file
+	}
+	if file == original {
+		return meta.Blob
+	}
+	name := strings.TrimSuffix(file, filepath.Ext(file))
+	return FormatName(meta.Blob, name[strings.LastIndex(name, "_")+1:])
+}
+
+//Wraps a static file server for images, thumbnails or resized images so
+//files are only served to users allowed to view the original.
+//derived is true for servers of files made from an original.
+func ImageFileServer(fs http.Handler, derived bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file := strings.TrimPrefix(r.URL.Path, "/")
+		original := file
+		if derived {
+			var ok bool
+			//Files whose original cannot be found cannot be checked, so are never sent
+			if original, ok = DerivativeSource(file); !ok {
+				http.NotFound(w, r)
+				return
+			}
+		}
+
+		if !CanViewImage(r, original) {
+			http.NotFound(w, r)
+			return
+		}
+
+		if content := ContentFile(file, original); content != file {
+			r2 := new(http.Request)
+			*r2 = *r
+			r2.URL = new(url.URL)
+			*r2.URL = *r.URL
+			r2.URL.Path = "/" + content
+			r2.URL.RawPath = ""
+			r = r2
+		}
+		fs.ServeHTTP(w, r)
+	})
+}
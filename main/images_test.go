@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+//Points the gallery at an empty storage folder, image database and share store
+//in a temporary folder, which is also made the working folder so logs land there.
+//Everything is put back when the test ends.
+func testGallery(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	oldStorage, oldMeta, oldShares, oldConfig := storage, imageMeta, shares, config
+	storage = &LocalStorage{Root: filepath.Join(dir, "assets")}
+	imageMeta, err = OpenImageStore(filepath.Join(dir, "data", "gallery.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	shares, err = LoadShareStore(filepath.Join(dir, "data", "shares.json"), [][]byte{[]byte("test share key")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		imageMeta.Close()
+		storage, imageMeta, shares, config = oldStorage, oldMeta, oldShares, oldConfig
+		os.Chdir(wd)
+	})
+	return dir
+}
+
+//Returns a small png, different for each shade
+func testPNG(t *testing.T, shade uint8) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 8, 6))
+	for x := 0; x < 8; x++ {
+		for y := 0; y < 6; y++ {
+			img.Set(x, y, color.RGBA{shade, uint8(x * 30), uint8(y * 40), 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+//Stores a file, failing the test if it cannot
+func putTestFile(t *testing.T, name string, data []byte) {
+	t.Helper()
+	if err := storage.Put(name, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//Returns the content of a stored file, failing the test if it cannot be read
+func readTestFile(t *testing.T, name string) []byte {
+	t.Helper()
+	file, err := storage.Get(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestImageStore(t *testing.T) {
+	testGallery(t)
+
+	for _, name := range []string{"b.png", "a.png"} {
+		if err := imageMeta.Add(ImageMeta{Filename: name, Owner: "alice"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := imageMeta.Add(ImageMeta{Filename: "a.png", Owner: "bob"}); err == nil {
+		t.Error("a second record was added under the same name")
+	}
+
+	list := imageMeta.List()
+	if len(list) != 2 || list[0].Filename != "a.png" || list[1].Filename != "b.png" {
+		t.Fatalf("got list %+v", list)
+	}
+	if list[0].ID == 0 || list[0].ID == list[1].ID || list[0].Uploaded.IsZero() {
+		t.Errorf("records were not given IDs and upload times: %+v", list)
+	}
+
+	//Updates cannot move a record to another name
+	err := imageMeta.Update("a.png", func(m *ImageMeta) {
+		m.Filename = "b.png"
+		m.Visibility = VisibilityPrivate
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := imageMeta.Get("a.png"); m.Visibility != VisibilityPrivate || m.Owner != "alice" {
+		t.Errorf("updated record is %+v", m)
+	}
+	if m, _ := imageMeta.Get("b.png"); m.Visibility != "" {
+		t.Errorf("the update changed another record: %+v", m)
+	}
+	if err := imageMeta.Update("missing.png", func(m *ImageMeta) {}); err != ErrImageNotFound {
+		t.Errorf("updating a missing record got %v", err)
+	}
+
+	if err := imageMeta.Replace("b.png", ImageMeta{Filename: "a.png"}); err == nil {
+		t.Error("replaced a record with the name of another")
+	}
+	if err := imageMeta.Replace("b.png", ImageMeta{Filename: "c.png", Owner: "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, found := imageMeta.Get("b.png"); found {
+		t.Error("the replaced record is still there")
+	}
+	if m, found := imageMeta.Get("c.png"); !found || m.Owner != "bob" {
+		t.Errorf("replacement is %+v, %v", m, found)
+	}
+
+	if err := imageMeta.Delete("c.png"); err != nil {
+		t.Fatal(err)
+	}
+	if len(imageMeta.List()) != 1 {
+		t.Errorf("got %d records after deleting, want 1", len(imageMeta.List()))
+	}
+}
+
+func TestScanAddsFiles(t *testing.T) {
+	testGallery(t)
+
+	data := testPNG(t, 1)
+	putTestFile(t, StorageName(ImagesFolder, "added.png"), data)
+	putTestFile(t, StorageName(ThumbnailsFolder, "added_thumb.jpg"), testPNG(t, 2))
+	putTestFile(t, StorageName(ImagesFolder, "broken.png"), []byte("not an image"))
+	if err := imageMeta.Add(ImageMeta{Filename: "imported.png", Owner: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	putTestFile(t, StorageName(ImagesFolder, "imported.png"), testPNG(t, 3))
+
+	if err := imageMeta.Scan(); err != nil {
+		t.Fatal(err)
+	}
+
+	sum := sha256.Sum256(data)
+	m, found := imageMeta.Get("added.png")
+	if !found {
+		t.Fatal("scan did not add the file")
+	}
+	if m.Format != "png" || m.Width != 8 || m.Height != 6 || m.Size != int64(len(data)) || !m.Thumbnail {
+		t.Errorf("added record is %+v", m)
+	}
+	if m.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("added record has digest %s", m.SHA256)
+	}
+	if _, found := imageMeta.Get("broken.png"); found {
+		t.Error("scan added a file that is not an image")
+	}
+	if m, _ := imageMeta.Get("imported.png"); m.Owner != "alice" || m.Format != "png" || m.SHA256 == "" {
+		t.Errorf("record missing details was not filled in: %+v", m)
+	}
+}
+
+func TestDeleteLinkKeepsSourceVersions(t *testing.T) {
+	testGallery(t)
+
+	putTestFile(t, StorageName(ImagesFolder, "arch.png"), testPNG(t, 1))
+	putTestFile(t, StorageName(VersionsFolder, "arch.v1.png"), testPNG(t, 2))
+	versions := []ImageVersion{{Number: 1, File: "arch.v1.png", Size: 100}}
+	if err := imageMeta.Add(ImageMeta{Filename: "arch.png", Size: 200, Version: 2, Versions: versions}); err != nil {
+		t.Fatal(err)
+	}
+	//A link recorded before links were made from scratch, holding a copy of the history
+	if err := imageMeta.Add(ImageMeta{Filename: "copy.png", Blob: "arch.png", Size: 200, Version: 2, Versions: versions}); err != nil {
+		t.Fatal(err)
+	}
+
+	link, _ := imageMeta.Get("copy.png")
+	if used := link.StorageUsed(); used != 0 {
+		t.Errorf("link uses %d bytes, want 0", used)
+	}
+
+	if err := DeleteImage("copy.png"); err != nil {
+		t.Fatal(err)
+	}
+	if !StorageExists(StorageName(VersionsFolder, "arch.v1.png")) {
+		t.Error("deleting a link deleted the version of the image it shares files with")
+	}
+	if !StorageExists(StorageName(ImagesFolder, "arch.png")) {
+		t.Error("deleting a link deleted the file it shares")
+	}
+}
+
+func TestScanClearsLinkVersions(t *testing.T) {
+	testGallery(t)
+
+	putTestFile(t, StorageName(ImagesFolder, "arch.png"), testPNG(t, 1))
+	if err := imageMeta.Add(ImageMeta{Filename: "arch.png"}); err != nil {
+		t.Fatal(err)
+	}
+	err := imageMeta.Add(ImageMeta{
+		Filename:        "copy.png",
+		Blob:            "arch.png",
+		Version:         2,
+		VersionBy:       "someone",
+		VersionUploaded: time.Now(),
+		Versions:        []ImageVersion{{Number: 1, File: "arch.v1.png"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := imageMeta.Scan(); err != nil {
+		t.Fatal(err)
+	}
+	link, found := imageMeta.Get("copy.png")
+	if !found {
+		t.Fatal("scan removed the link")
+	}
+	if link.Version != 0 || link.VersionBy != "" || !link.VersionUploaded.IsZero() || len(link.Versions) != 0 {
+		t.Errorf("link kept version history: %+v", link)
+	}
+}
+
+func TestScanKeepsRecordsOfMissingFiles(t *testing.T) {
+	testGallery(t)
+
+	putTestFile(t, StorageName(VersionsFolder, "gone.v1.png"), testPNG(t, 1))
+	err := imageMeta.Add(ImageMeta{
+		Filename:   "gone.png",
+		Owner:      "someone",
+		Visibility: VisibilityPrivate,
+		Version:    2,
+		Versions:   []ImageVersion{{Number: 1, File: "gone.v1.png"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := imageMeta.Add(ImageMeta{Filename: "copy.png", Blob: "gone.png"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := imageMeta.Scan(); err != nil {
+		t.Fatal(err)
+	}
+	m, found := imageMeta.Get("gone.png")
+	if !found {
+		t.Fatal("scan removed the record of an image missing its file")
+	}
+	if m.Owner != "someone" || m.Visibility != VisibilityPrivate || len(m.Versions) != 1 {
+		t.Errorf("scan changed the record: %+v", m)
+	}
+	if _, found := imageMeta.Get("copy.png"); !found {
+		t.Error("scan removed a link to a missing file")
+	}
+	if !StorageExists(StorageName(VersionsFolder, "gone.v1.png")) {
+		t.Error("scan deleted a version file")
+	}
+}
+
+func TestImageFileServerChecksOriginal(t *testing.T) {
+	testGallery(t)
+	testUsers(t)
+	testSessions(t)
+
+	for _, m := range []ImageMeta{
+		{Filename: "secret.jpeg", Owner: "bob", Visibility: VisibilityPrivate},
+		{Filename: "open.jpeg", Owner: "bob", Visibility: VisibilityPublic},
+	} {
+		if err := imageMeta.Add(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"secret_thumb.jpg", "open_thumb.jpg", "stray_thumb.jpg"} {
+		putTestFile(t, StorageName(ThumbnailsFolder, name), testPNG(t, 1))
+	}
+	server := ImageFileServer(StorageFileServer(ThumbnailsFolder), true)
+
+	tests := []struct {
+		file   string
+		status int
+	}{
+		{"open_thumb.jpg", http.StatusOK},
+		{"secret_thumb.jpg", http.StatusNotFound},
+		{"stray_thumb.jpg", http.StatusNotFound}, //No original to check
+		{"missing_thumb.jpg", http.StatusNotFound},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/"+test.file, nil))
+		if w.Code != test.status {
+			t.Errorf("%s: got %d, want %d", test.file, w.Code, test.status)
+		}
+	}
+}
+
+func TestCanDeleteImage(t *testing.T) {
+	testGallery(t)
+	for _, m := range []ImageMeta{
+		{Filename: "alices.png", Owner: "alice"},
+		{Filename: "old.png"}, //Uploaded before owners were recorded
+	} {
+		if err := imageMeta.Add(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		user     User
+		filename string
+		can      bool
+	}{
+		{User{Username: "alice", Role: RoleUploader}, "alices.png", true},
+		{User{Username: "bob", Role: RoleUploader}, "alices.png", false},
+		{User{Username: "alice", Role: RoleViewer}, "alices.png", false},
+		{User{Username: "root", Role: RoleAdmin}, "alices.png", true},
+		{User{Username: "alice", Role: RoleUploader}, "old.png", false},
+		{User{Username: "root", Role: RoleAdmin}, "old.png", true},
+		{User{Username: "", Role: RoleUploader}, "old.png", false},
+		{User{Username: "alice", Role: RoleUploader}, "missing.png", false},
+	}
+	for _, test := range tests {
+		if can := CanDeleteImage(test.user, test.filename); can != test.can {
+			t.Errorf("%s (%s) deleting %s: got %v, want %v", test.user.Username, test.user.Role, test.filename, can, test.can)
+		}
+	}
+}
+
+func TestCanViewImage(t *testing.T) {
+	testGallery(t)
+	testUsers(t)
+	testSessions(t)
+
+	for _, m := range []ImageMeta{
+		{Filename: "public.png", Owner: "alice"},
+		{Filename: "unlisted.png", Owner: "alice", Visibility: VisibilityUnlisted},
+		{Filename: "private.png", Owner: "alice", Visibility: VisibilityPrivate},
+		{Filename: "trashed.png", Owner: "alice", Deleted: time.Now()},
+	} {
+		if err := imageMeta.Add(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cookies := map[string]*http.Cookie{}
+	for username, role := range map[string]string{"alice": RoleUploader, "bob": RoleUploader, "root": RoleAdmin} {
+		if err := users.Add(username, "some password", role); err != nil {
+			t.Fatal(err)
+		}
+		cookies[username] = saveTestSession(t, store, map[interface{}]interface{}{"username": username})
+	}
+
+	tests := []struct {
+		user     string //"" for a visitor who is not logged in
+		filename string
+		view     bool
+		listed   bool
+	}{
+		{"", "public.png", true, true},
+		{"", "unlisted.png", true, false},
+		{"", "private.png", false, false},
+		{"", "trashed.png", false, false},
+		{"bob", "unlisted.png", true, false},
+		{"bob", "private.png", false, false},
+		{"alice", "unlisted.png", true, true},
+		{"alice", "private.png", true, true},
+		{"alice", "trashed.png", true, false},
+		{"root", "private.png", true, true},
+		{"root", "trashed.png", true, false},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/image/"+test.filename, nil)
+		if test.user != "" {
+			r.AddCookie(cookies[test.user])
+		}
+		if view := CanViewImage(r, test.filename); view != test.view {
+			t.Errorf("%q viewing %s: got %v, want %v", test.user, test.filename, view, test.view)
+		}
+		if listed := ImageListed(r, test.filename); listed != test.listed {
+			t.Errorf("%q listing %s: got %v, want %v", test.user, test.filename, listed, test.listed)
+		}
+	}
+}
+
+func TestFindHash(t *testing.T) {
+	testGallery(t)
+
+	data := testPNG(t, 1)
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+	for _, m := range []ImageMeta{
+		{Filename: "trashed.png", SHA256: digest, Deleted: time.Now()},
+		{Filename: "other.png", SHA256: "0123"},
+		{Filename: "unhashed.png"},
+	} {
+		if err := imageMeta.Add(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//Uploads are hashed while they are staged
+	staged, err := StageImage(bytes.NewReader(data), ".png", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer staged.Discard()
+	if staged.SHA256 != digest {
+		t.Fatalf("staged upload has digest %s, want %s", staged.SHA256, digest)
+	}
+
+	if m, found := imageMeta.FindHash(digest); found {
+		t.Errorf("found %s, which is in the trash", m.Filename)
+	}
+	if err := imageMeta.Add(ImageMeta{Filename: "arch.png", SHA256: digest}); err != nil {
+		t.Fatal(err)
+	}
+	if m, found := imageMeta.FindHash(digest); !found || m.Filename != "arch.png" {
+		t.Errorf("got %+v, %v, want arch.png", m, found)
+	}
+	if _, found := imageMeta.FindHash(""); found {
+		t.Error("an empty digest matched")
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Failure count for one username or IP address
+type loginAttempts struct {
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+//Counts failed logins per key and locks keys out with an exponential backoff.
+//Keys are "user:<name>" and "ip:<address>" so both are throttled independently.
+type LoginLimiter struct {
+	mu       sync.Mutex
+	attempts map[string]*loginAttempts
+}
+
+//Global login limiter
+var loginLimiter = &LoginLimiter{
+	attempts: make(map[string]*loginAttempts),
+}
+
+//Returns the number of failures allowed for the key before it is locked
+func freeAttempts(key string) int {
+	if strings.HasPrefix(key, "ip:") {
+		return config.LoginAttemptsIP
+	}
+	return config.LoginAttemptsUser
+}
+
+//Returns how long the longest locked of the keys stays locked, or 0 if none are
+func (l *LoginLimiter) Locked(keys ...string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var wait time.Duration
+	for _, key := range keys {
+		a, ok := l.attempts[key]
+		if !ok {
+			continue
+		}
+		if left := time.Until(a.LockedUntil); left > wait {
+			wait = left
+		}
+	}
+	return wait
+}
+
+//Records a failed login for the keys.
+//Returns how long the keys are now locked for, or 0 if they are not.
+func (l *LoginLimiter) Fail(keys ...string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.prune()
+
+	now := time.Now()
+	maxDelay := time.Duration(config.LoginLockoutMax) * time.Second
+
+	var wait time.Duration
+	for _, key := range keys {
+		a, ok := l.attempts[key]
+		if !ok {
+			a = &loginAttempts{}
+			l.attempts[key] = a
+		}
+		a.Failures++
+		a.LastFailure = now
+
+		over := a.Failures - freeAttempts(key)
+		if over < 0 {
+			continue
+		}
+
+		//Double the delay for every failure past the free attempts
+		delay := time.Duration(config.LoginLockoutBase) * time.Second
+		for i := 0; i < over && delay < maxDelay; i++ {
+			delay *= 2
+		}
+		if delay > maxDelay {
+			delay = maxDelay
+		}
+
+		a.LockedUntil = now.Add(delay)
+		if delay > wait {
+			wait = delay
+		}
+	}
+	return wait
+}
+
+//Clears the failures of the keys after a successful login
+func (l *LoginLimiter) Reset(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, key := range keys {
+		delete(l.attempts, key)
+	}
+}
+
+//Forgets keys that have not failed for longer than the maximum lockout.
+//Caller must hold the lock.
+func (l *LoginLimiter) prune() {
+	forget := time.Duration(config.LoginLockoutMax) * time.Second
+	for key, a := range l.attempts {
+		if time.Since(a.LastFailure) > forget && time.Now().After(a.LockedUntil) {
+			delete(l.attempts, key)
+		}
+	}
+}
+
+//Returns the message shown on the login page while logins are locked
+func lockoutMessage(wait time.Duration) string {
+	return fmt.Sprintf("Too many failed login attempts. Please try again in %v.", wait.Round(time.Second))
+}
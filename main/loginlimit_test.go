@@ -0,0 +1,120 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+//Trusts the given proxies until the test ends
+func testTrustedProxies(t *testing.T, list ...string) {
+	t.Helper()
+	oldConfig, oldProxies := config, trustedProxies
+	t.Cleanup(func() {
+		config, trustedProxies = oldConfig, oldProxies
+	})
+
+	var err error
+	config.TrustedProxies = list
+	trustedProxies, err = parseTrustedProxies(list)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	tests := []struct {
+		list []string
+		ok   bool
+	}{
+		{nil, true},
+		{[]string{"127.0.0.1", " 10.0.0.0/8 ", "::1", "fd00::/8"}, true},
+		{[]string{"proxy.example.com"}, false},
+		{[]string{"10.0.0.0/33"}, false},
+		{[]string{""}, false},
+	}
+	for _, test := range tests {
+		if _, err := parseTrustedProxies(test.list); (err == nil) != test.ok {
+			t.Errorf("%q: got %v", test.list, err)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	testTrustedProxies(t, "10.0.0.1", "192.168.0.0/16", "::1")
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     []string
+		ip         string
+	}{
+		{"direct", "203.0.113.7:5000", nil, "203.0.113.7"},
+		{"untrusted sender's header is ignored", "203.0.113.7:5000", []string{"198.51.100.1"}, "203.0.113.7"},
+		{"trusted proxy", "10.0.0.1:5000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"trusted IPv6 proxy", "[::1]:5000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"client written addresses are skipped", "10.0.0.1:5000", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"chain of trusted proxies", "10.0.0.1:5000", []string{"1.2.3.4, 198.51.100.1, 192.168.1.1"}, "198.51.100.1"},
+		{"repeated headers", "10.0.0.1:5000", []string{"1.2.3.4", "198.51.100.1, 192.168.1.1"}, "198.51.100.1"},
+		{"only trusted proxies", "10.0.0.1:5000", []string{"192.168.1.1"}, "192.168.1.1"},
+		{"malformed entry", "10.0.0.1:5000", []string{"198.51.100.1, nonsense"}, "10.0.0.1"},
+		{"no header", "10.0.0.1:5000", nil, "10.0.0.1"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/login", nil)
+		r.RemoteAddr = test.remoteAddr
+		for _, value := range test.header {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+		if ip := clientIP(r); ip != test.ip {
+			t.Errorf("%s: got %s, want %s", test.name, ip, test.ip)
+		}
+	}
+
+	config.ClientIPHeader = "X-Real-IP"
+	r := httptest.NewRequest(http.MethodPost, "/login", nil)
+	r.RemoteAddr = "10.0.0.1:5000"
+	r.Header.Set("X-Forwarded-For", "1.2.3.4")
+	r.Header.Set("X-Real-IP", "198.51.100.1")
+	if ip := clientIP(r); ip != "198.51.100.1" {
+		t.Errorf("X-Real-IP: got %s", ip)
+	}
+}
+
+func TestLoginLimiter(t *testing.T) {
+	testTrustedProxies(t, "10.0.0.1")
+	config.LoginAttemptsIP = 3
+	config.LoginLockoutBase = 30
+	config.LoginLockoutMax = 100
+
+	//Returns the limit key of a user behind the proxy
+	behindProxy := func(ip string) string {
+		r := httptest.NewRequest(http.MethodPost, "/login", nil)
+		r.RemoteAddr = "10.0.0.1:5000"
+		r.Header.Set("X-Forwarded-For", ip)
+		return "ip:" + clientIP(r)
+	}
+	attacker := behindProxy("203.0.113.7")
+
+	l := &LoginLimiter{attempts: make(map[string]*loginAttempts)}
+	waits := []time.Duration{0, 0, 30 * time.Second, 60 * time.Second, 100 * time.Second, 100 * time.Second}
+	for i, want := range waits {
+		if wait := l.Fail(attacker); wait != want {
+			t.Errorf("failure %d: locked for %v, want %v", i+1, wait, want)
+		}
+	}
+	if l.Locked(attacker) == 0 {
+		t.Error("address is not locked")
+	}
+
+	//Another user behind the same proxy is not locked out with the attacker
+	if wait := l.Locked(behindProxy("198.51.100.1")); wait != 0 {
+		t.Errorf("user behind the proxy locked for %v", wait)
+	}
+
+	l.Reset(attacker)
+	if wait := l.Locked(attacker); wait != 0 {
+		t.Errorf("reset address still locked for %v", wait)
+	}
+}
@@ -6,20 +6,19 @@ import (
 	"html/template"
 	"image"
 	"io"
-	"io/ioutil"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
-	"github.com/disintegration/imaging"
 	"github.com/gorilla/mux"
-	"github.com/gorilla/sessions"
 )
 
 var (
-	key        = []byte("super-secret-key")   //Designate key value for encrypting cookie data
-	store      = sessions.NewCookieStore(key) //Create a global cookie store using the key
+	store      *ServerStore //Global session store, created from the configured keys in main
 	extensions = []string{".jpg", ".JPG", ".png", ".PNG"}
 )
 
@@ -38,38 +37,77 @@ func getLogin(w http.ResponseWriter, r *http.Request) {
 		//First request:
 		if r.Method != http.MethodPost {
 			dataDefault := UserData{
-				Data:     false,
-				Success:  false,
-				Username: "",
+				Data:      false,
+				Success:   false,
+				Username:  "",
+				CSRFToken: data.CSRFToken,
+				SSOLabel:  ssoLabel(),
+				Expired:   SessionExpired(w, r),
 			}
 			DisplayError(w, r, tmpl.Execute(w, dataDefault))
 			return
 		}
 
-		session, _ := store.Get(r, "userData")
+		username := r.FormValue("username")
+		ip := clientIP(r)
+		limitKeys := []string{"user:" + username, "ip:" + ip}
 
-		//If username and password were entered:
-		if r.FormValue("username") != "" && r.FormValue("password") != "" {
+		//If there have been too many failed attempts, refuse without checking the password
+		if wait := loginLimiter.Locked(limitKeys...); wait > 0 {
+			Log(fmt.Sprintf("blocked login for %s from %s, locked for %v", username, ip, wait.Round(time.Second)))
+			Audit(r, AuditLoginLocked, "", username, "locked for "+wait.Round(time.Second).String())
 			formData := UserData{
-				Data:     true,
-				Success:  true,
-				Username: r.FormValue("username"),
+				Data:      true,
+				Success:   false,
+				Error:     lockoutMessage(wait),
+				CSRFToken: data.CSRFToken,
+				SSOLabel:  ssoLabel(),
 			}
+			w.WriteHeader(http.StatusTooManyRequests)
+			tmpl.Execute(w, formData)
+			return
+		}
+
+		//If username and password were entered and accepted by an auth backend:
+		remember := r.FormValue("remember") != ""
+		var user User
+		ident, err := authenticator.Authenticate(username, r.FormValue("password"))
+		if err == nil {
+			user, err = ProvisionUser(ident)
+		}
+		if err == nil {
+			//Users with two factor authentication still need to enter a code.
+			//Their failures are only cleared once the code is accepted, so
+			//entering the password again does not reset the lockout on codes.
+			if user.TOTPEnabled {
+				startPending2FA(w, r, user.Username, remember)
+				http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+				return
+			}
+
 			//Load logged in page
-			session.Values["data"] = formData.Data
-			session.Values["success"] = formData.Success
-			session.Values["username"] = formData.Username
-			session.Save(r, w)
+			loginLimiter.Reset(limitKeys...)
+			StartSession(w, r, user.Username, remember)
+			Audit(r, AuditLogin, user.Username, user.Username, "through "+user.BackendName())
 
 			http.Redirect(w, r, "/gallery", http.StatusSeeOther)
 			//displayError(w, r, tmpl.Execute(w, formData))
 			return
 		}
 
-		//If username and password were not both entered:
+		//If the username or password were missing or incorrect:
+		Log("failed login for " + username + " from " + ip)
+		Audit(r, AuditLoginFailed, "", username, "wrong username or password")
 		formData := UserData{
-			Data:    true,
-			Success: false,
+			Data:      true,
+			Success:   false,
+			CSRFToken: data.CSRFToken,
+			SSOLabel:  ssoLabel(),
+		}
+
+		if wait := loginLimiter.Fail(limitKeys...); wait > 0 {
+			Log(fmt.Sprintf("login for %s from %s locked for %v", username, ip, wait))
+			formData.Error = lockoutMessage(wait)
 		}
 
 		tmpl.Execute(w, formData)
@@ -78,15 +116,13 @@ func getLogin(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-//Generates logout page and sets userData cookie values to nil
+//Generates logout page and removes the userData session
 func getLogout(w http.ResponseWriter, r *http.Request) {
 	tmpl := template.Must(template.ParseFiles("assets/log_out.html", "assets/Templates.html"))
-	session, _ := store.Get(r, "userData")
-
-	session.Values["data"] = true
-	session.Values["success"] = false
-	session.Values["username"] = nil
-	session.Save(r, w)
+	if user, ok := CurrentUser(r); ok {
+		Audit(r, AuditLogout, user.Username, user.Username, "")
+	}
+	EndSession(w, r)
 
 	DisplayError(w, r, tmpl.Execute(w, nil))
 }
@@ -97,21 +133,25 @@ func getGallery(w http.ResponseWriter, r *http.Request) {
 	var imageData ImgTableData
 	imageData.GetLoginData(r)
 
-	files, _ := ioutil.ReadDir("./assets/images")
+	files := imageMeta.List()
 	images := make([]ImgData, len(files))
 
-	//Get all files
+	//Get all files the user may see
 	count := 0
 	for _, f := range files {
-		name := f.Name()
+		name := f.Filename
+		if !ImageListed(r, name) {
+			continue
+		}
 		thumbName := strings.Replace(name, filepath.Ext(name), "_thumb", -1)
 		name = strings.Replace(name, filepath.Ext(name), "", -1)
 
 		images[count].ImageName = name
 		images[count].ThumbName = thumbName
+		images[count].Title = f.DisplayName()
 		count++
 	}
-	imageData.Images = images
+	imageData.Images = images[:count]
 
 	DisplayError(w, r, tmpl.Execute(w, imageData))
 }
@@ -125,33 +165,42 @@ func getImage(w http.ResponseWriter, r *http.Request) {
 
 	vars := mux.Vars(r)
 	imgName := vars["imgName"]
-	var imgPath string
-	var err error
-	var ext string
-
-	for _, ex := range extensions {
-		//Try all file extensions to find the correct one
-		imgPath = "assets/images/" + imgName + ex
-
-		//Stat needs path without /, while the html parser needs it with a /
-		//Stat checks if the file exists
-		_, err = os.Stat(imgPath)
-
-		if !os.IsNotExist(err) {
-			//If file extension matches, break out of loop
-			ext = ex
-			break
-		}
+
+	//Try all file extensions to find the correct one
+	extName, found := FindImage(imgName)
+	//Images in the trash are only shown on the trash page
+	if meta, _ := imageMeta.Get(extName); meta.InTrash() {
+		found = false
 	}
 
-	//If the file was matched to a file extension, display the found file
-	if !os.IsNotExist(err) {
-		imgData.ExtName = (imgName + ext)
+	//If the file was matched to a file extension and the user may see it, display the found file
+	if found && CanViewImage(r, extName) {
+		imgData.ExtName = extName
 		imgData.Name = imgName
 		//prevent issues due to spaces in the image name
 		imgData.SrcName = strings.Replace(imgName, " ", "%20", -1)
-		imgData.ImagePath = ("/" + imgPath) //Add / to path for parser
+		imgData.ImagePath = "/assets/" + StorageName(ImagesFolder, extName)
 		imgData.Found = true
+
+		meta, found := imageMeta.Get(imgData.ExtName)
+		imgData.Title = meta.DisplayName()
+		if found && meta.Owner != "" {
+			imgData.Owner = meta.Owner
+			if owner, err := users.Get(meta.Owner); err == nil {
+				imgData.Owner = owner.Name()
+			}
+			imgData.Uploaded = meta.Uploaded.Format("January 2, 2006")
+		}
+		imgData.Visibility = meta.VisibilityLevel()
+		imgData.Versions = VersionInfos(meta)
+		imgData.Visibilities = visibilities
+
+		user, ok := CurrentUser(r)
+		imgData.CanDelete = ok && CanDeleteImage(user, imgData.ExtName)
+		imgData.CanEdit = ownsImage(r, meta)
+		if imgData.CanEdit {
+			imgData.Shares = ShareInfos(r, imgData.ExtName)
+		}
 	} else {
 		//Image is not found, display error
 		imgData.Found = false
@@ -201,138 +250,217 @@ func (pr *Progress) Print() {
 	fmt.Printf("File upload in progress: %d\n", pr.BytesRead)
 }
 
-//Accepts upload requests and checks if they are valid.
-//Valid requests will result in the files being saved to the
-//images folder with the same name and extension
-func uploadHandler(w http.ResponseWriter, r *http.Request) {
-	currentFileNames := GetFilenames(true)
-
-	if r.Method != "POST" {
-		DisplayError(w, r, errors.New(fmt.Sprintf("Cannot upload: %s method not allowed", r.Method)))
-		return
-	}
-
+//Opens the file sent in the fileInput field of an upload form, checking its size and type.
+//Returns the file, its header and its detected content type.
+func openUpload(r *http.Request) (multipart.File, *multipart.FileHeader, string, error) {
 	// 32 MB is the default used by FormFile
 	if err := r.ParseMultipartForm(32 << 20); err != nil {
-		DisplayError(w, r, errors.New("Form data cannot be read"), "file")
-		return
+		return nil, nil, "", errors.New("Form data cannot be read")
 	}
 
 	// get a reference to the fileHeaders
 	files := r.MultipartForm.File["fileInput"]
 
 	if len(files) < 1 {
-		DisplayError(w, r, errors.New(fmt.Sprintf("Cannot upload: No file has been submitted")), "file")
-		return
+		return nil, nil, "", errors.New(fmt.Sprintf("Cannot upload: No file has been submitted"))
 	}
 
 	fileHeader := files[0]
 
-	for _, fileName := range currentFileNames {
-		//Check if the file already exists
-		if fileHeader.Filename == fileName {
-			DisplayError(w, r, errors.New(fmt.Sprintf("Cannot upload: The file %s already exists", fileHeader.Filename)), "file")
-			return
-		}
-	}
-
 	if fileHeader.Size > maxUploadSize {
-		DisplayError(w, r, errors.New(fmt.Sprintf("Cannot upload: The file %s is too big. The maximum file size is %vMB in size", fileHeader.Filename, sizeMulti)), "file")
-		return
+		return nil, nil, "", errors.New(fmt.Sprintf("Cannot upload: The file %s is too big. The maximum file size is %vMB in size", fileHeader.Filename, sizeMulti))
 	}
 
 	file, err := fileHeader.Open()
 	if err != nil {
-		DisplayError(w, r, err, "file")
-		return
+		return nil, nil, "", err
 	}
 
-	defer file.Close()
-
 	buff := make([]byte, 512)
 	_, err = file.Read(buff)
 	if err != nil {
-		DisplayError(w, r, err, "file")
-		return
+		file.Close()
+		return nil, nil, "", err
 	}
 
 	filetype := http.DetectContentType(buff)
 	if filetype != "image/jpeg" && filetype != "image/png" {
-		DisplayError(w, r, errors.New(fmt.Sprintf("The provided file format (%s) is not allowed. Please upload a jpeg or png image", filepath.Ext(fileHeader.Filename))), "file")
-		return
+		file.Close()
+		return nil, nil, "", errors.New(fmt.Sprintf("The provided file format (%s) is not allowed. Please upload a jpeg or png image", filepath.Ext(fileHeader.Filename)))
 	}
 
 	_, err = file.Seek(0, io.SeekStart)
 	if err != nil {
-		DisplayError(w, r, err, "file")
+		file.Close()
+		return nil, nil, "", err
+	}
+
+	return file, fileHeader, filetype, nil
+}
+
+//Accepts upload requests and checks if they are valid.
+//Valid requests will result in the files being saved to the
+//images folder with the same name and extension
+func uploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		DisplayError(w, r, errors.New(fmt.Sprintf("Cannot upload: %s method not allowed", r.Method)))
 		return
 	}
 
-	err = os.MkdirAll("./assets/images", os.ModePerm)
+	file, fileHeader, filetype, err := openUpload(r)
 	if err != nil {
 		DisplayError(w, r, err, "file")
 		return
 	}
+	defer file.Close()
 
-	//Save file as filename.extension
-	//ext := filepath.Ext(fileHeader.Filename)
-	f, err := os.Create(fmt.Sprintf("./assets/images/%s", fileHeader.Filename))
-	if err != nil {
-		DisplayError(w, r, err, "file")
+	visibility := r.FormValue("visibility")
+	if visibility == "" {
+		visibility = VisibilityPublic
+	}
+	if !ValidVisibility(visibility) {
+		DisplayError(w, r, errors.New(fmt.Sprintf("Cannot upload: Unknown visibility %s", visibility)), "file")
 		return
 	}
 
-	defer f.Close()
+	//Uploads too big to fit are turned away before staging, and checked again after
+	user, _ := CurrentUser(r)
+	if err := CheckQuota(user.Username, fileHeader.Size); err != nil {
+		DisplayError(w, r, err, "file")
+		return
+	}
 
 	pr := &Progress{
 		TotalSize: fileHeader.Size,
 	}
 
-	_, err = io.Copy(f, io.TeeReader(file, pr))
+	//Files are saved under a safe version of their name, numbered if an image already has it.
+	//The name is kept for this upload until it is recorded, so no other upload can take it.
+	original := CleanOriginalName(fileHeader.Filename)
+	filename := SlugFilename(fileHeader.Filename, uploadExtensions[filetype])
+	replacing := ""
+	if existing, taken := imageNamed(strings.TrimSuffix(filename, filepath.Ext(filename))); taken &&
+		config.UploadCollisions == CollisionReplace && CanDeleteImage(user, existing.Filename) &&
+		ReserveReplacement(filename) {
+		replacing = existing.Filename
+	} else {
+		filename = ReserveFilename(filename)
+	}
+	defer ReleaseFilename(filename)
+
+	//The upload is staged and checked before anything in the gallery changes
+	staged, err := StageImage(file, uploadExtensions[filetype], pr)
 	if err != nil {
+		Log(original + " could not be uploaded: " + err.Error())
 		DisplayError(w, r, err, "file")
 		return
 	}
 
-	//GenerateAllSizes(fileHeader.Filename)
-	imageName := fileHeader.Filename
-	src, _ := imaging.Open("assets/images/" + imageName)
-	srcWidth := src.Bounds().Max.X
-	sizes := []int{400, 600, 800, 1000, 1200}
+	if existing, found := imageMeta.FindHash(staged.SHA256); found {
+		//The gallery already has the content, so the new copy is not kept
+		staged.Discard()
 
-	var path string
+		if config.DuplicateUploads != DuplicateLink || existing.BlobName() == replacing {
+			Log(original + " rejected as a duplicate of " + existing.Filename)
+			duplicateUpload(w, r, original, existing)
+			return
+		}
 
-	//Create a thread group
-	//var wg sync.WaitGroup
-	//wg.Add(len(sizes))
+		//Images sharing the replaced image's files keep them
+		if replacing != "" {
+			if err := detachLinks(replacing); err != nil {
+				DisplayError(w, r, err, "file")
+				return
+			}
+		}
 
-	//start := time.Now()
-	//For every size, create a new image if the size is less than the original image size
-	for _, size := range sizes {
-		var newSize int
-		if srcWidth <= size {
-			newSize = srcWidth
-		} else {
-			newSize = size
+		//Record the new name, sharing the files of the existing image.
+		//The record is made from scratch so none of the existing image's
+		//history, such as its earlier versions, carries over.
+		meta := ImageMeta{
+			Filename:     filename,
+			OriginalName: original,
+			Format:       existing.Format,
+			Width:        existing.Width,
+			Height:       existing.Height,
+			Size:         existing.Size,
+			Owner:        user.Username,
+			Visibility:   visibility,
+			SHA256:       existing.SHA256,
+			Blob:         existing.BlobName(),
+			Thumbnail:    existing.Thumbnail,
+			Resized:      append([]int(nil), existing.Resized...),
+		}
+		if err := recordUpload(meta, replacing); err != nil {
+			DisplayError(w, r, err, "file")
+			return
 		}
 
-		path = "assets/resized/" + FormatName(imageName, fmt.Sprintf("%v", size))
-		_, err = os.Stat(path)
-
-		//If the thumbnail does not already exist
-		if os.IsNotExist(err) {
-			//Run this function on a new thread
-			go func(newSize int, path string) {
-				//defer wg.Done()
-				resized := imaging.Resize(src, newSize, 0, imaging.Lanczos)
-				fmt.Printf("%v Finished\n", newSize)
-				imaging.Save(resized, path)
-			}(newSize, path)
+		if replacing != "" {
+			Audit(r, AuditDelete, user.Username, replacing, "replaced by upload")
+		}
+		Log(filename + " uploaded by " + user.Username + " as a copy of " + meta.Blob)
+		Audit(r, AuditUpload, user.Username, filename, visibility+", same as "+meta.Blob)
+	} else {
+		//The thumbnail and resized copies count towards the quota too, so the upload is
+		//checked again now they are made. The lock is held until the upload is recorded.
+		quotaMu.Lock()
+		defer quotaMu.Unlock()
+		if err := CheckStagedQuota(user.Username, staged, replacing); err != nil {
+			staged.Discard()
+			DisplayError(w, r, err, "file")
+			return
+		}
+
+		//Images sharing the replaced image's files get their own copy
+		//before an upload with the same name takes the files over
+		if replacing != "" {
+			if err := detachLinks(replacing); err != nil {
+				staged.Discard()
+				DisplayError(w, r, err, "file")
+				return
+			}
+		}
+
+		//The replaced image is only removed once the upload is in place and recorded
+		derived := staged.DerivedSize()
+		if err := staged.Commit(filename); err != nil {
+			Log(filename + " could not be moved into place: " + err.Error())
+			if replacing != "" {
+				go remakeDerivatives(replacing)
+			}
+			DisplayError(w, r, err, "file")
+			return
+		}
+
+		meta := staged.Meta
+		meta.Filename = filename
+		meta.OriginalName = original
+		meta.Owner = user.Username
+		meta.Visibility = visibility
+		meta.SHA256 = staged.SHA256
+		meta.Thumbnail = true
+		meta.Resized = append([]int(nil), imageSizes...)
+		meta.DerivedSize = derived
+		if err := recordUpload(meta, replacing); err != nil {
+			//Without a record the files would be orphaned, so take them out again,
+			//unless the upload has the name of the image it replaces and took over its files
+			if replacing != filename {
+				staged.Rollback(filename)
+			}
+			if replacing != "" {
+				go remakeDerivatives(replacing)
+			}
+			DisplayError(w, r, err, "file")
+			return
 		}
-	}
-	GenerateThumnail(fileHeader.Filename)
 
-	Log(fileHeader.Filename + " uploaded")
+		if replacing != "" {
+			Audit(r, AuditDelete, user.Username, replacing, "replaced by upload")
+		}
+		Log(filename + " uploaded by " + user.Username)
+		Audit(r, AuditUpload, user.Username, filename, visibility)
+	}
 
 	var data UserData
 	data.GetLoginData(r)
@@ -345,6 +473,22 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	//fmt.Printf("Took %v seconds to resize", duration)
 }
 
+//Tells the user their upload is already in the gallery, linking to the existing
+//image if they may see it
+func duplicateUpload(w http.ResponseWriter, r *http.Request, filename string, existing ImageMeta) {
+	tmpl := template.Must(template.ParseFiles("assets/duplicate.html", "assets/Templates.html"))
+	data := DuplicateData{Filename: filename}
+	data.GetLoginData(r)
+
+	if CanViewImage(r, existing.Filename) {
+		data.Existing = existing.Filename
+		data.ExistingName = strings.TrimSuffix(existing.Filename, filepath.Ext(existing.Filename))
+	}
+
+	w.WriteHeader(http.StatusConflict)
+	DisplayError(w, r, tmpl.Execute(w, data))
+}
+
 //Redirects search requests to the search handler, which is search/{search string}
 func searchRedirect(w http.ResponseWriter, r *http.Request) {
 	search := r.FormValue("search")
@@ -365,29 +509,32 @@ func searchHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	search := vars["search"]
 
-	imageData := CreateSearchImageTable(search)
+	imageData := CreateSearchImageTable(search, r)
 	imageData.GetLoginData(r)
 
 	DisplayError(w, r, tmpl.Execute(w, imageData))
 }
 
+//Deletes an image along with its thumbnail and resized copies.
+//Only the uploader of the image or an admin may delete it.
 func removalHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	fileName := vars["file"]
-	thumbName := FormatName(fileName, "thumb")
-	os.Remove("./assets/thumbnails/" + thumbName)
 
-	sizes := []int{400, 600, 800, 1000, 1200}
-	var path string
-	//For every size, create a new image if the size is less than the original image size
-	for _, size := range sizes {
-		path = FormatName(fileName, fmt.Sprintf("%v", size))
-		os.Remove("./assets/resized/" + path)
+	user, ok := CurrentUser(r)
+	if !ok || !CanDeleteImage(user, fileName) {
+		forbidden(w, r)
+		return
 	}
 
-	os.Remove("./assets/images/" + fileName)
+	//Images are moved to the trash, where they can be restored until they are purged
+	if err := imageMeta.Trash(fileName, user.Username); err != nil {
+		DisplayError(w, r, err)
+		return
+	}
 
-	Log(fileName + " deleted")
+	Log(fileName + " moved to the trash by " + user.Username)
+	Audit(r, AuditDelete, user.Username, fileName, "trash")
 	http.Redirect(w, r, "/gallery", http.StatusSeeOther)
 }
 
@@ -395,9 +542,48 @@ func downloadHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	file := vars["file"]
 
-	filepath := "./assets/images/" + file
+	if !CanViewImage(r, file) {
+		http.NotFound(w, r)
+		return
+	}
+
 	//Sends just the file data, not any page data
-	http.ServeFile(w, r, filepath)
+	ServeStorageFile(w, r, StorageName(ImagesFolder, ContentFile(file, file)))
+}
+
+//Changes the visibility of an image.
+//Only the uploader of the image or an admin may change it.
+func visibilityHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	fileName := vars["file"]
+	visibility := r.FormValue("visibility")
+
+	meta, _ := imageMeta.Get(fileName)
+	if !ownsImage(r, meta) {
+		forbidden(w, r)
+		return
+	}
+
+	name := strings.TrimSuffix(fileName, filepath.Ext(fileName))
+	if found, ok := FindImage(name); !ok || found != fileName {
+		notFound(w, r)
+		return
+	}
+
+	if !ValidVisibility(visibility) {
+		DisplayError(w, r, errors.New("Unknown visibility: "+visibility))
+		return
+	}
+
+	if err := imageMeta.SetVisibility(fileName, visibility); err != nil {
+		DisplayError(w, r, err)
+		return
+	}
+
+	user, _ := CurrentUser(r)
+	Log(fileName + " made " + visibility + " by " + user.Username)
+	Audit(r, AuditVisibility, user.Username, fileName, visibility)
+	http.Redirect(w, r, "/image/"+url.PathEscape(name), http.StatusSeeOther)
 }
 
 //404 page not found handler
@@ -415,22 +601,22 @@ func notFound(w http.ResponseWriter, r *http.Request) {
 //Debugging page that prints all file names
 func checkFiles(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "Table 1:\n")
-	images := GeneratePaginatedTable(1, 5)
+	images := GeneratePaginatedTable(1, 5, r)
 	for _, i := range images {
 		fmt.Fprintf(w, "%s\n", i.ImageName)
 	}
 	fmt.Fprintf(w, "\nTable 2:\n")
-	images = GeneratePaginatedTable(2, 5)
+	images = GeneratePaginatedTable(2, 5, r)
 	for _, i := range images {
 		fmt.Fprintf(w, "%s\n", i.ImageName)
 	}
 	fmt.Fprintf(w, "\nTable 3:\n")
-	images = GeneratePaginatedTable(1, 25)
+	images = GeneratePaginatedTable(1, 25, r)
 	for _, i := range images {
 		fmt.Fprintf(w, "%s\n", i.ImageName)
 	}
 	fmt.Fprintf(w, "\nTable 4:\n")
-	images = GeneratePaginatedTable(2, 8)
+	images = GeneratePaginatedTable(2, 8, r)
 	for _, i := range images {
 		fmt.Fprintf(w, "%s\n", i.ImageName)
 	}
@@ -440,7 +626,12 @@ func thumbTest1(w http.ResponseWriter, r *http.Request) {
 	name := "Jellyfish.jpg"
 	GenerateThumnail(name)
 
-	path, _ := os.Open("assets/thumbnails/" + FormatName(name, "thumb"))
+	path, err := storage.Get(StorageName(ThumbnailsFolder, FormatName(name, "thumb")))
+	if err != nil {
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	defer path.Close()
 	stats, _, _ := image.DecodeConfig(path)
 
 	fmt.Fprintf(w, "Width: %v Height: %v", stats.Width, stats.Height)
@@ -479,7 +670,7 @@ func formatTest(w http.ResponseWriter, r *http.Request) {
 	var data1 ImgTableData
 	data1.GetLoginData(r)
 
-	imageArray := CreateImageArray()
+	imageArray := CreateImageArray(r)
 
 	data2 := imgTableData2{
 		LoggedIn: data1.LoggedIn,
@@ -511,47 +702,158 @@ func rangeTest(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
-	fs := http.FileServer(http.Dir("assets"))             //Define assets folder as file server
-	fs2 := http.FileServer(http.Dir("assets/images"))     //Define images folder as file server
-	fs3 := http.FileServer(http.Dir("assets/thumbnails")) //Define thumbnails folder as file server
-	fs4 := http.FileServer(http.Dir("assets/resized"))    //Define other images folder as file server
+	err := LoadConfig()
+	if err != nil {
+		fmt.Println("Could not load config:", err)
+		os.Exit(1)
+	}
+	if err = SetupSessionStore(); err != nil {
+		fmt.Println("Could not set up sessions:", err)
+		os.Exit(1)
+	}
+
+	users, err = LoadUserStore(usersPath)
+	if err != nil {
+		fmt.Println("Could not load users:", err)
+		os.Exit(1)
+	}
+	if err = users.Bootstrap(); err != nil {
+		fmt.Println("Could not create admin account:", err)
+		os.Exit(1)
+	}
+	if err = SetupAuthenticator(); err != nil {
+		fmt.Println("Could not set up authentication:", err)
+		os.Exit(1)
+	}
+	if err = SetupOIDC(); err != nil {
+		fmt.Println("Could not set up single sign on:", err)
+		os.Exit(1)
+	}
+	tokens, err = LoadTokenStore(tokensPath)
+	if err != nil {
+		fmt.Println("Could not load API tokens:", err)
+		os.Exit(1)
+	}
+	if err = SetupStorage(); err != nil {
+		fmt.Println("Could not set up storage:", err)
+		os.Exit(1)
+	}
+	imageMeta, err = OpenImageStore(imagesDBPath)
+	if err != nil {
+		fmt.Println("Could not open the image database:", err)
+		os.Exit(1)
+	}
+	shareKeys, err := ShareKeys()
+	if err != nil {
+		fmt.Println("Could not load share link keys:", err)
+		os.Exit(1)
+	}
+	shares, err = LoadShareStore(sharesPath, shareKeys)
+	if err != nil {
+		fmt.Println("Could not load share links:", err)
+		os.Exit(1)
+	}
+	//"check" checks the gallery's files instead of starting the server. It runs before
+	//the startup scan so it sees the gallery as it is and only changes it when repairing.
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(checkCommand(os.Args[2:]))
+	}
+	//The image database can only be opened once, so no other server is mid upload
+	if err = CleanStaging(); err != nil {
+		fmt.Println("Could not clean the staging folder:", err)
+		os.Exit(1)
+	}
+	if err = imageMeta.Migrate(imagesPath); err != nil {
+		fmt.Println("Could not import image details:", err)
+		os.Exit(1)
+	}
+	if err = imageMeta.Scan(); err != nil {
+		fmt.Println("Could not scan images:", err)
+		os.Exit(1)
+	}
+	StartTrashPurge()
 
-	r := mux.NewRouter() //Create router
+	fs := http.FileServer(http.Dir("assets"))  //Define assets folder as file server
+	fs2 := StorageFileServer(ImagesFolder)     //Define images folder as file server
+	fs3 := StorageFileServer(ThumbnailsFolder) //Define thumbnails folder as file server
+	fs4 := StorageFileServer(ResizedFolder)    //Define other images folder as file server
 
-	//Handle requests for assets
-	r.PathPrefix("/assets/").Handler(http.StripPrefix("/assets/", fs))
+	r := mux.NewRouter()   //Create router
+	r.Use(TokenMiddleware) //Authenticate requests sending API tokens
+	r.Use(CSRFMiddleware)  //Check CSRF tokens on every form submission
+
+	//Image folders come before the assets folder so their visibility is checked
 	//Handle requests for images
-	r.PathPrefix("/assets/images/").Handler(http.StripPrefix("/assets/images/", fs2))
+	r.PathPrefix("/assets/images/").Handler(http.StripPrefix("/assets/images/", ImageFileServer(fs2, false)))
 	//Handle requests for images
-	r.PathPrefix("/assets/thumbnails/").Handler(http.StripPrefix("/assets/thumbnails/", fs3))
+	r.PathPrefix("/assets/thumbnails/").Handler(http.StripPrefix("/assets/thumbnails/", ImageFileServer(fs3, true)))
 	//Handle other image requests
-	r.PathPrefix("/assets/resized/").Handler(http.StripPrefix("/assets/resized/", fs4))
+	r.PathPrefix("/assets/resized/").Handler(http.StripPrefix("/assets/resized/", ImageFileServer(fs4, true)))
+	//Earlier versions and unfinished uploads are only served through their own checks
+	r.PathPrefix("/assets/" + VersionsFolder + "/").Handler(http.NotFoundHandler())
+	r.PathPrefix("/assets/" + StagingFolder + "/").Handler(http.NotFoundHandler())
+	//Handle requests for assets
+	r.PathPrefix("/assets/").Handler(http.StripPrefix("/assets/", fs))
 
-	r.HandleFunc("/login", getLogin)         //Handle login page
-	r.HandleFunc("/gallery", getGallery)     //Handle main gallery page
-	r.HandleFunc("/logout", getLogout)       //Handle logout page
-	r.HandleFunc("/upload", getUpload)       //Handle upload page
-	r.HandleFunc("/uploaded", uploadHandler) //Handle file uploads
-	r.HandleFunc("/search", searchRedirect)  //Redirect search requests
+	r.HandleFunc("/login", getLogin)        //Handle login page
+	r.HandleFunc("/login/2fa", getLogin2FA) //Handle second login step
+	//Handle single sign on through an OpenID Connect provider
+	r.HandleFunc("/login/oidc", getOIDCLogin)
+	r.HandleFunc("/login/oidc/callback", getOIDCCallback)
+	r.HandleFunc("/gallery", getGallery)    //Handle main gallery page
+	r.HandleFunc("/logout", getLogout)      //Handle logout page
+	r.HandleFunc("/register", getRegister)  //Handle account registration page
+	r.HandleFunc("/profile", getProfile)    //Handle profile page
+	r.HandleFunc("/settings", getSettings)  //Handle account settings page
+	r.HandleFunc("/search", searchRedirect) //Redirect search requests
 
 	//Handle requests for image files to be displayed
 	r.HandleFunc("/image/{imgName}", getImage)
 	//Handle search requests
 	r.HandleFunc("/search/{search}", searchHandler)
-	//Handle deletion requests
-	r.HandleFunc("/delete/{file}", removalHandler)
 	//Handle download requests
 	r.HandleFunc("/download/{file}", downloadHandler)
+	//Handle downloads of earlier versions of images
+	r.HandleFunc("/version/{file}/{number:[0-9]+}", versionDownloadHandler)
+	//Handle image visibility changes
+	r.HandleFunc("/visibility/{file}", visibilityHandler).Methods(http.MethodPost)
+	//Handle share links, which work without logging in
+	r.HandleFunc("/share/new/{file}", shareCreateHandler).Methods(http.MethodPost)
+	r.HandleFunc("/share/revoke/{id}", shareRevokeHandler).Methods(http.MethodPost)
+	r.HandleFunc("/share/{token}", getShare)
+	r.HandleFunc("/share/{token}/{folder:images|thumbnails|resized}/{file}", shareFileHandler)
 
 	r.NotFoundHandler = http.HandlerFunc(notFound)
 
+	//Pages only available to uploaders and admins:
+	uploaders := r.NewRoute().Subrouter()
+	uploaders.Use(RequireRole(RoleUploader, RoleAdmin))
+
+	uploaders.HandleFunc("/upload", getUpload)       //Handle upload page
+	uploaders.HandleFunc("/uploaded", uploadHandler) //Handle file uploads
+	//Handle deletion requests
+	uploaders.HandleFunc("/delete/{file}", removalHandler).Methods(http.MethodPost)
+	uploaders.HandleFunc("/trash", getTrash) //Handle the trash page, restoring and purging deleted images
+	//Handle new versions of images and reverting to earlier ones
+	uploaders.HandleFunc("/version/{file}", versionUploadHandler).Methods(http.MethodPost)
+	uploaders.HandleFunc("/version/{file}/{number:[0-9]+}/revert", versionRevertHandler).Methods(http.MethodPost)
+
+	//Pages only available to admins:
+	admins := r.NewRoute().Subrouter()
+	admins.Use(RequireRole(RoleAdmin))
+
+	admins.HandleFunc("/admin/users", getAdminUsers) //Manage user roles
+	admins.HandleFunc("/admin/audit", getAdminAudit) //View the audit log
+	admins.HandleFunc("/admin/audit/export", auditExportHandler)
+	admins.HandleFunc("/admin/check", getAdminCheck) //Check and repair the gallery's files
+
 	//Debug/test pages:
-	r.HandleFunc("/files", checkFiles)            //Print all files
-	r.HandleFunc("/range", rangeTest)             //Test multidimensional arrays parsing
-	r.HandleFunc("/thumb1", thumbTest1)           //Generate single thumbnail
-	r.HandleFunc("/thumb2", thumbTest2)           //Generate all thumbnails
-	r.HandleFunc("/format", formatTest)           //Test multidimensional array formating
-	r.HandleFunc("/sizes", generateAllImageSizes) //Resize all images in folder
+	admins.HandleFunc("/files", checkFiles)            //Print all files
+	admins.HandleFunc("/range", rangeTest)             //Test multidimensional arrays parsing
+	admins.HandleFunc("/thumb1", thumbTest1)           //Generate single thumbnail
+	admins.HandleFunc("/thumb2", thumbTest2)           //Generate all thumbnails
+	admins.HandleFunc("/format", formatTest)           //Test multidimensional array formating
+	admins.HandleFunc("/sizes", generateAllImageSizes) //Resize all images in folder
 
 	http.ListenAndServe(":3000", r) //Attach router to port
 }
@@ -3,12 +3,12 @@ package main
 import (
 	"fmt"
 	"html/template"
-	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -17,30 +17,70 @@ import (
 )
 
 type UserData struct {
-	LoggedIn bool
-	Data     bool //Tells whether a log in attempt has been made
-	Success  bool //Tells whether the log in attempt was successful
-	Username string
+	LoggedIn  bool
+	Data      bool //Tells whether a log in attempt has been made
+	Success   bool //Tells whether the log in attempt was successful
+	Username  string
+	Error     string //Reason the log in attempt was refused, if not a wrong password
+	CSRFToken string
+	SSOLabel  string //Label of the single sign on button, "" when it is turned off
+	Expired   bool   //The user's session timed out
 }
 
 type ImgPageData struct {
 	LoggedIn  bool
 	Username  string
+	CanDelete bool
+	CSRFToken string
 	Found     bool
 	Name      string
+	Title     string //Name shown to users, the uploaded file name if recorded
 	SrcName   string
 	ExtName   string
 	ImagePath string
+	Owner     string //Display name of the uploader, "" if not recorded
+	Uploaded  string
+
+	Visibility   string
+	Visibilities []string
+	CanEdit      bool //Can change the visibility and share the image
+	Shares       []ShareInfo
+	Versions     []VersionInfo
+}
+
+//Data of the page shown when an upload is already in the gallery
+type DuplicateData struct {
+	LoggedIn     bool
+	Username     string
+	CSRFToken    string
+	Filename     string //Name the file was uploaded as
+	Existing     string //File of the existing image, "" if the user may not see it
+	ExistingName string //Existing file without its extension
+}
+
+//Checks cookie data to see is user is logged in.
+func (data *DuplicateData) GetLoginData(r *http.Request) {
+	session, _ := store.Get(r, "userData")
+	data.CSRFToken = CSRFToken(r)
+
+	if IsNil(session.Values["username"]) { //If cookie not found or user logged out
+		data.LoggedIn = false
+	} else {
+		data.Username = session.Values["username"].(string)
+		data.LoggedIn = true
+	}
 }
 
 type ImgData struct {
 	ImageName string
 	ThumbName string
+	Title     string //Name shown under the image
 }
 
 type ImgTableData struct {
 	LoggedIn   bool
 	Username   string
+	CSRFToken  string
 	Images     []ImgData
 	Numfound   int
 	SearchItem string
@@ -57,6 +97,7 @@ type ImgTableData2 struct {
 //Checks cookie data to see is user is logged in.
 func (data *UserData) GetLoginData(r *http.Request) {
 	session, _ := store.Get(r, "userData")
+	data.CSRFToken = CSRFToken(r)
 
 	if IsNil(session.Values["username"]) { //If cookie not found or user logged out
 		data.Data = true
@@ -73,6 +114,7 @@ func (data *UserData) GetLoginData(r *http.Request) {
 //Checks cookie data to see is user is logged in.
 func (data *ImgPageData) GetLoginData(r *http.Request) {
 	session, _ := store.Get(r, "userData")
+	data.CSRFToken = CSRFToken(r)
 
 	if IsNil(session.Values["username"]) { //If cookie not found or user logged out
 		data.LoggedIn = false
@@ -85,6 +127,7 @@ func (data *ImgPageData) GetLoginData(r *http.Request) {
 //Checks cookie data to see is user is logged in.
 func (data *ImgTableData) GetLoginData(r *http.Request) {
 	session, _ := store.Get(r, "userData")
+	data.CSRFToken = CSRFToken(r)
 
 	if IsNil(session.Values["username"]) { //If cookie not found or user logged out
 		data.LoggedIn = false
@@ -105,6 +148,50 @@ func (data *ImgTableData2) GetLoginData(r *http.Request) {
 	}
 }
 
+//Marks the userData session as logged in as the given user.
+//The session gets a new ID so one set before logging in cannot be reused.
+//Remembered sessions last longer and are not ended for being idle.
+func StartSession(w http.ResponseWriter, r *http.Request, username string, remember bool) error {
+	session, _ := store.Get(r, "userData")
+	store.Regenerate(session)
+	delete(session.Values, "pending2fa")
+	delete(session.Values, "pending2faTime")
+	delete(session.Values, "pending2faRemember")
+	delete(session.Values, "expired")
+
+	session.Values["data"] = true
+	session.Values["success"] = true
+	session.Values["username"] = username
+	session.Values["loginTime"] = time.Now().Unix()
+	if remember {
+		session.Values["remember"] = true
+		session.Options.MaxAge = int(store.RememberTimeout.Seconds())
+	}
+	newCSRFToken(r)
+	return session.Save(r, w)
+}
+
+//Returns true once after the user's session timed out, so the login page can say so
+func SessionExpired(w http.ResponseWriter, r *http.Request) bool {
+	session, _ := store.Get(r, "userData")
+	if session.Values["expired"] != true {
+		return false
+	}
+
+	delete(session.Values, "expired")
+	session.Save(r, w)
+	return true
+}
+
+//Deletes the userData session from the store and the browser
+func EndSession(w http.ResponseWriter, r *http.Request) error {
+	session, _ := store.Get(r, "userData")
+
+	session.Values = make(map[interface{}]interface{})
+	session.Options.MaxAge = -1
+	return session.Save(r, w)
+}
+
 //Helper functions:
 //https://mangatmodi.medium.com/go-check-nil-interface-the-right-way-d142776edef1
 func IsNil(i interface{}) bool {
@@ -156,39 +243,30 @@ func DisplayError(w http.ResponseWriter, r *http.Request, err error, errorVarian
 	}
 }
 
-//Returns all files in the images folder.
+//Returns all files in the images folder, as recorded in the image database.
 //If extension is true, returns with file extensions.
 //If extension is false, just returns the file names.
 func GetFilenames(extension bool) []string {
-	files, err := ioutil.ReadDir("./assets/images")
+	files := imageMeta.List()
 	ImageNames := make([]string, len(files))
 
-	if err == nil {
-		count := 0
-
-		if extension {
-			for _, f := range files {
-				name := f.Name()
+	for i, f := range files {
+		name := f.Filename
 
-				ImageNames[count] = name
-				count++
-			}
-		} else {
-			for _, f := range files {
-				name := f.Name()
-
-				//Remove extensions from file names
-				name = strings.Replace(name, filepath.Ext(name), "", -1)
-
-				ImageNames[count] = name
-				count++
-			}
+		if !extension {
+			//Remove extensions from file names
+			name = strings.Replace(name, filepath.Ext(name), "", -1)
 		}
+
+		ImageNames[i] = name
 	}
 
 	return ImageNames
 }
 
+//Widths of the resized copies shown on the image page
+var imageSizes = []int{400, 600, 800, 1000, 1200}
+
 func FormatName(filename string, newName string) string {
 	//Get file extension
 	ext := filepath.Ext(filename)
@@ -199,35 +277,65 @@ func FormatName(filename string, newName string) string {
 }
 
 func GenerateThumnail(imageName string) {
-	src, _ := imaging.Open("assets/images/" + imageName)
-	thumbPath := "assets/thumbnails/" + FormatName(imageName, "thumb")
-	_, err := os.Stat(thumbPath)
+	//Images sharing another image's files use its thumbnail
+	if meta, _ := imageMeta.Get(imageName); meta.Blob != "" {
+		return
+	}
+	thumbPath := StorageName(ThumbnailsFolder, FormatName(imageName, "thumb"))
 
 	//If the thumbnail does not already exist
-	if os.IsNotExist(err) {
+	if !StorageExists(thumbPath) {
+		src, err := LoadImage(StorageName(ImagesFolder, imageName))
+		if err != nil {
+			Log("could not make a thumbnail of " + imageName + ": " + err.Error())
+			return
+		}
 		//fmt.Printf("Resizing\n")
 		// Resize the cropped image to width = 200px preserving the aspect ratio.
 		resized := imaging.Resize(src, 0, 200, imaging.Lanczos)
 
-		imaging.Save(resized, thumbPath)
+		if err := SaveImage(thumbPath, resized); err != nil {
+			Log("could not save the thumbnail of " + imageName + ": " + err.Error())
+			return
+		}
 	}
+	imageMeta.Update(imageName, func(m *ImageMeta) {
+		m.Thumbnail = true
+	})
+	recordDerivedSize(imageName)
+}
+
+//Records that a resized copy of the image has been made
+func markResized(imageName string, size int) {
+	imageMeta.Update(imageName, func(m *ImageMeta) {
+		for _, done := range m.Resized {
+			if done == size {
+				return
+			}
+		}
+		m.Resized = append(m.Resized, size)
+		sort.Ints(m.Resized)
+	})
 }
 
 func GenerateAllSizes(imageName string) {
-	src, _ := imaging.Open("assets/images/" + imageName)
-	srcWidth := src.Bounds().Max.X
-	sizes := []int{400, 600, 800, 1000, 1200}
+	if meta, _ := imageMeta.Get(imageName); meta.Blob != "" {
+		return
+	}
 
-	var path string
-	var err error
+	src, err := LoadImage(StorageName(ImagesFolder, imageName))
+	if err != nil {
+		Log("could not resize " + imageName + ": " + err.Error())
+		return
+	}
+	srcWidth := src.Bounds().Max.X
 
 	//Create a thread group
 	var wg sync.WaitGroup
-	wg.Add(len(sizes))
 
 	start := time.Now()
 	//For every size, create a new image if the size is less than the original image size
-	for _, size := range sizes {
+	for _, size := range imageSizes {
 		var newSize int
 		if srcWidth <= size {
 			newSize = srcWidth
@@ -235,41 +343,53 @@ func GenerateAllSizes(imageName string) {
 			newSize = size
 		}
 
-		path = "assets/resized/" + FormatName(imageName, fmt.Sprintf("%v", size))
-		_, err = os.Stat(path)
+		path := StorageName(ResizedFolder, FormatName(imageName, fmt.Sprintf("%v", size)))
 
-		//If the thumbnail does not already exist
-		if os.IsNotExist(err) {
+		//If the resized image does not already exist
+		if !StorageExists(path) {
 			//Run this function on a new thread
-			go func(newSize int, path string) {
+			wg.Add(1)
+			go func(size int, newSize int, path string) {
 				defer wg.Done()
 				resized := imaging.Resize(src, newSize, 0, imaging.Lanczos)
-				imaging.Save(resized, path)
-			}(newSize, path)
+				if err := SaveImage(path, resized); err != nil {
+					Log("could not save " + path + ": " + err.Error())
+					return
+				}
+				markResized(imageName, size)
+			}(size, newSize, path)
+		} else {
+			markResized(imageName, size)
 		}
 	}
 
 	//Wait for all threads to finish
 	wg.Wait()
+	recordDerivedSize(imageName)
 	duration := time.Since(start)
 	fmt.Printf("Took %v seconds to resize\n", duration)
 }
 
-func CreateImageArray() [][]ImgData {
-	files, _ := ioutil.ReadDir("./assets/images")
+func CreateImageArray(r *http.Request) [][]ImgData {
+	files := imageMeta.List()
 	images := make([]ImgData, len(files))
 
-	//Get all files
+	//Get all files the user may see
 	count := 0
 	for _, f := range files {
-		name := f.Name()
+		name := f.Filename
+		if !ImageListed(r, name) {
+			continue
+		}
 		thumbName := strings.Replace(name, filepath.Ext(name), "_thumb", -1)
 		name = strings.Replace(name, filepath.Ext(name), "", -1)
 
 		images[count].ImageName = name
 		images[count].ThumbName = thumbName
+		images[count].Title = f.DisplayName()
 		count++
 	}
+	images = images[:count]
 
 	//Format multi-dimensional array
 	length := len(images)
@@ -311,27 +431,31 @@ func CreateImageArray() [][]ImgData {
 	return imageArray
 }
 
-func CreateSearchImageTable(search string) ImgTableData {
-	files, _ := ioutil.ReadDir("./assets/images")
+func CreateSearchImageTable(search string, r *http.Request) ImgTableData {
+	files := imageMeta.List()
 	var images []ImgData
 	imageData := ImgTableData{
 		SearchItem: search,
 	}
 
-	//Get all files
+	//Get all files the user may see
 	for _, f := range files {
-		name := f.Name()
+		name := f.Filename
+		if !ImageListed(r, name) {
+			continue
+		}
 		thumbName := strings.Replace(name, filepath.Ext(name), "_thumb", -1)
 		name = strings.Replace(name, filepath.Ext(name), "", -1)
 
 		match := "(?i)" + search
 		reg := regexp.MustCompile(match)
 
-		//If name matches, add to array
-		if reg.Match([]byte(name)) {
+		//If the name or uploaded file name matches, add to array
+		if reg.Match([]byte(name)) || reg.Match([]byte(f.DisplayName())) {
 			temp := ImgData{
 				ImageName: name,
 				ThumbName: thumbName,
+				Title:     f.DisplayName(),
 			}
 			images = append(images, temp)
 		}
@@ -343,8 +467,13 @@ func CreateSearchImageTable(search string) ImgTableData {
 	return imageData
 }
 
-func GeneratePaginatedTable(pageNum int, skip int) []ImgData {
-	filenames := GetFilenames(true)
+func GeneratePaginatedTable(pageNum int, skip int, r *http.Request) []ImgData {
+	var filenames []string
+	for _, name := range GetFilenames(true) {
+		if ImageListed(r, name) {
+			filenames = append(filenames, name)
+		}
+	}
 	skipNum1 := (pageNum - 1) * skip
 	skipNum2 := pageNum * skip
 
@@ -360,9 +489,11 @@ func GeneratePaginatedTable(pageNum int, skip int) []ImgData {
 		name := n
 		thumbName := strings.Replace(name, filepath.Ext(name), "_thumb", -1)
 		name = strings.Replace(name, filepath.Ext(name), "", -1)
+		meta, _ := imageMeta.Get(n)
 
 		images[count].ImageName = name
 		images[count].ThumbName = thumbName
+		images[count].Title = meta.DisplayName()
 		count++
 	}
 
@@ -0,0 +1,571 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+//Backend name of accounts created through OpenID Connect
+const oidcBackend = "oidc"
+
+//How long a login started at the provider stays valid
+const oidcPending = 10 * time.Minute
+
+//Settings for logging in through an OpenID Connect provider
+type OIDCConfig struct {
+	Issuer       string   `json:"issuer"` //Such as https://accounts.example.com
+	ClientID     string   `json:"client_id"`
+	ClientSecret string   `json:"client_secret"`
+	RedirectURL  string   `json:"redirect_url"` //Must end in /login/oidc/callback
+	Scopes       []string `json:"scopes"`
+	Label        string   `json:"label"` //Shown on the login button
+
+	UsernameClaim    string `json:"username_claim"`
+	DisplayNameClaim string `json:"display_name_claim"`
+	//Claim holding the user's groups or roles, and which gallery role each value gives.
+	//When several values match, the most privileged role is used.
+	RoleClaim string            `json:"role_claim"`
+	RoleMap   map[string]string `json:"role_map"`
+}
+
+//Endpoints read from the provider's discovery document
+type oidcDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+//One key from the provider's JWKS
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+//Talks to an OpenID Connect provider and verifies the ID tokens it issues
+type OIDCProvider struct {
+	Config OIDCConfig
+	Client *http.Client
+
+	mu        sync.Mutex
+	discovery *oidcDiscovery
+	keys      map[string]crypto.PublicKey
+	keysTime  time.Time
+}
+
+//Global OIDC provider, nil unless configured
+var oidcProvider *OIDCProvider
+
+//Creates the global provider if an issuer is configured
+func SetupOIDC() error {
+	if config.OIDC.Issuer == "" {
+		return nil
+	}
+	if config.OIDC.ClientID == "" || config.OIDC.RedirectURL == "" {
+		return errors.New("oidc needs client_id and redirect_url")
+	}
+
+	oidcProvider = &OIDCProvider{
+		Config: config.OIDC,
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+	return nil
+}
+
+//Returns the label of the single sign on button, or "" if OIDC is off
+func ssoLabel() string {
+	if oidcProvider == nil {
+		return ""
+	}
+	return oidcProvider.Config.Label
+}
+
+//Fetches a json document from the provider
+func (p *OIDCProvider) getJSON(u string, v interface{}) error {
+	resp, err := p.Client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+//Returns the provider's endpoints, fetching them the first time
+func (p *OIDCProvider) endpoints() (*oidcDiscovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	var d oidcDiscovery
+	err := p.getJSON(strings.TrimRight(p.Config.Issuer, "/")+"/.well-known/openid-configuration", &d)
+	if err != nil {
+		return nil, err
+	}
+	if d.Issuer != p.Config.Issuer {
+		return nil, fmt.Errorf("provider issuer %q does not match configured issuer %q", d.Issuer, p.Config.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("provider discovery document is missing endpoints")
+	}
+
+	p.discovery = &d
+	return p.discovery, nil
+}
+
+//Returns the signing key with the given ID.
+//The key set is refetched when an unknown key is asked for, at most once a minute,
+//so keys rotated by the provider are picked up.
+func (p *OIDCProvider) key(kid string) (crypto.PublicKey, error) {
+	d, err := p.endpoints()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(p.keysTime) < time.Minute {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(d.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+
+	p.keys = make(map[string]crypto.PublicKey)
+	p.keysTime = time.Now()
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			Log("skipping OIDC key " + jwk.Kid + ": " + err.Error())
+			continue
+		}
+		p.keys[jwk.Kid] = key
+	}
+
+	key, ok := p.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+//Decodes an RSA or P-256 key from its JWK form
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(s)
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decode(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, errors.New("unsupported curve " + jwk.Crv)
+		}
+		x, err := decode(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+
+	return nil, errors.New("unsupported key type " + jwk.Kty)
+}
+
+//Returns the url the user is sent to for logging in at the provider.
+//With reauth set the provider is asked to make the user log in again even if
+//they are still logged in there.
+func (p *OIDCProvider) AuthURL(state string, nonce string, verifier string, reauth bool) (string, error) {
+	d, err := p.endpoints()
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+
+	scopes := append([]string{"openid"}, p.Config.Scopes...)
+	values := url.Values{}
+	values.Set("response_type", "code")
+	values.Set("client_id", p.Config.ClientID)
+	values.Set("redirect_uri", p.Config.RedirectURL)
+	values.Set("scope", strings.Join(scopes, " "))
+	values.Set("state", state)
+	values.Set("nonce", nonce)
+	values.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	values.Set("code_challenge_method", "S256")
+	if reauth {
+		values.Set("prompt", "login")
+	}
+
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + values.Encode(), nil
+}
+
+//Trades the authorization code for tokens and returns the raw ID token
+func (p *OIDCProvider) Exchange(code string, verifier string) (string, error) {
+	d, err := p.endpoints()
+	if err != nil {
+		return "", err
+	}
+
+	values := url.Values{}
+	values.Set("grant_type", "authorization_code")
+	values.Set("code", code)
+	values.Set("redirect_uri", p.Config.RedirectURL)
+	values.Set("code_verifier", verifier)
+	values.Set("client_id", p.Config.ClientID)
+
+	req, err := http.NewRequest(http.MethodPost, d.TokenEndpoint, strings.NewReader(values.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.Config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.Config.ClientID), url.QueryEscape(p.Config.ClientSecret))
+	}
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+	if body.Error != "" {
+		return "", fmt.Errorf("token endpoint: %s %s", body.Error, body.ErrorDescription)
+	}
+	if body.IDToken == "" {
+		return "", errors.New("token endpoint returned no id_token")
+	}
+	return body.IDToken, nil
+}
+
+//Checks the ID token's signature, issuer, audience, expiry and nonce.
+//Returns its claims.
+func (p *OIDCProvider) Verify(idToken string, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed id token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := p.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" {
+			return nil, errors.New("id token algorithm " + header.Alg + " does not match its key")
+		}
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig); err != nil {
+			return nil, errors.New("id token signature is invalid")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(sig) != 64 {
+			return nil, errors.New("id token algorithm " + header.Alg + " does not match its key")
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(k, digest[:], r, s) {
+			return nil, errors.New("id token signature is invalid")
+		}
+	default:
+		return nil, errors.New("unsupported signing key")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+
+	if iss, _ := claims["iss"].(string); iss != p.Config.Issuer {
+		return nil, errors.New("id token has the wrong issuer")
+	}
+	if !claimContains(claims["aud"], p.Config.ClientID) {
+		return nil, errors.New("id token is not for this client")
+	}
+	exp, _ := claims["exp"].(float64)
+	if time.Now().After(time.Unix(int64(exp), 0).Add(time.Minute)) {
+		return nil, errors.New("id token has expired")
+	}
+	if got, _ := claims["nonce"].(string); nonce == "" || subtle.ConstantTimeCompare([]byte(got), []byte(nonce)) != 1 {
+		return nil, errors.New("id token nonce does not match")
+	}
+
+	return claims, nil
+}
+
+//Decodes one base64 json part of a JWT
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+//Returns true if a string or list of strings claim contains the value
+func claimContains(claim interface{}, value string) bool {
+	switch c := claim.(type) {
+	case string:
+		return c == value
+	case []interface{}:
+		for _, v := range c {
+			if s, ok := v.(string); ok && s == value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//Returns the gallery role the claims map to, or "" if no role claim is configured.
+//Users whose claim matches no role get the role of new external accounts.
+func (p *OIDCProvider) Role(claims map[string]interface{}) string {
+	if p.Config.RoleClaim == "" {
+		return ""
+	}
+
+	for _, role := range roles {
+		for value, mapped := range p.Config.RoleMap {
+			if mapped == role && claimContains(claims[p.Config.RoleClaim], value) {
+				return role
+			}
+		}
+	}
+	return config.ExternalRole
+}
+
+//Returns the subject of the claims, qualified by their issuer since subjects
+//are only unique per issuer. Returns "" if the claims have no subject.
+func oidcSubject(claims map[string]interface{}) string {
+	iss, _ := claims["iss"].(string)
+	sub, _ := claims["sub"].(string)
+	if iss == "" || sub == "" {
+		return ""
+	}
+	return iss + " " + sub
+}
+
+//Returns a random url safe string for state, nonce and PKCE values
+func randomString() string {
+	return base64.RawURLEncoding.EncodeToString(securecookie.GenerateRandomKey(32))
+}
+
+//Sends the user to the provider to log in.
+//Logged in users come here with "reauth" set to confirm a change on the settings page.
+func getOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if oidcProvider == nil {
+		notFound(w, r)
+		return
+	}
+
+	reauth := r.FormValue("reauth") != ""
+	state, nonce, verifier := randomString(), randomString(), randomString()
+	authURL, err := oidcProvider.AuthURL(state, nonce, verifier, reauth)
+	if err != nil {
+		Log("OIDC login failed: " + err.Error())
+		DisplayError(w, r, errors.New("Single sign on is not available right now"))
+		return
+	}
+
+	session, _ := store.Get(r, "userData")
+	session.Values["oidcState"] = state
+	session.Values["oidcNonce"] = nonce
+	session.Values["oidcVerifier"] = verifier
+	session.Values["oidcTime"] = time.Now().Unix()
+	session.Values["oidcReauth"] = reauth
+	session.Save(r, w)
+
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+//Handles the provider redirecting back after login.
+//Verifies the ID token and logs in the user its claims map to.
+func getOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if oidcProvider == nil {
+		notFound(w, r)
+		return
+	}
+
+	session, _ := store.Get(r, "userData")
+	state, _ := session.Values["oidcState"].(string)
+	nonce, _ := session.Values["oidcNonce"].(string)
+	verifier, _ := session.Values["oidcVerifier"].(string)
+	started, _ := session.Values["oidcTime"].(int64)
+	reauth, _ := session.Values["oidcReauth"].(bool)
+
+	//The values can only be used once
+	delete(session.Values, "oidcState")
+	delete(session.Values, "oidcNonce")
+	delete(session.Values, "oidcVerifier")
+	delete(session.Values, "oidcTime")
+	delete(session.Values, "oidcReauth")
+	session.Save(r, w)
+
+	fail := func(reason string) {
+		Log("OIDC login from " + clientIP(r) + " failed: " + reason)
+		Audit(r, AuditLoginFailed, "", "", "single sign on: "+reason)
+		w.WriteHeader(http.StatusUnauthorized)
+		DisplayError(w, r, errors.New("Single sign on failed. Please try logging in again."))
+	}
+
+	if e := r.FormValue("error"); e != "" {
+		fail("provider returned " + e + " " + r.FormValue("error_description"))
+		return
+	}
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(r.FormValue("state"))) != 1 {
+		fail("state does not match")
+		return
+	}
+	if time.Since(time.Unix(started, 0)) > oidcPending {
+		fail("login took too long")
+		return
+	}
+
+	idToken, err := oidcProvider.Exchange(r.FormValue("code"), verifier)
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+	claims, err := oidcProvider.Verify(idToken, nonce)
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+
+	username, _ := claims[oidcProvider.Config.UsernameClaim].(string)
+	if !validUsername.MatchString(username) {
+		fail(fmt.Sprintf("claim %s is not a valid username: %q", oidcProvider.Config.UsernameClaim, username))
+		return
+	}
+	displayName, _ := claims[oidcProvider.Config.DisplayNameClaim].(string)
+	subject := oidcSubject(claims)
+	if subject == "" {
+		fail("id token has no subject")
+		return
+	}
+
+	//Confirming a change on the settings page must be done by the logged in user,
+	//not by whichever provider account the browser is signed in to
+	current, _ := session.Values["username"].(string)
+	if reauth && current != "" {
+		if u, err := users.Get(current); err != nil || u.Subject == "" || u.Subject != subject {
+			fail(fmt.Sprintf("%s tried to confirm a change for %s", subject, current))
+			return
+		}
+	}
+
+	//The username claim can change, so accounts are found by subject
+	user, err := ProvisionUser(Identity{Username: username, DisplayName: displayName, Backend: oidcBackend, Subject: subject})
+	if err != nil {
+		fail(err.Error())
+		return
+	}
+	if reauth && current != "" && user.Username != current {
+		fail(user.Username + " tried to confirm a change for " + current)
+		return
+	}
+	username = user.Username
+
+	//The provider's role claim is authoritative, so role changes there apply on the next login
+	if role := oidcProvider.Role(claims); role != "" && role != user.Role {
+		users.Update(username, func(u *User) error {
+			u.Role = role
+			return nil
+		})
+		Log(username + " given the " + role + " role by OIDC claims")
+		Audit(r, AuditRoleChange, "", username, role+" from single sign on claims")
+	}
+
+	//Second factors are left to the provider
+	StartSession(w, r, username, false)
+	Audit(r, AuditLogin, username, username, "through single sign on")
+	if reauth {
+		http.Redirect(w, r, "/settings", http.StatusSeeOther)
+		return
+	}
+	http.Redirect(w, r, "/gallery", http.StatusSeeOther)
+}
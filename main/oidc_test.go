@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//OpenID Connect provider serving discovery, keys and tokens from a test server
+type mockOIDC struct {
+	server  *httptest.Server
+	key     *rsa.PrivateKey
+	idToken string //Returned by the token endpoint
+}
+
+func newMockOIDC(t *testing.T) *mockOIDC {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &mockOIDC{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcDiscovery{
+			Issuer:                m.server.URL,
+			AuthorizationEndpoint: m.server.URL + "/authorize",
+			TokenEndpoint:         m.server.URL + "/token",
+			JWKSURI:               m.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string][]jsonWebKey{"keys": {{
+			Kty: "RSA",
+			Kid: "k1",
+			Use: "sig",
+			N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("code") != "good code" || r.FormValue("code_verifier") == "" {
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": m.idToken})
+	})
+	m.server = httptest.NewServer(mux)
+	t.Cleanup(m.server.Close)
+	return m
+}
+
+//Returns a provider configured for the mock
+func (m *mockOIDC) provider() *OIDCProvider {
+	return &OIDCProvider{
+		Config: OIDCConfig{
+			Issuer:        m.server.URL,
+			ClientID:      "gallery",
+			RedirectURL:   "http://gallery.test/login/oidc/callback",
+			UsernameClaim: "preferred_username",
+		},
+		Client: m.server.Client(),
+	}
+}
+
+//Returns valid claims for the mock's tokens
+func (m *mockOIDC) claims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss":                m.server.URL,
+		"sub":                "1234",
+		"aud":                "gallery",
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"nonce":              "the nonce",
+		"preferred_username": "alice",
+	}
+}
+
+//Signs the claims into an ID token with the given key
+func signTestToken(t *testing.T, key *rsa.PrivateKey, alg string, claims map[string]interface{}) string {
+	t.Helper()
+	encode := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+
+	signed := encode(map[string]string{"alg": alg, "kid": "k1"}) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestOIDCExchangeAndVerify(t *testing.T) {
+	m := newMockOIDC(t)
+	p := m.provider()
+
+	m.idToken = signTestToken(t, m.key, "RS256", m.claims())
+	idToken, err := p.Exchange("good code", "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := p.Verify(idToken, "the nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["sub"] != "1234" {
+		t.Errorf("got claims %v", claims)
+	}
+	if _, err := p.Exchange("bad code", "verifier"); err == nil {
+		t.Error("a refused code was exchanged")
+	}
+}
+
+func TestOIDCVerifyRejects(t *testing.T) {
+	m := newMockOIDC(t)
+	p := m.provider()
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	with := func(name string, value interface{}) map[string]interface{} {
+		claims := m.claims()
+		claims[name] = value
+		return claims
+	}
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"other key", signTestToken(t, otherKey, "RS256", m.claims())},
+		{"wrong algorithm", signTestToken(t, m.key, "ES256", m.claims())},
+		{"wrong issuer", signTestToken(t, m.key, "RS256", with("iss", "https://evil.test"))},
+		{"wrong audience", signTestToken(t, m.key, "RS256", with("aud", "someone else"))},
+		{"audience list", signTestToken(t, m.key, "RS256", with("aud", []string{"someone else"}))},
+		{"expired", signTestToken(t, m.key, "RS256", with("exp", time.Now().Add(-time.Hour).Unix()))},
+		{"no expiry", signTestToken(t, m.key, "RS256", with("exp", nil))},
+		{"wrong nonce", signTestToken(t, m.key, "RS256", with("nonce", "another nonce"))},
+		{"no nonce", signTestToken(t, m.key, "RS256", with("nonce", nil))},
+		{"malformed", "not.a-token"},
+	}
+	for _, test := range tests {
+		if _, err := p.Verify(test.token, "the nonce"); err == nil {
+			t.Errorf("%s: token accepted", test.name)
+		}
+	}
+
+	//A tampered payload keeps the signature of the original
+	good := signTestToken(t, m.key, "RS256", m.claims())
+	evil := signTestToken(t, m.key, "RS256", with("sub", "admin"))
+	parts, evilParts := strings.Split(good, "."), strings.Split(evil, ".")
+	if _, err := p.Verify(parts[0]+"."+evilParts[1]+"."+parts[2], "the nonce"); err == nil {
+		t.Error("tampered token accepted")
+	}
+
+	//A login that lost its nonce is not matched by a token without one
+	if _, err := p.Verify(signTestToken(t, m.key, "RS256", with("nonce", nil)), ""); err == nil {
+		t.Error("token accepted without a nonce")
+	}
+}
+
+func TestOIDCRole(t *testing.T) {
+	p := &OIDCProvider{Config: OIDCConfig{
+		RoleClaim: "groups",
+		RoleMap:   map[string]string{"staff": RoleUploader, "admins": RoleAdmin},
+	}}
+
+	tests := []struct {
+		groups interface{}
+		role   string
+	}{
+		{[]interface{}{"staff", "admins"}, RoleAdmin},
+		{[]interface{}{"staff"}, RoleUploader},
+		{"admins", RoleAdmin},
+		{[]interface{}{"others"}, config.ExternalRole},
+		{nil, config.ExternalRole},
+	}
+	for _, test := range tests {
+		if role := p.Role(map[string]interface{}{"groups": test.groups}); role != test.role {
+			t.Errorf("groups %v: got role %q, want %q", test.groups, role, test.role)
+		}
+	}
+
+	p.Config.RoleClaim = ""
+	if role := p.Role(map[string]interface{}{"groups": "admins"}); role != "" {
+		t.Errorf("got role %q without a role claim", role)
+	}
+}
+
+func TestProvisionSubject(t *testing.T) {
+	testGallery(t)
+	testUsers(t)
+
+	alice := Identity{Username: "alice", Backend: oidcBackend, Subject: "https://idp.test 1"}
+	user, err := ProvisionUser(alice)
+	if err != nil || user.Username != "alice" {
+		t.Fatalf("got %+v, %v", user, err)
+	}
+
+	//Renamed at the provider, still the same account
+	alice.Username = "alice2"
+	if user, err := ProvisionUser(alice); err != nil || user.Username != "alice" {
+		t.Errorf("renamed user got %+v, %v", user, err)
+	}
+
+	//Another provider user taking alice's name does not get her account
+	mallory := Identity{Username: "alice", Backend: oidcBackend, Subject: "https://idp.test 2"}
+	if user, err := ProvisionUser(mallory); err == nil {
+		t.Errorf("another subject got the account %+v", user)
+	}
+	//Nor does the same subject from another issuer
+	mallory.Subject = "https://evil.test 1"
+	if user, err := ProvisionUser(mallory); err == nil {
+		t.Errorf("another issuer got the account %+v", user)
+	}
+
+	//Accounts made before subjects were stored are not taken over by name
+	if err := users.AddExternal(Identity{Username: "bob", Backend: oidcBackend}, RoleAdmin); err != nil {
+		t.Fatal(err)
+	}
+	if user, err := ProvisionUser(Identity{Username: "bob", Backend: oidcBackend, Subject: "https://idp.test 3"}); err == nil {
+		t.Errorf("an account without a subject was taken %+v", user)
+	}
+}
+
+func TestOIDCReauthOtherUser(t *testing.T) {
+	dir := testGallery(t)
+	testTemplates(t, dir, "error.html")
+	testUsers(t)
+	testSessions(t)
+	testAuditLog(t)
+
+	m := newMockOIDC(t)
+	oldProvider := oidcProvider
+	t.Cleanup(func() {
+		oidcProvider = oldProvider
+	})
+	oidcProvider = m.provider()
+
+	aliceClaims := m.claims()
+	if _, err := ProvisionUser(Identity{Username: "alice", Backend: oidcBackend, Subject: oidcSubject(aliceClaims)}); err != nil {
+		t.Fatal(err)
+	}
+	malloryClaims := m.claims()
+	malloryClaims["sub"] = "5678"
+	malloryClaims["preferred_username"] = "mallory"
+
+	loggedIn := time.Now().Add(-time.Hour).Unix()
+	callback := func(claims map[string]interface{}) (*httptest.ResponseRecorder, *http.Cookie) {
+		cookie := saveTestSession(t, store, map[interface{}]interface{}{
+			"username":     "alice",
+			"loginTime":    loggedIn,
+			"oidcState":    "the state",
+			"oidcNonce":    "the nonce",
+			"oidcVerifier": "the verifier",
+			"oidcTime":     time.Now().Unix(),
+			"oidcReauth":   true,
+		})
+		m.idToken = signTestToken(t, m.key, "RS256", claims)
+		r := httptest.NewRequest(http.MethodGet, "/login/oidc/callback?state=the+state&code=good+code", nil)
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		getOIDCCallback(w, r)
+		return w, cookie
+	}
+
+	//Another provider account cannot confirm alice's changes
+	w, cookie := callback(malloryClaims)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("reauth as another user got %d", w.Code)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/settings", nil)
+	r.AddCookie(cookie)
+	session, _ := store.Get(r, "userData")
+	if session.Values["username"] != "alice" || session.Values["loginTime"] != loggedIn {
+		t.Errorf("the session was changed to %v", session.Values)
+	}
+	if _, err := users.Get("mallory"); err != ErrUserNotFound {
+		t.Error("an account was made for the other user")
+	}
+
+	//The logged in user can
+	if w, _ := callback(aliceClaims); w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/settings" {
+		t.Errorf("reauth as alice got %d to %s", w.Code, w.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+const bytesPerMB = 1024 * 1024
+
+//Storage use shown on the profile page
+type QuotaInfo struct {
+	Used       string
+	Quota      string //"" if there is no per user quota
+	Percent    int
+	TotalUsed  string //Only filled in for admins
+	TotalQuota string
+}
+
+//Returns a number of bytes in megabytes, such as "2.5 MB"
+func formatMB(bytes int64) string {
+	return fmt.Sprintf("%.1f MB", float64(bytes)/bytesPerMB)
+}
+
+//Returns the bytes used by an image's files: the original, its thumbnail and resized
+//copies and its earlier versions. Images sharing another image's files use none.
+func (m ImageMeta) StorageUsed() int64 {
+	if m.Blob != "" {
+		return 0
+	}
+	used := m.Size + m.DerivedSize
+	for _, v := range m.Versions {
+		used += v.Size
+	}
+	return used
+}
+
+//Returns the bytes used by the images a user uploaded and by every image.
+//Images in the trash count until they are purged.
+func StorageUsage(username string) (int64, int64) {
+	var user, total int64
+	for _, m := range imageMeta.List() {
+		used := m.StorageUsed()
+		if username != "" && m.Owner == username {
+			user += used
+		}
+		total += used
+	}
+	return user, total
+}
+
+//Checks that size more bytes for the owner's images fit in the per user and total quotas
+func CheckQuota(owner string, size int64) error {
+	user, total := StorageUsage(owner)
+
+	if quota := int64(config.UserQuotaMB) * bytesPerMB; quota > 0 && owner != "" && user+size > quota {
+		return errors.New(fmt.Sprintf("Cannot upload: This file would go over your storage quota. You have used %s of %s", formatMB(user), formatMB(quota)))
+	}
+	if quota := int64(config.TotalQuotaMB) * bytesPerMB; quota > 0 && total+size > quota {
+		return errors.New(fmt.Sprintf("Cannot upload: The gallery is out of storage space. %s of %s is used", formatMB(total), formatMB(quota)))
+	}
+	return nil
+}
+
+//Held from checking that a staged upload fits in the quotas until it is recorded,
+//so two uploads cannot both take the space left for one
+var quotaMu sync.Mutex
+
+//Checks that a staged upload, with its thumbnail and resized copies, fits in the
+//quotas of its owner. An image of the owner it replaces frees its space.
+//Caller must hold quotaMu.
+func CheckStagedQuota(owner string, staged *StagedImage, replacing string) error {
+	size := staged.Meta.Size + staged.DerivedSize()
+	if old, found := imageMeta.Get(replacing); found && old.Owner == owner {
+		size -= old.StorageUsed()
+	}
+	return CheckQuota(owner, size)
+}
+
+//Returns the storage use of a user, and of the whole gallery for admins
+func QuotaInfoFor(username string, admin bool) QuotaInfo {
+	user, total := StorageUsage(username)
+	info := QuotaInfo{Used: formatMB(user)}
+
+	if quota := int64(config.UserQuotaMB) * bytesPerMB; quota > 0 {
+		info.Quota = formatMB(quota)
+		info.Percent = int(user * 100 / quota)
+	}
+	if admin {
+		info.TotalUsed = formatMB(total)
+		if quota := int64(config.TotalQuotaMB) * bytesPerMB; quota > 0 {
+			info.TotalQuota = formatMB(quota)
+		}
+	}
+	return info
+}
+
+//Records the bytes used by the thumbnail and resized copies of an image
+func recordDerivedSize(imageName string) {
+	names := []string{StorageName(ThumbnailsFolder, FormatName(imageName, "thumb"))}
+	for _, size := range imageSizes {
+		names = append(names, StorageName(ResizedFolder, FormatName(imageName, fmt.Sprintf("%v", size))))
+	}
+
+	var used int64
+	for _, name := range names {
+		if info, err := storage.Stat(name); err == nil {
+			used += info.Size
+		}
+	}
+
+	imageMeta.Update(imageName, func(m *ImageMeta) {
+		m.DerivedSize = used
+	})
+}
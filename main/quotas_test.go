@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCheckQuota(t *testing.T) {
+	testGallery(t)
+	config.UserQuotaMB = 2
+	config.TotalQuotaMB = 3
+
+	if err := imageMeta.Add(ImageMeta{Filename: "a.png", Owner: "alice", Size: bytesPerMB, DerivedSize: bytesPerMB / 2}); err != nil {
+		t.Fatal(err)
+	}
+	//Links share another image's files, so they use none
+	if err := imageMeta.Add(ImageMeta{Filename: "b.png", Owner: "alice", Blob: "a.png", Size: bytesPerMB}); err != nil {
+		t.Fatal(err)
+	}
+	if err := imageMeta.Add(ImageMeta{Filename: "c.png", Owner: "bob", Size: bytesPerMB / 2, Versions: []ImageVersion{{Size: bytesPerMB / 2}}}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		owner string
+		size  int64
+		ok    bool
+	}{
+		{"alice", bytesPerMB / 2, true},
+		{"alice", bytesPerMB/2 + 1, false}, //Over alice's quota
+		{"bob", bytesPerMB / 2, true},
+		{"bob", bytesPerMB/2 + 1, false}, //Over the total quota
+		{"", bytesPerMB / 2, true},       //Images without an owner only have the total quota
+		{"", bytesPerMB/2 + 1, false},
+	}
+	for _, test := range tests {
+		if err := CheckQuota(test.owner, test.size); (err == nil) != test.ok {
+			t.Errorf("%s adding %d bytes: got %v, want ok %v", test.owner, test.size, err, test.ok)
+		}
+	}
+
+	config.UserQuotaMB, config.TotalQuotaMB = 0, 0
+	if err := CheckQuota("alice", 100*bytesPerMB); err != nil {
+		t.Errorf("no quotas: got %v", err)
+	}
+}
+
+func TestCheckStagedQuota(t *testing.T) {
+	testGallery(t)
+
+	staged, err := StageImage(bytes.NewReader(testPNG(t, 1)), ".png", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer staged.Discard()
+	derived := staged.DerivedSize()
+	if derived <= 0 {
+		t.Fatal("the staged thumbnail and resized copies have no size")
+	}
+
+	//Leave room for the original but not for its thumbnail and resized copies
+	config.UserQuotaMB = 1
+	used := bytesPerMB - staged.Meta.Size - derived/2
+	if err := imageMeta.Add(ImageMeta{Filename: "a.png", Owner: "alice", Size: used}); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckQuota("alice", staged.Meta.Size); err != nil {
+		t.Fatalf("the original alone does not fit: %v", err)
+	}
+	if err := CheckStagedQuota("alice", staged, ""); err == nil {
+		t.Error("the thumbnail and resized copies were not counted")
+	}
+
+	//Replacing one of the owner's images frees its space, replacing someone else's does not
+	if err := CheckStagedQuota("alice", staged, "a.png"); err != nil {
+		t.Errorf("replacing the owner's image: got %v", err)
+	}
+	if err := imageMeta.Add(ImageMeta{Filename: "b.png", Owner: "bob", Size: bytesPerMB}); err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckStagedQuota("alice", staged, "b.png"); err == nil {
+		t.Error("replacing someone else's image freed the uploader's space")
+	}
+}
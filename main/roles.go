@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+//User roles, from most to least privileged
+const (
+	RoleAdmin    = "admin"    //Can do everything, including managing users
+	RoleUploader = "uploader" //Can upload and delete images
+	RoleViewer   = "viewer"   //Can only view the gallery
+)
+
+//Role given to accounts created from the registration page
+const registerRole = RoleViewer
+
+var roles = []string{RoleAdmin, RoleUploader, RoleViewer}
+
+//Returns true if the user has any of the given roles
+func (u User) HasRole(allowed ...string) bool {
+	for _, role := range allowed {
+		if u.Role == role {
+			return true
+		}
+	}
+	return false
+}
+
+//Returns the logged in user from the request's API token or the userData session.
+//Returns false if nobody is logged in or the account no longer exists.
+func CurrentUser(r *http.Request) (User, bool) {
+	//Requests sending a token are never authenticated by cookie
+	if token, ok := RequestToken(r); ok {
+		user, err := users.Get(token.Username)
+		return user, err == nil
+	} else if bearerToken(r) != "" {
+		return User{}, false
+	}
+
+	session, _ := store.Get(r, "userData")
+
+	if IsNil(session.Values["username"]) {
+		return User{}, false
+	}
+
+	user, err := users.Get(session.Values["username"].(string))
+	if err != nil {
+		return User{}, false
+	}
+	return user, true
+}
+
+//Router middleware only letting users with one of the given roles through.
+//Every other request, including ones from visitors who are not logged in, gets a 403 page.
+func RequireRole(allowed ...string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			user, ok := CurrentUser(r)
+
+			if !ok || !user.HasRole(allowed...) {
+				forbidden(w, r)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+//403 forbidden handler
+func forbidden(w http.ResponseWriter, r *http.Request) {
+	tmpl := template.Must(template.ParseFiles("assets/403.html", "assets/Templates.html"))
+
+	var data UserData
+	data.GetLoginData(r)
+
+	w.WriteHeader(http.StatusForbidden)
+	DisplayError(w, r, tmpl.Execute(w, data))
+}
+
+type AdminUsersData struct {
+	LoggedIn  bool
+	Username  string
+	CSRFToken string
+	Users     []User
+	Roles     []string
+	Message   string
+	Error     string
+}
+
+//Checks cookie data to see is user is logged in.
+func (data *AdminUsersData) GetLoginData(r *http.Request) {
+	session, _ := store.Get(r, "userData")
+	data.CSRFToken = CSRFToken(r)
+
+	if IsNil(session.Values["username"]) { //If cookie not found or user logged out
+		data.LoggedIn = false
+	} else {
+		data.Username = session.Values["username"].(string)
+		data.LoggedIn = true
+	}
+}
+
+//Generates the user management page and applies the admin action from its forms
+func getAdminUsers(w http.ResponseWriter, r *http.Request) {
+	tmpl := template.Must(template.ParseFiles("assets/admin_users.html", "assets/Templates.html"))
+	data := AdminUsersData{
+		Roles: roles,
+	}
+	data.GetLoginData(r)
+
+	if r.Method == http.MethodPost {
+		username := r.FormValue("username")
+
+		switch r.FormValue("action") {
+		case "role":
+			err := setRole(data.Username, username, r.FormValue("role"))
+			if err != nil {
+				data.Error = err.Error()
+			} else {
+				data.Message = username + " is now " + r.FormValue("role")
+				Audit(r, AuditRoleChange, data.Username, username, r.FormValue("role"))
+			}
+
+		case "sessions":
+			count, err := store.RevokeUser(username)
+			if err != nil {
+				data.Error = err.Error()
+			} else {
+				Log(data.Username + " logged " + username + " out everywhere")
+				Audit(r, AuditSessionRevoke, data.Username, username, "all sessions")
+				data.Message = fmt.Sprintf("Ended %v sessions of %s", count, username)
+			}
+
+		default:
+			data.Error = "Unknown action"
+		}
+	}
+
+	data.Users = users.List()
+	DisplayError(w, r, tmpl.Execute(w, data))
+}
+
+//Changes the role of a user on behalf of an admin
+func setRole(admin string, username string, role string) error {
+	valid := false
+	for _, r := range roles {
+		if r == role {
+			valid = true
+		}
+	}
+	if !valid {
+		return errors.New("Unknown role: " + role)
+	}
+
+	//Prevent the gallery from being left without an admin
+	if admin == username && role != RoleAdmin {
+		return errors.New("You cannot remove your own admin role")
+	}
+
+	err := users.Update(username, func(u *User) error {
+		u.Role = role
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	Log(admin + " set the role of " + username + " to " + role)
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import "testing"
+
+func TestHasRole(t *testing.T) {
+	tests := []struct {
+		role    string
+		allowed []string
+		has     bool
+	}{
+		{RoleAdmin, []string{RoleAdmin}, true},
+		{RoleUploader, []string{RoleAdmin, RoleUploader}, true},
+		{RoleViewer, []string{RoleAdmin, RoleUploader}, false},
+		{"", []string{RoleAdmin, RoleUploader, RoleViewer}, false},
+		{RoleAdmin, nil, false},
+	}
+	for _, test := range tests {
+		if has := (User{Role: test.role}).HasRole(test.allowed...); has != test.has {
+			t.Errorf("%q in %v: got %v, want %v", test.role, test.allowed, has, test.has)
+		}
+	}
+}
+
+func TestSetRole(t *testing.T) {
+	testUsers(t)
+	for username, role := range map[string]string{"root": RoleAdmin, "alice": RoleViewer} {
+		if err := users.Add(username, "some password", role); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		username string
+		role     string
+		ok       bool
+		want     string //Role the user has afterwards
+	}{
+		{"alice", RoleUploader, true, RoleUploader},
+		{"alice", "superuser", false, RoleUploader},
+		{"alice", "", false, RoleUploader},
+		{"root", RoleViewer, false, RoleAdmin}, //An admin cannot demote themselves
+		{"root", RoleAdmin, true, RoleAdmin},
+		{"nobody", RoleViewer, false, ""},
+	}
+	for _, test := range tests {
+		if err := setRole("root", test.username, test.role); (err == nil) != test.ok {
+			t.Errorf("%s to %q: got %v", test.username, test.role, err)
+		}
+		if u, _ := users.Get(test.username); u.Role != test.want {
+			t.Errorf("%s to %q: role is %q, want %q", test.username, test.role, u.Role, test.want)
+		}
+	}
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Settings of an S3 compatible object store, such as AWS S3 or MinIO
+type S3Config struct {
+	Endpoint  string `json:"endpoint"` //Such as "https://s3.eu-west-1.amazonaws.com" or "http://localhost:9000"
+	Region    string `json:"region"`
+	Bucket    string `json:"bucket"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+	Prefix    string `json:"prefix"` //Put in front of every object key, such as "gallery/"
+	//Address buckets as endpoint/bucket instead of bucket.endpoint.
+	//Most self hosted servers need this.
+	PathStyle bool `json:"path_style"`
+}
+
+//Storage in an S3 compatible bucket, signing requests with AWS signature version 4
+type S3Storage struct {
+	config   S3Config
+	endpoint *url.URL
+	client   *http.Client
+}
+
+//Creates S3 storage from its settings
+func NewS3Storage(cfg S3Config) (*S3Storage, error) {
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, errors.New("s3 storage needs an endpoint and a bucket")
+	}
+	if cfg.AccessKey == "" || cfg.SecretKey == "" {
+		return nil, errors.New("s3 storage needs an access key and a secret key")
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+
+	endpoint, err := url.Parse(cfg.Endpoint)
+	if err != nil || endpoint.Host == "" || (endpoint.Scheme != "http" && endpoint.Scheme != "https") {
+		return nil, fmt.Errorf("invalid s3 endpoint %q", cfg.Endpoint)
+	}
+
+	return &S3Storage{
+		config:   cfg,
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 60 * time.Second},
+	}, nil
+}
+
+//Error document returned by S3 for failed requests
+type s3Error struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+//Result of a ListObjectsV2 request
+type s3ListResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		Size         int64     `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+//Escapes a string the way signature version 4 expects,
+//leaving only unreserved characters, and slashes if encodeSlash is false
+func s3Escape(s string, encodeSlash bool) string {
+	var buf strings.Builder
+	for _, b := range []byte(s) {
+		switch {
+		case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9',
+			b == '-', b == '_', b == '.', b == '~':
+			buf.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			buf.WriteByte(b)
+		default:
+			fmt.Fprintf(&buf, "%%%02X", b)
+		}
+	}
+	return buf.String()
+}
+
+//Returns the query string with sorted, escaped keys and values
+func s3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+//Adds an AWS signature version 4 Authorization header to the request.
+//The host and every header already set on the request are signed, so
+//x-amz-date and x-amz-content-sha256 must be set before calling this.
+func signS3Request(req *http.Request, payloadHash string, accessKey string, secretKey string, region string, t time.Time) {
+	amzDate := t.UTC().Format("20060102T150405Z")
+	date := t.UTC().Format("20060102")
+	scope := date + "/" + region + "/s3/aws4_request"
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		trimmed := make([]string, len(values))
+		for i, v := range values {
+			trimmed[i] = strings.Join(strings.Fields(v), " ")
+		}
+		headers[strings.ToLower(name)] = strings.Join(trimmed, ",")
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		sha256Hex([]byte(canonicalRequest)),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+//Returns the URL of an object, or of the bucket if key is ""
+func (s *S3Storage) objectURL(key string, query url.Values) *url.URL {
+	u := *s.endpoint
+	base := strings.TrimSuffix(u.Path, "/")
+
+	var p string
+	if s.config.PathStyle {
+		p = base + "/" + s.config.Bucket
+		if key != "" {
+			p += "/" + key
+		}
+	} else {
+		u.Host = s.config.Bucket + "." + u.Host
+		p = base + "/" + key
+	}
+
+	u.Path = p
+	u.RawPath = s3Escape(p, false)
+	u.RawQuery = s3Query(query)
+	return &u
+}
+
+//Sends a signed request for an object
+func (s *S3Storage) do(method string, key string, query url.Values, body []byte, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.objectURL(key, query).String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+
+	now := time.Now()
+	payloadHash := sha256Hex(body)
+	req.Header.Set("x-amz-date", now.UTC().Format("20060102T150405Z"))
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	signS3Request(req, payloadHash, s.config.AccessKey, s.config.SecretKey, s.config.Region, now)
+
+	return s.client.Do(req)
+}
+
+//Reads the error from a failed response and closes it
+func s3ResponseError(method string, name string, resp *http.Response) error {
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%s: %w", name, os.ErrNotExist)
+	}
+
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	var e s3Error
+	if xml.Unmarshal(data, &e) == nil && e.Code != "" {
+		return fmt.Errorf("s3 %s %s: %s: %s", method, name, e.Code, e.Message)
+	}
+	return fmt.Errorf("s3 %s %s: %s", method, name, resp.Status)
+}
+
+func (s *S3Storage) Put(name string, data io.Reader) error {
+	if err := checkStorageName(name); err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(data)
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	if contentType := mime.TypeByExtension(path.Ext(name)); contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+
+	resp, err := s.do(http.MethodPut, s.config.Prefix+name, nil, body, header)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return s3ResponseError(http.MethodPut, name, resp)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3Storage) Get(name string) (io.ReadCloser, error) {
+	if err := checkStorageName(name); err != nil {
+		return nil, err
+	}
+
+	resp, err := s.do(http.MethodGet, s.config.Prefix+name, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, s3ResponseError(http.MethodGet, name, resp)
+	}
+	return resp.Body, nil
+}
+
+func (s *S3Storage) Delete(name string) error {
+	if err := checkStorageName(name); err != nil {
+		return err
+	}
+
+	resp, err := s.do(http.MethodDelete, s.config.Prefix+name, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		err := s3ResponseError(http.MethodDelete, name, resp)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3Storage) List(folder string) ([]FileInfo, error) {
+	if err := checkStorageName(folder); err != nil {
+		return nil, err
+	}
+	prefix := s.config.Prefix + folder + "/"
+
+	var infos []FileInfo
+	token := ""
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {prefix},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := s.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return nil, s3ResponseError(http.MethodGet, folder, resp)
+		}
+
+		var result s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3 list %s: %v", folder, err)
+		}
+
+		for _, obj := range result.Contents {
+			name := strings.TrimPrefix(obj.Key, prefix)
+			//Skip objects in deeper folders
+			if name == "" || strings.Contains(name, "/") {
+				continue
+			}
+			infos = append(infos, FileInfo{Name: name, Size: obj.Size, ModTime: obj.LastModified})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		token = result.NextContinuationToken
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos, nil
+}
+
+//Copies the object on the server and deletes the old one, since S3 cannot rename objects
+func (s *S3Storage) Move(from string, to string) error {
+	if err := checkStorageName(from); err != nil {
+		return err
+	}
+	if err := checkStorageName(to); err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	header.Set("x-amz-copy-source", "/"+s.config.Bucket+"/"+s3Escape(s.config.Prefix+from, false))
+	resp, err := s.do(http.MethodPut, s.config.Prefix+to, nil, nil, header)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return s3ResponseError(http.MethodPut, to, resp)
+	}
+
+	//A copy can fail after the server has answered 200, in which case the body is an error
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	var e s3Error
+	if xml.Unmarshal(data, &e) == nil && e.Code != "" {
+		return fmt.Errorf("s3 copy %s: %s: %s", from, e.Code, e.Message)
+	}
+
+	return s.Delete(from)
+}
+
+func (s *S3Storage) Stat(name string) (FileInfo, error) {
+	if err := checkStorageName(name); err != nil {
+		return FileInfo{}, err
+	}
+
+	resp, err := s.do(http.MethodHead, s.config.Prefix+name, nil, nil, nil)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return FileInfo{}, s3ResponseError(http.MethodHead, name, resp)
+	}
+	resp.Body.Close()
+
+	size, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return FileInfo{Name: path.Base(name), Size: size, ModTime: modTime}, nil
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+const sessionsPath = "./data/sessions.gob"
+
+//How long a timed out session keeps its "expired" marker without being used,
+//so the login page can still say the session expired
+const expiredNoticeTime = time.Hour
+
+//Server side record of a session.
+//The cookie only holds the signed session ID.
+type SessionRecord struct {
+	ID        string
+	Values    map[interface{}]interface{}
+	Created   time.Time
+	LastSeen  time.Time
+	IP        string
+	UserAgent string
+}
+
+//Returns the username stored in the session, or "" if nobody is logged in
+func (rec *SessionRecord) Username() string {
+	username, _ := rec.Values["username"].(string)
+	return username
+}
+
+//Returns a non secret identifier for the session that is safe to put in pages
+func (rec *SessionRecord) Handle() string {
+	sum := sha256.Sum256([]byte(rec.ID))
+	return hex.EncodeToString(sum[:8])
+}
+
+//Summary of a session shown on the settings page
+type SessionInfo struct {
+	Handle    string
+	Created   string
+	LastSeen  string
+	IP        string
+	UserAgent string
+	Current   bool
+}
+
+//Session store keeping session values on the server, persisted to a gob file.
+//Sessions can be listed per user and revoked, which removes them for every
+//browser using them. Implements sessions.Store.
+type ServerStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+
+	//Timeouts for logged in sessions, 0 for no limit. Sessions marked
+	//"remember" only end RememberTimeout after logging in.
+	IdleTimeout     time.Duration
+	AbsoluteTimeout time.Duration
+	RememberTimeout time.Duration
+
+	mu      sync.Mutex
+	path    string
+	records map[string]*SessionRecord
+}
+
+//Creates a server store, loading any sessions saved at the given path
+func NewServerStore(path string, keyPairs ...[]byte) (*ServerStore, error) {
+	s := &ServerStore{
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+		path:    path,
+		records: make(map[string]*SessionRecord),
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if err := gob.NewDecoder(file).Decode(&s.records); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+//Sets the maximum age of sessions and of the cookies holding their IDs
+func (s *ServerStore) MaxAge(age int) {
+	s.Options.MaxAge = age
+
+	for _, codec := range s.Codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(age)
+		}
+	}
+}
+
+//Sets the timeouts for logged in sessions.
+//Cookies are made to stay valid for as long as remembered sessions last.
+func (s *ServerStore) SetTimeouts(idle time.Duration, absolute time.Duration, remember time.Duration) {
+	s.IdleTimeout = idle
+	s.AbsoluteTimeout = absolute
+	s.RememberTimeout = remember
+
+	if remember > time.Duration(s.Options.MaxAge)*time.Second {
+		for _, codec := range s.Codecs {
+			if sc, ok := codec.(*securecookie.SecureCookie); ok {
+				sc.MaxAge(int(remember.Seconds()))
+			}
+		}
+	}
+}
+
+//Returns a session for the given name after adding it to the registry
+func (s *ServerStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+//Returns a session for the given name without adding it to the registry.
+//Sessions missing from the store, because they expired or were revoked, come back empty.
+//This is where the session timeouts are enforced, since every page checks the login
+//through here. Logged in sessions that timed out are logged out and keep "expired"
+//set until the login page shows it, whichever page the timeout was found on.
+func (s *ServerStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	var id string
+	if err := securecookie.DecodeMulti(name, c.Value, &id, s.Codecs...); err != nil {
+		return session, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rec, ok := s.records[id]
+	if !ok {
+		return session, nil
+	}
+	if s.timedOut(rec) {
+		s.markExpired(rec)
+	}
+	if s.expired(rec) {
+		return session, nil
+	}
+
+	if rec.Values["remember"] == true {
+		session.Options.MaxAge = int(s.RememberTimeout.Seconds())
+	}
+	rec.LastSeen = time.Now()
+	rec.IP = clientIP(r)
+	rec.UserAgent = r.UserAgent()
+
+	session.ID = id
+	session.IsNew = false
+	for k, v := range rec.Values {
+		session.Values[k] = v
+	}
+	return session, nil
+}
+
+//Stores the session values and sets the cookie holding its ID.
+//A MaxAge below zero deletes the session.
+func (s *ServerStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if session.Options.MaxAge < 0 {
+		delete(s.records, session.ID)
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return s.persist()
+	}
+
+	rec, ok := s.records[session.ID]
+	if session.ID == "" || !ok {
+		session.ID = strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+		rec = &SessionRecord{
+			ID:      session.ID,
+			Created: time.Now(),
+		}
+		s.records[session.ID] = rec
+	}
+
+	rec.Values = make(map[interface{}]interface{}, len(session.Values))
+	for k, v := range session.Values {
+		rec.Values[k] = v
+	}
+	rec.LastSeen = time.Now()
+	rec.IP = clientIP(r)
+	rec.UserAgent = r.UserAgent()
+
+	if err := s.persist(); err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+//Gives the session a new ID, keeping its values.
+//Used when logging in so an ID planted before login cannot be reused.
+func (s *ServerStore) Regenerate(session *sessions.Session) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.records, session.ID)
+	session.ID = ""
+}
+
+//Returns the sessions of a user, most recently used first
+func (s *ServerStore) UserSessions(username string, current string) []SessionInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var list []*SessionRecord
+	for _, rec := range s.records {
+		if rec.Username() == username && !s.expired(rec) {
+			list = append(list, rec)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].LastSeen.After(list[j].LastSeen)
+	})
+
+	infos := make([]SessionInfo, len(list))
+	for i, rec := range list {
+		infos[i] = SessionInfo{
+			Handle:    rec.Handle(),
+			Created:   rec.Created.Format("2006-01-02 15:04:05"),
+			LastSeen:  rec.LastSeen.Format("2006-01-02 15:04:05"),
+			IP:        rec.IP,
+			UserAgent: rec.UserAgent,
+			Current:   rec.ID == current,
+		}
+	}
+	return infos
+}
+
+//Removes the session of the user with the given handle.
+//Returns false if the user has no such session.
+func (s *ServerStore) Revoke(username string, handle string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, rec := range s.records {
+		if rec.Username() == username && rec.Handle() == handle {
+			delete(s.records, id)
+			return true, s.persist()
+		}
+	}
+	return false, nil
+}
+
+//Removes every session of the user, logging them out everywhere.
+//Returns the number of sessions removed.
+func (s *ServerStore) RevokeUser(username string) (int, error) {
+	return s.RevokeOthers(username, "")
+}
+
+//Removes every session of the user except the one with the given ID,
+//so a user changing their password stays logged in only where they did it.
+//Returns the number of sessions removed.
+func (s *ServerStore) RevokeOthers(username string, keep string) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	count := 0
+	for id, rec := range s.records {
+		if rec.Username() == username && id != keep {
+			delete(s.records, id)
+			count++
+		}
+	}
+	return count, s.persist()
+}
+
+//Logs a timed out session out, leaving only the "expired" marker in it.
+//Caller must hold the lock.
+func (s *ServerStore) markExpired(rec *SessionRecord) {
+	rec.Values = map[interface{}]interface{}{"expired": true}
+	rec.LastSeen = time.Now()
+}
+
+//Returns true if the session has not been used within MaxAge, has timed out,
+//or has kept its "expired" marker unused for expiredNoticeTime.
+//Caller must hold the lock.
+func (s *ServerStore) expired(rec *SessionRecord) bool {
+	if rec.Values["expired"] == true && time.Since(rec.LastSeen) > expiredNoticeTime {
+		return true
+	}
+	maxAge := time.Duration(s.Options.MaxAge) * time.Second
+	if rec.Values["remember"] == true && s.RememberTimeout > maxAge {
+		maxAge = s.RememberTimeout
+	}
+	if s.Options.MaxAge > 0 && time.Since(rec.LastSeen) > maxAge {
+		return true
+	}
+	return s.timedOut(rec)
+}
+
+//Returns true if a logged in session has passed its idle or absolute timeout.
+//Caller must hold the lock.
+func (s *ServerStore) timedOut(rec *SessionRecord) bool {
+	if rec.Username() == "" {
+		return false
+	}
+
+	idle, absolute := s.IdleTimeout, s.AbsoluteTimeout
+	if rec.Values["remember"] == true {
+		idle, absolute = 0, s.RememberTimeout
+	}
+
+	//Sessions get a new record when logging in, so Created is the login time
+	now := time.Now()
+	return (idle > 0 && now.Sub(rec.LastSeen) > idle) ||
+		(absolute > 0 && now.Sub(rec.Created) > absolute)
+}
+
+//Drops expired sessions and writes the rest to disk.
+//Sessions that timed out are kept with the "expired" marker instead.
+//Caller must hold the lock.
+func (s *ServerStore) persist() error {
+	for id, rec := range s.records {
+		if s.timedOut(rec) {
+			s.markExpired(rec)
+		} else if s.expired(rec) {
+			delete(s.records, id)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(file).Encode(s.records); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+//Reverse proxies whose client IP header is trusted, parsed from config.TrustedProxies in LoadConfig
+var trustedProxies []*net.IPNet
+
+//Parses a list of IP addresses and CIDR ranges
+func parseTrustedProxies(list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range list {
+		entry = strings.TrimSpace(entry)
+		if strings.Contains(entry, "/") {
+			_, n, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("trusted proxy %q: %v", entry, err)
+			}
+			nets = append(nets, n)
+			continue
+		}
+
+		ip := net.ParseIP(entry)
+		if ip == nil {
+			return nil, fmt.Errorf("trusted proxy %q is not an IP address or range", entry)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+	}
+	return nets, nil
+}
+
+//Returns true if the address belongs to a trusted proxy
+func isTrustedProxy(ip net.IP) bool {
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//Returns the IP address the request came from.
+//Requests from a trusted proxy are read from its client IP header. The header is
+//walked from the right past any further trusted proxies, since each proxy appends
+//the address it got the request from and the client can write anything before that.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if ip := net.ParseIP(host); ip == nil || !isTrustedProxy(ip) {
+		return host
+	}
+
+	var hops []string
+	for _, value := range r.Header.Values(config.ClientIPHeader) {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		host = ip.String()
+		if !isTrustedProxy(ip) {
+			break
+		}
+	}
+	return host
+}
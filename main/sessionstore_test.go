@@ -0,0 +1,218 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+//Points the global session store at an empty store in a temporary folder.
+//Returns the path the store saves to.
+func testSessions(t *testing.T) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "sessions.gob")
+
+	oldStore := store
+	var err error
+	store, err = NewServerStore(path, []byte("test session hash key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		store = oldStore
+	})
+	return path
+}
+
+//Saves a new session holding the values and returns its cookie
+func saveTestSession(t *testing.T, s *ServerStore, values map[interface{}]interface{}) *http.Cookie {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	session, err := s.New(r, "userData")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range values {
+		session.Values[k] = v
+	}
+	w := httptest.NewRecorder()
+	if err := s.Save(r, w, session); err != nil {
+		t.Fatal(err)
+	}
+	return w.Result().Cookies()[0]
+}
+
+//Returns the username of the session the cookie belongs to, or "" if it has none
+func testSessionUser(t *testing.T, s *ServerStore, cookie *http.Cookie) string {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(cookie)
+	session, err := s.New(r, "userData")
+	if err != nil {
+		t.Fatal(err)
+	}
+	username, _ := session.Values["username"].(string)
+	return username
+}
+
+func TestServerStoreRevoke(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.gob")
+	key := []byte("test session hash key")
+	s, err := NewServerStore(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alice1 := saveTestSession(t, s, map[interface{}]interface{}{"username": "alice"})
+	alice2 := saveTestSession(t, s, map[interface{}]interface{}{"username": "alice"})
+	alice3 := saveTestSession(t, s, map[interface{}]interface{}{"username": "alice"})
+	bob := saveTestSession(t, s, map[interface{}]interface{}{"username": "bob"})
+
+	//Sessions are kept on disk, the cookie holds only the ID
+	s, err = NewServerStore(path, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if username := testSessionUser(t, s, alice1); username != "alice" {
+		t.Fatalf("reloaded session belongs to %q", username)
+	}
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: "userData", Value: alice1.Value[:len(alice1.Value)-4] + "AAAA"})
+	if session, err := s.New(r, "userData"); err == nil || session.Values["username"] != nil {
+		t.Errorf("a forged cookie got the session %v", session.Values)
+	}
+
+	infos := s.UserSessions("alice", "")
+	if len(infos) != 3 {
+		t.Fatalf("alice has %d sessions, want 3", len(infos))
+	}
+	if revoked, err := s.Revoke("bob", infos[0].Handle); err != nil || revoked {
+		t.Errorf("bob revoked alice's session: %v, %v", revoked, err)
+	}
+	if revoked, err := s.Revoke("alice", infos[0].Handle); err != nil || !revoked {
+		t.Fatalf("revoking got %v, %v", revoked, err)
+	}
+	if len(s.UserSessions("alice", "")) != 2 {
+		t.Error("the revoked session is still listed")
+	}
+
+	//Logging out everywhere ends the rest of alice's sessions only
+	if count, err := s.RevokeUser("alice"); err != nil || count != 2 {
+		t.Errorf("revoked %d sessions, %v, want 2", count, err)
+	}
+	for _, cookie := range []*http.Cookie{alice1, alice2, alice3} {
+		if username := testSessionUser(t, s, cookie); username != "" {
+			t.Errorf("a revoked session still belongs to %q", username)
+		}
+	}
+	if username := testSessionUser(t, s, bob); username != "bob" {
+		t.Errorf("bob's session belongs to %q after revoking alice's", username)
+	}
+}
+
+//Ages the session the cookie belongs to
+func ageTestSession(t *testing.T, s *ServerStore, cookie *http.Cookie, idle time.Duration, age time.Duration) {
+	t.Helper()
+	var id string
+	if err := securecookie.DecodeMulti("userData", cookie.Value, &id, s.Codecs...); err != nil {
+		t.Fatal(err)
+	}
+	s.records[id].LastSeen = time.Now().Add(-idle)
+	s.records[id].Created = time.Now().Add(-age)
+}
+
+func TestServerStoreTimeouts(t *testing.T) {
+	s, err := NewServerStore(filepath.Join(t.TempDir(), "sessions.gob"), []byte("test session hash key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetTimeouts(30*time.Minute, 12*time.Hour, 30*24*time.Hour)
+
+	tests := []struct {
+		name     string
+		values   map[interface{}]interface{}
+		idle     time.Duration //Time since the session was last used
+		age      time.Duration //Time since logging in
+		username string        //User the session still belongs to, "" if it ended
+	}{
+		{"active", map[interface{}]interface{}{"username": "alice"}, time.Minute, time.Hour, "alice"},
+		{"idle", map[interface{}]interface{}{"username": "alice"}, time.Hour, time.Hour, ""},
+		{"too old", map[interface{}]interface{}{"username": "alice"}, time.Minute, 13 * time.Hour, ""},
+		{"remembered and idle", map[interface{}]interface{}{"username": "alice", "remember": true}, 2 * 24 * time.Hour, 3 * 24 * time.Hour, "alice"},
+		{"remembered too long", map[interface{}]interface{}{"username": "alice", "remember": true}, time.Minute, 31 * 24 * time.Hour, ""},
+		{"anonymous and idle", map[interface{}]interface{}{"csrf": "token"}, time.Hour, 13 * time.Hour, ""},
+	}
+	for _, test := range tests {
+		cookie := saveTestSession(t, s, test.values)
+		ageTestSession(t, s, cookie, test.idle, test.age)
+		if username := testSessionUser(t, s, cookie); username != test.username {
+			t.Errorf("%s: session belongs to %q, want %q", test.name, username, test.username)
+		}
+	}
+}
+
+func TestSessionExpiredNotice(t *testing.T) {
+	dir := testGallery(t)
+	testTemplates(t, dir, "log_in.html", "403.html")
+	testUsers(t)
+	testSessions(t)
+	store.SetTimeouts(30*time.Minute, 12*time.Hour, 30*24*time.Hour)
+	if err := users.Add("alice", "some password", RoleUploader); err != nil {
+		t.Fatal(err)
+	}
+
+	//Returns the login page shown to the cookie's visitor
+	loginPage := func(cookie *http.Cookie) string {
+		r := httptest.NewRequest(http.MethodGet, "/login", nil)
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		getLogin(w, r)
+		return w.Body.String()
+	}
+	//Visits a page for logged in users, which finds the timeout first
+	otherPage := func(cookie *http.Cookie) int {
+		r := httptest.NewRequest(http.MethodGet, "/upload", nil)
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		RequireRole(RoleUploader)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).ServeHTTP(w, r)
+		return w.Code
+	}
+	const notice = "Your session has expired"
+
+	cookie := saveTestSession(t, store, map[interface{}]interface{}{"username": "alice"})
+	if code := otherPage(cookie); code != http.StatusOK {
+		t.Fatalf("logged in page got %d", code)
+	}
+	ageTestSession(t, store, cookie, time.Hour, time.Hour)
+	if code := otherPage(cookie); code != http.StatusForbidden {
+		t.Errorf("page after the timeout got %d", code)
+	}
+	if page := loginPage(cookie); !strings.Contains(page, notice) {
+		t.Error("the login page after the timeout does not say the session expired")
+	}
+	if page := loginPage(cookie); strings.Contains(page, notice) {
+		t.Error("the notice was shown twice")
+	}
+
+	//Timed out sessions dropped while saving another session keep the notice too
+	cookie = saveTestSession(t, store, map[interface{}]interface{}{"username": "alice"})
+	ageTestSession(t, store, cookie, time.Minute, 13*time.Hour)
+	saveTestSession(t, store, map[interface{}]interface{}{"username": "bob"})
+	if page := loginPage(cookie); !strings.Contains(page, notice) {
+		t.Error("the login page does not say a session ended while saving expired")
+	}
+
+	//The notice is not kept forever
+	cookie = saveTestSession(t, store, map[interface{}]interface{}{"username": "alice"})
+	ageTestSession(t, store, cookie, time.Hour, time.Hour)
+	otherPage(cookie)
+	ageTestSession(t, store, cookie, expiredNoticeTime+time.Minute, 2*time.Hour)
+	if page := loginPage(cookie); strings.Contains(page, notice) {
+		t.Error("the notice was shown long after the timeout")
+	}
+}
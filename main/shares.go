@@ -0,0 +1,500 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/securecookie"
+)
+
+const sharesPath = "./data/shares.json"
+
+//Longest a share link can last, in hours
+const maxShareHours = 24 * 30
+
+//How long after opening a share page its files load without counting more views
+const shareViewTime = 10 * time.Minute
+
+var (
+	ErrShareNotFound = errors.New("This share link is invalid or has been revoked")
+	ErrShareExpired  = errors.New("This share link has expired")
+	ErrShareUsedUp   = errors.New("This share link has reached its view limit")
+)
+
+//A link that lets anyone holding it view one image, without logging in,
+//until it expires or has been viewed MaxViews times
+type ShareLink struct {
+	ID       string
+	Filename string
+	Owner    string //User who created the link
+	Created  time.Time
+	Expires  time.Time
+	MaxViews int //0 for no limit
+	Views    int
+}
+
+//Returns true once the link has run out of views
+func (l ShareLink) UsedUp() bool {
+	return l.MaxViews > 0 && l.Views >= l.MaxViews
+}
+
+//File backed collection of share links, saved the same way as the user store.
+//Links are signed with keys derived from the session hash keys, so a link
+//cannot be changed to last longer or to point at another image.
+type ShareStore struct {
+	mu    sync.Mutex
+	path  string
+	keys  [][]byte //The first key signs new links, the others are still accepted
+	links map[string]*ShareLink
+}
+
+//Global share link store, loaded in main
+var shares *ShareStore
+
+//Loads the share link store from the given json file.
+//A missing file is treated as an empty store.
+func LoadShareStore(path string, keys [][]byte) (*ShareStore, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys for share links")
+	}
+	s := &ShareStore{
+		path:  path,
+		keys:  keys,
+		links: make(map[string]*ShareLink),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var list []*ShareLink
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("reading %s: %v", path, err)
+	}
+	for _, l := range list {
+		s.links[l.ID] = l
+	}
+
+	return s, nil
+}
+
+//Returns the keys used to sign share links, one for each session key pair.
+//They are derived from the hash keys so a key never signs both cookies and links.
+func ShareKeys() ([][]byte, error) {
+	pairs, err := SessionKeyPairs()
+	if err != nil {
+		return nil, err
+	}
+
+	var keys [][]byte
+	for i := 0; i < len(pairs); i += 2 {
+		keys = append(keys, shareKey(pairs[i]))
+	}
+	return keys, nil
+}
+
+//Derives the share link key from a session hash key
+func shareKey(hashKey []byte) []byte {
+	mac := hmac.New(sha256.New, hashKey)
+	mac.Write([]byte("share-link"))
+	return mac.Sum(nil)
+}
+
+//Writes the store to disk, dropping expired links. Caller must hold the lock.
+func (s *ShareStore) save() error {
+	now := time.Now()
+	list := make([]*ShareLink, 0, len(s.links))
+	for id, l := range s.links {
+		if now.After(l.Expires) {
+			delete(s.links, id)
+			continue
+		}
+		list = append(list, l)
+	}
+
+	data, err := json.MarshalIndent(list, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+//Returns the signature of a link made with the given key
+func signShare(key []byte, l ShareLink) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s|%s|%d|%d", l.ID, l.Filename, l.Expires.Unix(), l.MaxViews)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+//Returns the token used in the link's URL.
+//Tokens look like "<ID>.<expiry>.<signature>".
+func (s *ShareStore) Token(l ShareLink) string {
+	return l.ID + "." + strconv.FormatInt(l.Expires.Unix(), 10) + "." + signShare(s.keys[0], l)
+}
+
+//Creates a link to the image lasting the given time.
+//maxViews is 0 for no view limit.
+func (s *ShareStore) Create(filename string, owner string, duration time.Duration, maxViews int) (ShareLink, error) {
+	if duration <= 0 || duration > maxShareHours*time.Hour {
+		return ShareLink{}, fmt.Errorf("Share links can last at most %d days", maxShareHours/24)
+	}
+	if maxViews < 0 {
+		return ShareLink{}, errors.New("The view limit cannot be negative")
+	}
+
+	idBytes := securecookie.GenerateRandomKey(12)
+	if idBytes == nil {
+		return ShareLink{}, errors.New("could not generate share link")
+	}
+
+	now := time.Now()
+	l := &ShareLink{
+		ID:       hex.EncodeToString(idBytes),
+		Filename: filename,
+		Owner:    owner,
+		Created:  now,
+		Expires:  now.Add(duration),
+		MaxViews: maxViews,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.links[l.ID] = l
+	if err := s.save(); err != nil {
+		return ShareLink{}, err
+	}
+	return *l, nil
+}
+
+//Returns a share link by ID
+func (s *ShareStore) Get(id string) (ShareLink, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, ok := s.links[id]
+	if !ok {
+		return ShareLink{}, false
+	}
+	return *l, true
+}
+
+//Returns the links to an image that can still be used, newest first
+func (s *ShareStore) List(filename string) []ShareLink {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var list []ShareLink
+	for _, l := range s.links {
+		if l.Filename == filename && now.Before(l.Expires) && !l.UsedUp() {
+			list = append(list, *l)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.After(list[j].Created)
+	})
+	return list
+}
+
+//Deletes a share link
+func (s *ShareStore) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.links[id]; !ok {
+		return ErrShareNotFound
+	}
+	delete(s.links, id)
+	return s.save()
+}
+
+//Deletes every link to a deleted image
+func (s *ShareStore) DeleteImage(filename string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, l := range s.links {
+		if l.Filename == filename {
+			delete(s.links, id)
+		}
+	}
+	return s.save()
+}
+
+//Checks a share token and returns its link.
+//If view is true the view is counted, failing once the link is used up.
+func (s *ShareStore) Open(token string, view bool) (ShareLink, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ShareLink{}, ErrShareNotFound
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	l, ok := s.links[parts[0]]
+	if !ok || parts[1] != strconv.FormatInt(l.Expires.Unix(), 10) {
+		return ShareLink{}, ErrShareNotFound
+	}
+
+	valid := false
+	for _, key := range s.keys {
+		if hmac.Equal([]byte(parts[2]), []byte(signShare(key, *l))) {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return ShareLink{}, ErrShareNotFound
+	}
+
+	if time.Now().After(l.Expires) {
+		return ShareLink{}, ErrShareExpired
+	}
+
+	//Links to images in the trash stop working until the image is restored
+	if meta, _ := imageMeta.Get(l.Filename); meta.InTrash() {
+		return ShareLink{}, ErrShareNotFound
+	}
+
+	if view {
+		if l.UsedUp() {
+			return ShareLink{}, ErrShareUsedUp
+		}
+		l.Views++
+		if err := s.save(); err != nil {
+			return ShareLink{}, err
+		}
+	}
+	return *l, nil
+}
+
+//Returns the full URL of a share link
+func shareURL(r *http.Request, l ShareLink) string {
+	scheme := "http"
+	if r.TLS != nil || config.CookieSecure {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + "/share/" + shares.Token(l)
+}
+
+//Session value holding when the visitor last opened a share link,
+//so the image files on its page do not count as more views
+func shareSessionKey(id string) string {
+	return "share:" + id
+}
+
+//A share link as shown on the image page
+type ShareInfo struct {
+	ID      string
+	URL     string
+	Expires string
+	Views   string
+}
+
+//Returns the active links to an image for the image page
+func ShareInfos(r *http.Request, filename string) []ShareInfo {
+	var infos []ShareInfo
+	for _, l := range shares.List(filename) {
+		views := strconv.Itoa(l.Views)
+		if l.MaxViews > 0 {
+			views += " of " + strconv.Itoa(l.MaxViews)
+		}
+		infos = append(infos, ShareInfo{
+			ID:      l.ID,
+			URL:     shareURL(r, l),
+			Expires: l.Expires.Format("2006-01-02 15:04"),
+			Views:   views,
+		})
+	}
+	return infos
+}
+
+type SharePageData struct {
+	LoggedIn  bool
+	Username  string
+	CSRFToken string
+	Found     bool
+	Error     string
+	Name      string
+	SrcName   string
+	ExtName   string
+	Token     string
+	Expires   string
+}
+
+//Checks cookie data to see is user is logged in.
+func (data *SharePageData) GetLoginData(r *http.Request) {
+	session, _ := store.Get(r, "userData")
+	data.CSRFToken = CSRFToken(r)
+
+	if IsNil(session.Values["username"]) { //If cookie not found or user logged out
+		data.LoggedIn = false
+	} else {
+		data.LoggedIn = true
+		data.Username = session.Values["username"].(string)
+	}
+}
+
+//Shows a shared image to anyone holding the link, counting a view
+func getShare(w http.ResponseWriter, r *http.Request) {
+	tmpl := template.Must(template.ParseFiles("assets/share.html", "assets/Templates.html"))
+	var data SharePageData
+	data.GetLoginData(r)
+
+	token := mux.Vars(r)["token"]
+	l, err := shares.Open(token, true)
+	if err != nil {
+		data.Error = err.Error()
+		w.WriteHeader(http.StatusNotFound)
+		DisplayError(w, r, tmpl.Execute(w, data))
+		return
+	}
+
+	//Remember the view so the picture's files load without counting again
+	session, _ := store.Get(r, "userData")
+	session.Values[shareSessionKey(l.ID)] = time.Now().Unix()
+	session.Save(r, w)
+
+	name := strings.TrimSuffix(l.Filename, filepath.Ext(l.Filename))
+	data.Found = true
+	meta, _ := imageMeta.Get(l.Filename)
+	data.Name = meta.DisplayName()
+	data.SrcName = strings.Replace(name, " ", "%20", -1)
+	data.ExtName = l.Filename
+	data.Token = token
+	data.Expires = l.Expires.Format("January 2, 2006 15:04")
+
+	DisplayError(w, r, tmpl.Execute(w, data))
+}
+
+//Serves the shared image, its thumbnail or its resized versions.
+//Visitors who have not opened the share page in the last shareViewTime use up a view,
+//so the link's expiry and view limit are checked on every file.
+func shareFileHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	folder := vars["folder"]
+	file := vars["file"]
+
+	session, _ := store.Get(r, "userData")
+	id := strings.SplitN(vars["token"], ".", 2)[0]
+	viewed := false
+	if opened, ok := session.Values[shareSessionKey(id)].(int64); ok {
+		viewed = time.Since(time.Unix(opened, 0)) < shareViewTime
+	}
+
+	l, err := shares.Open(vars["token"], !viewed)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	original := file
+	if folder != "images" {
+		original, _ = DerivativeSource(file)
+	}
+	if original != l.Filename {
+		http.NotFound(w, r)
+		return
+	}
+
+	ServeStorageFile(w, r, StorageName(folder, ContentFile(file, original)))
+}
+
+//Creates a share link for an image.
+//Only the uploader of the image or an admin may share it.
+func shareCreateHandler(w http.ResponseWriter, r *http.Request) {
+	fileName := mux.Vars(r)["file"]
+
+	meta, _ := imageMeta.Get(fileName)
+	if !ownsImage(r, meta) {
+		forbidden(w, r)
+		return
+	}
+
+	name := strings.TrimSuffix(fileName, filepath.Ext(fileName))
+	if found, ok := FindImage(name); !ok || found != fileName {
+		notFound(w, r)
+		return
+	}
+
+	hours, err := strconv.Atoi(r.FormValue("hours"))
+	if err != nil {
+		DisplayError(w, r, errors.New("Invalid link duration"))
+		return
+	}
+	maxViews := 0
+	if v := strings.TrimSpace(r.FormValue("maxViews")); v != "" {
+		if maxViews, err = strconv.Atoi(v); err != nil {
+			DisplayError(w, r, errors.New("Invalid view limit"))
+			return
+		}
+	}
+
+	user, _ := CurrentUser(r)
+	if _, err := shares.Create(fileName, user.Username, time.Duration(hours)*time.Hour, maxViews); err != nil {
+		DisplayError(w, r, err)
+		return
+	}
+
+	Log(fileName + " shared by " + user.Username)
+	Audit(r, AuditShareCreate, user.Username, fileName, "")
+	http.Redirect(w, r, "/image/"+url.PathEscape(name), http.StatusSeeOther)
+}
+
+//Revokes a share link.
+//Only the uploader of the image or an admin may revoke it.
+func shareRevokeHandler(w http.ResponseWriter, r *http.Request) {
+	l, ok := shares.Get(mux.Vars(r)["id"])
+	if !ok {
+		notFound(w, r)
+		return
+	}
+
+	meta, _ := imageMeta.Get(l.Filename)
+	if !ownsImage(r, meta) {
+		forbidden(w, r)
+		return
+	}
+
+	if err := shares.Revoke(l.ID); err != nil {
+		DisplayError(w, r, err)
+		return
+	}
+
+	user, _ := CurrentUser(r)
+	Log("Share link for " + l.Filename + " revoked by " + user.Username)
+	Audit(r, AuditShareRevoke, user.Username, l.Filename, "link "+l.ID)
+	name := strings.TrimSuffix(l.Filename, filepath.Ext(l.Filename))
+	http.Redirect(w, r, "/image/"+url.PathEscape(name), http.StatusSeeOther)
+}
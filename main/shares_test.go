@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestShareKeys(t *testing.T) {
+	testGallery(t)
+	hashKey := bytes.Repeat([]byte{7}, 32)
+	config.SessionKeys = []string{base64.StdEncoding.EncodeToString(hashKey)}
+
+	keys, err := ShareKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("got %d keys, want 1", len(keys))
+	}
+	if bytes.Equal(keys[0], hashKey) {
+		t.Error("share links are signed with the session hash key")
+	}
+	if !bytes.Equal(keys[0], shareKey(hashKey)) {
+		t.Error("share key is not derived from the session hash key")
+	}
+}
+
+func TestShareOpen(t *testing.T) {
+	testGallery(t)
+
+	l, err := shares.Create("arch.png", "alice", time.Hour, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := shares.Token(l)
+
+	other, err := LoadShareStore(shares.path, [][]byte{[]byte("another key")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	longer := l
+	longer.Expires = l.Expires.Add(time.Hour)
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"other key", other.Token(l)},
+		{"changed expiry", shares.Token(longer)},
+		{"changed signature", token + "x"},
+		{"unknown link", "0000." + token[len(l.ID)+1:]},
+		{"malformed", l.ID},
+	}
+	for _, test := range tests {
+		if _, err := shares.Open(test.token, false); err != ErrShareNotFound {
+			t.Errorf("%s: got %v, want %v", test.name, err, ErrShareNotFound)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := shares.Open(token, true); err != nil {
+			t.Fatalf("view %d: %v", i+1, err)
+		}
+	}
+	if _, err := shares.Open(token, true); err != ErrShareUsedUp {
+		t.Errorf("view past the limit got %v, want %v", err, ErrShareUsedUp)
+	}
+
+	shares.links[l.ID].Expires = time.Now().Add(-time.Minute)
+	if _, err := shares.Open(shares.Token(*shares.links[l.ID]), false); err != ErrShareExpired {
+		t.Errorf("expired link got %v, want %v", err, ErrShareExpired)
+	}
+}
+
+func TestShareFileHandler(t *testing.T) {
+	testGallery(t)
+	testSessions(t)
+
+	putTestFile(t, StorageName(ImagesFolder, "arch.png"), testPNG(t, 1))
+	if err := imageMeta.Add(ImageMeta{Filename: "arch.png", Owner: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	l, err := shares.Create("arch.png", "alice", time.Hour, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := shares.Token(l)
+
+	//Returns a session cookie recording the share page was opened at the given time
+	openedAt := func(opened time.Time) *http.Cookie {
+		r := httptest.NewRequest(http.MethodGet, "/share/"+token, nil)
+		w := httptest.NewRecorder()
+		session, _ := store.Get(r, "userData")
+		session.Values[shareSessionKey(l.ID)] = opened.Unix()
+		if err := session.Save(r, w); err != nil {
+			t.Fatal(err)
+		}
+		return w.Result().Cookies()[0]
+	}
+	fetch := func(cookie *http.Cookie) int {
+		r := httptest.NewRequest(http.MethodGet, "/share/"+token+"/images/arch.png", nil)
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		r = mux.SetURLVars(r, map[string]string{"token": token, "folder": "images", "file": "arch.png"})
+		w := httptest.NewRecorder()
+		shareFileHandler(w, r)
+		return w.Code
+	}
+
+	//The page's own view, counted when it was opened
+	if _, err := shares.Open(token, true); err != nil {
+		t.Fatal(err)
+	}
+	recent := openedAt(time.Now())
+	if code := fetch(recent); code != http.StatusOK {
+		t.Errorf("file of a page just opened got %d", code)
+	}
+
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+	}{
+		{"no session", nil},
+		{"page opened long ago", openedAt(time.Now().Add(-shareViewTime - time.Minute))},
+	}
+	for _, test := range tests {
+		if code := fetch(test.cookie); code != http.StatusNotFound {
+			t.Errorf("%s: got %d from a used up link", test.name, code)
+		}
+	}
+
+	shares.links[l.ID].Expires = time.Now().Add(-time.Minute)
+	if code := fetch(recent); code != http.StatusNotFound {
+		t.Errorf("file of an expired link got %d", code)
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/disintegration/imaging"
+)
+
+//Folders image files are kept in
+const (
+	ImagesFolder     = "images"     //Uploaded originals
+	ThumbnailsFolder = "thumbnails" //200px high thumbnails for the gallery
+	ResizedFolder    = "resized"    //Smaller copies for the image page
+	VersionsFolder   = "versions"   //Earlier versions of replaced images
+	StagingFolder    = "staging"    //Uploads being checked before they are moved into place
+)
+
+//Details of a stored file
+type FileInfo struct {
+	Name    string //Name inside its folder, such as "Arch.jpg"
+	Size    int64
+	ModTime time.Time
+}
+
+//Where image files are kept. Files are named "<folder>/<file>", such as "images/Arch.jpg".
+//Get and Stat return an error matching os.ErrNotExist for missing files.
+type Storage interface {
+	Put(name string, data io.Reader) error
+	Get(name string) (io.ReadCloser, error)
+	Delete(name string) error
+	List(folder string) ([]FileInfo, error) //Files in the folder sorted by name
+	Stat(name string) (FileInfo, error)
+	Move(from string, to string) error //Renames a file, replacing any file already called to
+}
+
+//Storage settings from config.json
+type StorageConfig struct {
+	Type      string   `json:"type"`       //"local" or "s3"
+	LocalPath string   `json:"local_path"` //Folder holding the images, thumbnails and resized folders
+	S3        S3Config `json:"s3"`
+}
+
+//Global storage, set up in main
+var storage Storage
+
+//Creates the global storage from the config
+func SetupStorage() error {
+	switch config.Storage.Type {
+	case "", "local":
+		storage = &LocalStorage{Root: config.Storage.LocalPath}
+	case "s3":
+		s3, err := NewS3Storage(config.Storage.S3)
+		if err != nil {
+			return err
+		}
+		storage = s3
+	default:
+		return fmt.Errorf("unknown storage type %q", config.Storage.Type)
+	}
+	return nil
+}
+
+//Joins a folder and file name into a storage name
+func StorageName(folder string, file string) string {
+	return folder + "/" + file
+}
+
+//Checks a storage name is a file inside one of the folders,
+//so names from requests cannot reach other files
+func checkStorageName(name string) error {
+	if name == "" || strings.HasPrefix(name, "/") || strings.Contains(name, "\\") || path.Clean(name) != name {
+		return fmt.Errorf("invalid file name %q", name)
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." || part == "." {
+			return fmt.Errorf("invalid file name %q", name)
+		}
+	}
+	return nil
+}
+
+//Storage in a folder on this server
+type LocalStorage struct {
+	Root string
+}
+
+//Returns the path of a stored file on disk
+func (s *LocalStorage) path(name string) (string, error) {
+	if err := checkStorageName(name); err != nil {
+		return "", err
+	}
+	return filepath.Join(s.Root, filepath.FromSlash(name)), nil
+}
+
+//Writes the file to a temporary file first, so readers never see half a file
+func (s *LocalStorage) Put(name string, data io.Reader) error {
+	p, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	os.Chmod(tmp.Name(), 0644)
+	return os.Rename(tmp.Name(), p)
+}
+
+func (s *LocalStorage) Get(name string) (io.ReadCloser, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(p)
+}
+
+func (s *LocalStorage) Delete(name string) error {
+	p, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(p)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *LocalStorage) List(folder string) ([]FileInfo, error) {
+	p, err := s.path(folder)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := ioutil.ReadDir(p)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var infos []FileInfo
+	for _, f := range files {
+		//Skip folders and files still being written
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		infos = append(infos, FileInfo{Name: f.Name(), Size: f.Size(), ModTime: f.ModTime()})
+	}
+	return infos, nil
+}
+
+//Renames the file on disk, so readers see either the old file or the new one
+func (s *LocalStorage) Move(from string, to string) error {
+	src, err := s.path(from)
+	if err != nil {
+		return err
+	}
+	dst, err := s.path(to)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+	return os.Rename(src, dst)
+}
+
+func (s *LocalStorage) Stat(name string) (FileInfo, error) {
+	p, err := s.path(name)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	info, err := os.Stat(p)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	if info.IsDir() {
+		return FileInfo{}, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+	}
+	return FileInfo{Name: path.Base(name), Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+//Returns true if the stored file exists
+func StorageExists(name string) bool {
+	_, err := storage.Stat(name)
+	return err == nil
+}
+
+//Decodes a stored image
+func LoadImage(name string) (image.Image, error) {
+	file, err := storage.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return imaging.Decode(file)
+}
+
+//Stores an image as a jpeg
+func SaveImage(name string, img image.Image) error {
+	var buf bytes.Buffer
+	if err := imaging.Encode(&buf, img, imaging.JPEG); err != nil {
+		return err
+	}
+	return storage.Put(name, &buf)
+}
+
+//Sends a stored file, supporting range and conditional requests
+func ServeStorageFile(w http.ResponseWriter, r *http.Request, name string) {
+	info, err := storage.Stat(name)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			Log("could not read " + name + ": " + err.Error())
+		}
+		http.NotFound(w, r)
+		return
+	}
+
+	file, err := storage.Get(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+
+	//Local files can be sent as they are, others are read into memory first
+	//since images are at most maxUploadSize
+	content, ok := file.(io.ReadSeeker)
+	if !ok {
+		data, err := ioutil.ReadAll(file)
+		if err != nil {
+			http.Error(w, "could not read file", http.StatusInternalServerError)
+			return
+		}
+		content = bytes.NewReader(data)
+	}
+	http.ServeContent(w, r, info.Name, info.ModTime, content)
+}
+
+//Serves the files of one storage folder, like http.FileServer does for a folder on disk.
+//Must be wrapped in http.StripPrefix so the request path is the file name.
+func StorageFileServer(folder string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file := strings.TrimPrefix(r.URL.Path, "/")
+		if file == "" || strings.Contains(file, "/") {
+			http.NotFound(w, r)
+			return
+		}
+		ServeStorageFile(w, r, StorageName(folder, file))
+	})
+}
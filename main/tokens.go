@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/securecookie"
+)
+
+const tokensPath = "./data/tokens.json"
+
+//How often the last use of a token is written to disk.
+//The settings page only shows it to the minute.
+const tokenLastUsedInterval = time.Minute
+
+//Token scopes
+const (
+	ScopeRead   = "read"   //Download images
+	ScopeUpload = "upload" //Upload images
+	ScopeDelete = "delete" //Delete images
+)
+
+var scopes = []string{ScopeRead, ScopeUpload, ScopeDelete}
+
+//Routes that accept API tokens and the scope each needs.
+//Token requests to any other route are refused.
+var tokenScopes = map[string]string{
+	"/uploaded":        ScopeUpload,
+	"/delete/{file}":   ScopeDelete,
+	"/download/{file}": ScopeRead,
+}
+
+var ErrBadToken = errors.New("invalid API token")
+
+//A personal API token. Only a hash of the secret part is stored.
+//Tokens look like "gal_<ID>_<secret>".
+type APIToken struct {
+	ID       string
+	Username string
+	Name     string
+	Hash     string
+	Scopes   []string
+	Created  time.Time
+	LastUsed time.Time
+}
+
+//Returns true if the token was given the scope
+func (t APIToken) HasScope(scope string) bool {
+	for _, s := range t.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+//File backed collection of API tokens, saved the same way as the user store
+type TokenStore struct {
+	mu     sync.Mutex
+	path   string
+	tokens map[string]*APIToken
+}
+
+//Global token store, loaded in main
+var tokens *TokenStore
+
+//Loads the token store from the given json file.
+//A missing file is treated as an empty store.
+func LoadTokenStore(path string) (*TokenStore, error) {
+	s := &TokenStore{
+		path:   path,
+		tokens: make(map[string]*APIToken),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var list []*APIToken
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("reading %s: %v", path, err)
+	}
+	for _, t := range list {
+		s.tokens[t.ID] = t
+	}
+
+	return s, nil
+}
+
+//Writes the store to disk. Caller must hold the lock.
+func (s *TokenStore) save() error {
+	list := make([]*APIToken, 0, len(s.tokens))
+	for _, t := range s.tokens {
+		list = append(list, t)
+	}
+
+	data, err := json.MarshalIndent(list, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+//Returns the hex sha256 of a token secret
+func hashToken(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+//Creates a token for the user with the given scopes.
+//Returns the full token, which is the only time it can be seen.
+func (s *TokenStore) Create(username string, name string, tokenScopes []string) (string, error) {
+	if len(tokenScopes) == 0 {
+		return "", errors.New("Tokens need at least one scope")
+	}
+	for _, scope := range tokenScopes {
+		valid := false
+		for _, known := range scopes {
+			valid = valid || scope == known
+		}
+		if !valid {
+			return "", errors.New("Unknown scope: " + scope)
+		}
+	}
+
+	idBytes := securecookie.GenerateRandomKey(6)
+	secretBytes := securecookie.GenerateRandomKey(32)
+	if idBytes == nil || secretBytes == nil {
+		return "", errors.New("could not generate token")
+	}
+	id := hex.EncodeToString(idBytes)
+	secret := base64.RawURLEncoding.EncodeToString(secretBytes)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.tokens[id] = &APIToken{
+		ID:       id,
+		Username: username,
+		Name:     name,
+		Hash:     hashToken(secret),
+		Scopes:   tokenScopes,
+		Created:  time.Now(),
+	}
+	if err := s.save(); err != nil {
+		return "", err
+	}
+
+	return "gal_" + id + "_" + secret, nil
+}
+
+//Returns the user's tokens, newest first
+func (s *TokenStore) List(username string) []APIToken {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var list []APIToken
+	for _, t := range s.tokens {
+		if t.Username == username {
+			list = append(list, *t)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.After(list[j].Created)
+	})
+	return list
+}
+
+//Deletes one of the user's tokens
+func (s *TokenStore) Revoke(username string, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tokens[id]
+	if !ok || t.Username != username {
+		return errors.New("That token does not exist")
+	}
+	delete(s.tokens, id)
+	return s.save()
+}
+
+//Deletes every token of the user
+func (s *TokenStore) RevokeUser(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, t := range s.tokens {
+		if t.Username == username {
+			delete(s.tokens, id)
+		}
+	}
+	return s.save()
+}
+
+//Looks up a full token and records its use
+func (s *TokenStore) Authenticate(token string) (APIToken, error) {
+	parts := strings.SplitN(token, "_", 3)
+	if len(parts) != 3 || parts[0] != "gal" {
+		return APIToken{}, ErrBadToken
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.tokens[parts[1]]
+	if !ok || subtle.ConstantTimeCompare([]byte(t.Hash), []byte(hashToken(parts[2]))) != 1 {
+		return APIToken{}, ErrBadToken
+	}
+
+	//Saving on every request would make all API traffic wait on the file
+	if time.Since(t.LastUsed) >= tokenLastUsedInterval {
+		t.LastUsed = time.Now()
+		if err := s.save(); err != nil {
+			Log("could not save token last use: " + err.Error())
+		}
+	}
+	return *t, nil
+}
+
+type contextKey string
+
+const tokenContextKey = contextKey("apiToken")
+
+//Returns the bearer token sent with the request, or "" if there is none
+func bearerToken(r *http.Request) string {
+	header := r.Header.Get("Authorization")
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+//Returns the API token the request was authenticated with, if any
+func RequestToken(r *http.Request) (APIToken, bool) {
+	t, ok := r.Context().Value(tokenContextKey).(APIToken)
+	return t, ok
+}
+
+//Router middleware authenticating requests that send an API token as a Bearer header.
+//The token must have the scope tokenScopes lists for the matched route.
+//Requests without a token are passed through for cookie authentication.
+func TokenMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		secret := bearerToken(r)
+		if secret == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		token, err := tokens.Authenticate(secret)
+		if err != nil {
+			Log("rejected API token from " + clientIP(r))
+			Audit(r, AuditTokenRejected, "", r.URL.Path, err.Error())
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		var template string
+		if route := mux.CurrentRoute(r); route != nil {
+			template, _ = route.GetPathTemplate()
+		}
+		scope, ok := tokenScopes[template]
+		if !ok || !token.HasScope(scope) {
+			Audit(r, AuditTokenRejected, token.Username, r.URL.Path, "token "+token.ID+" lacks the scope")
+			http.Error(w, "API token not allowed for this request", http.StatusForbidden)
+			return
+		}
+
+		Log(fmt.Sprintf("API token %s of %s used for %s %s", token.ID, token.Username, r.Method, r.URL.Path))
+		Audit(r, AuditTokenUse, token.Username, r.URL.Path, "token "+token.ID+" for "+r.Method)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenContextKey, token)))
+	})
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//Points the global token store at an empty store in a temporary folder
+func testTokens(t *testing.T) {
+	t.Helper()
+	oldTokens := tokens
+	var err error
+	tokens, err = LoadTokenStore(filepath.Join(t.TempDir(), "tokens.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		tokens = oldTokens
+	})
+}
+
+func TestTokenStore(t *testing.T) {
+	testTokens(t)
+
+	for _, tokenScopes := range [][]string{nil, {"admin"}, {ScopeRead, "everything"}} {
+		if _, err := tokens.Create("alice", "bad", tokenScopes); err == nil {
+			t.Errorf("created a token with scopes %v", tokenScopes)
+		}
+	}
+
+	token, err := tokens.Create("alice", "script", []string{ScopeUpload})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := tokens.Create("bob", "script", []string{ScopeRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, "_")
+	otherParts := strings.Split(other, "_")
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid", token, true},
+		{"wrong secret", token[:len(token)-1], false},
+		{"another token's secret", "gal_" + parts[1] + "_" + otherParts[2], false},
+		{"unknown ID", "gal_000000000000_" + parts[2], false},
+		{"wrong prefix", "api_" + parts[1] + "_" + parts[2], false},
+		{"no secret", "gal_" + parts[1], false},
+		{"empty", "", false},
+	}
+	for _, test := range tests {
+		if got, err := tokens.Authenticate(test.token); (err == nil) != test.ok {
+			t.Errorf("%s: got %v", test.name, err)
+		} else if test.ok && (got.Username != "alice" || !got.HasScope(ScopeUpload) || got.HasScope(ScopeDelete)) {
+			t.Errorf("%s: got token %+v", test.name, got)
+		}
+	}
+
+	if err := tokens.Revoke("bob", parts[1]); err == nil {
+		t.Error("bob revoked alice's token")
+	}
+	if err := tokens.Revoke("alice", parts[1]); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tokens.Authenticate(token); err != ErrBadToken {
+		t.Errorf("revoked token got %v", err)
+	}
+}
+
+func TestTokenLastUsed(t *testing.T) {
+	testTokens(t)
+
+	token, err := tokens.Create("alice", "script", []string{ScopeRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := strings.Split(token, "_")[1]
+	saved := func() time.Time {
+		t.Helper()
+		s, err := LoadTokenStore(tokens.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.tokens[id].LastUsed
+	}
+
+	if _, err := tokens.Authenticate(token); err != nil {
+		t.Fatal(err)
+	}
+	first := saved()
+	if first.IsZero() {
+		t.Fatal("the first use was not saved")
+	}
+
+	//Uses within the interval are not written again
+	time.Sleep(10 * time.Millisecond)
+	if _, err := tokens.Authenticate(token); err != nil {
+		t.Fatal(err)
+	}
+	if !saved().Equal(first) {
+		t.Error("a use right after the last one was saved")
+	}
+
+	tokens.tokens[id].LastUsed = time.Now().Add(-tokenLastUsedInterval)
+	if _, err := tokens.Authenticate(token); err != nil {
+		t.Fatal(err)
+	}
+	if !saved().After(first) {
+		t.Error("a use after the interval was not saved")
+	}
+}
+
+func TestTokenMiddleware(t *testing.T) {
+	testGallery(t)
+	testTokens(t)
+	testAuditLog(t)
+
+	upload, err := tokens.Create("alice", "uploads", []string{ScopeUpload})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var user string
+	r := mux.NewRouter()
+	r.Use(TokenMiddleware)
+	for _, path := range []string{"/uploaded", "/download/{file}", "/gallery"} {
+		r.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			token, _ := RequestToken(r)
+			user = token.Username
+		})
+	}
+
+	tests := []struct {
+		name   string
+		path   string
+		auth   string
+		status int
+		user   string
+	}{
+		{"scoped route", "/uploaded", "Bearer " + upload, http.StatusOK, "alice"},
+		{"lower case scheme", "/uploaded", "bearer " + upload, http.StatusOK, "alice"},
+		{"route needing another scope", "/download/arch.png", "Bearer " + upload, http.StatusForbidden, ""},
+		{"route without tokens", "/gallery", "Bearer " + upload, http.StatusForbidden, ""},
+		{"bad token", "/uploaded", "Bearer gal_00_00", http.StatusUnauthorized, ""},
+		{"no token", "/gallery", "", http.StatusOK, ""},
+	}
+	for _, test := range tests {
+		user = ""
+		req := httptest.NewRequest(http.MethodPost, test.path, nil)
+		if test.auth != "" {
+			req.Header.Set("Authorization", test.auth)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != test.status || user != test.user {
+			t.Errorf("%s: got %d as %q, want %d as %q", test.name, w.Code, user, test.status, test.user)
+		}
+	}
+}
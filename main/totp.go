@@ -0,0 +1,231 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+	"github.com/skip2/go-qrcode"
+)
+
+//TOTP settings from RFC 6238, matching what authenticator apps expect
+const (
+	totpIssuer  = "GoImageGallery"
+	totpPeriod  = 30 //Seconds each code is valid for
+	totpDigits  = 6
+	totpSkew    = 1 //Codes from this many periods before or after now are accepted
+	totpPending = 5 * time.Minute
+
+	recoveryCodeCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+//Generates a new random base32 TOTP secret
+func NewTOTPSecret() (string, error) {
+	key := securecookie.GenerateRandomKey(20)
+	if key == nil {
+		return "", errors.New("could not generate TOTP secret")
+	}
+	return totpEncoding.EncodeToString(key), nil
+}
+
+//Returns the code for the given secret and time step (RFC 4226 HOTP)
+func totpCode(key []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulus := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%modulus)
+}
+
+//Checks a code against the secret.
+//Returns the time step the code belongs to, which must be later than
+//lastStep so an intercepted code cannot be used twice.
+func VerifyTOTP(secret string, code string, lastStep int64) (int64, bool) {
+	key, err := totpEncoding.DecodeString(secret)
+	if err != nil || len(key) == 0 {
+		return 0, false
+	}
+
+	code = strings.ReplaceAll(code, " ", "")
+	now := time.Now().Unix() / totpPeriod
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(key, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+//Returns the otpauth:// URI authenticator apps read from the QR code
+func totpURI(username string, secret string) string {
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("issuer", totpIssuer)
+	return "otpauth://totp/" + url.PathEscape(totpIssuer+":"+username) + "?" + values.Encode()
+}
+
+//Renders the enrollment QR code as a png data URI for the settings page
+func TOTPQRCode(username string, secret string) (template.URL, error) {
+	png, err := qrcode.Encode(totpURI(username, secret), qrcode.Medium, 256)
+	if err != nil {
+		return "", err
+	}
+	return template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png)), nil
+}
+
+//Returns the hex sha256 of a recovery code, ignoring case and dashes
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+//Generates a new set of single use recovery codes.
+//Returns the codes to show the user and the hashes to store.
+func NewRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([]string, recoveryCodeCount)
+
+	for i := range codes {
+		key := securecookie.GenerateRandomKey(5)
+		if key == nil {
+			return nil, nil, errors.New("could not generate recovery codes")
+		}
+		code := hex.EncodeToString(key)
+		codes[i] = code[:5] + "-" + code[5:]
+		hashes[i] = hashRecoveryCode(code)
+	}
+	return codes, hashes, nil
+}
+
+//Checks a second factor code for the user, which may be a TOTP code or a recovery code.
+//Used recovery codes and TOTP time steps are consumed.
+//Users without two factor authentication enabled have no second factor to check.
+func VerifySecondFactor(username string, code string) error {
+	return users.Update(username, func(u *User) error {
+		if !u.TOTPEnabled || u.TOTPSecret == "" {
+			return ErrBadCredentials
+		}
+
+		if step, ok := VerifyTOTP(u.TOTPSecret, code, u.TOTPLastStep); ok {
+			u.TOTPLastStep = step
+			return nil
+		}
+
+		hash := hashRecoveryCode(code)
+		for i, stored := range u.RecoveryCodes {
+			if subtle.ConstantTimeCompare([]byte(stored), []byte(hash)) == 1 {
+				u.RecoveryCodes = append(u.RecoveryCodes[:i:i], u.RecoveryCodes[i+1:]...)
+				Log(username + " used a recovery code")
+				return nil
+			}
+		}
+
+		return ErrBadCredentials
+	})
+}
+
+//Stores a user who entered the right password but still needs to enter their
+//second factor. They are not logged in until getLogin2FA succeeds.
+func startPending2FA(w http.ResponseWriter, r *http.Request, username string, remember bool) error {
+	session, _ := store.Get(r, "userData")
+
+	session.Values["pending2fa"] = username
+	session.Values["pending2faTime"] = time.Now().Unix()
+	session.Values["pending2faRemember"] = remember
+	return session.Save(r, w)
+}
+
+//Returns the user waiting for their second factor, or "" if there is none or it timed out
+func pending2FA(r *http.Request) string {
+	session, _ := store.Get(r, "userData")
+
+	username, _ := session.Values["pending2fa"].(string)
+	started, _ := session.Values["pending2faTime"].(int64)
+	if time.Since(time.Unix(started, 0)) > totpPending {
+		return ""
+	}
+	return username
+}
+
+//Generates the second login step for users with two factor authentication
+//and logs them in once a valid code is entered
+func getLogin2FA(w http.ResponseWriter, r *http.Request) {
+	tmpl := template.Must(template.ParseFiles("assets/log_in_2fa.html", "assets/Templates.html"))
+	var data UserData
+	data.GetLoginData(r)
+
+	if data.LoggedIn {
+		http.Redirect(w, r, "/gallery", http.StatusSeeOther)
+		return
+	}
+
+	username := pending2FA(r)
+	if username == "" {
+		http.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+
+	//First request:
+	if r.Method != http.MethodPost {
+		data.Data = false
+		DisplayError(w, r, tmpl.Execute(w, data))
+		return
+	}
+
+	ip := clientIP(r)
+	limitKeys := []string{"user:" + username, "ip:" + ip}
+
+	if wait := loginLimiter.Locked(limitKeys...); wait > 0 {
+		data.Error = lockoutMessage(wait)
+		w.WriteHeader(http.StatusTooManyRequests)
+		DisplayError(w, r, tmpl.Execute(w, data))
+		return
+	}
+
+	if err := VerifySecondFactor(username, r.FormValue("code")); err != nil {
+		Log("failed second factor for " + username + " from " + ip)
+		Audit(r, AuditLoginFailed, "", username, "wrong second factor code")
+		data.Error = "The code entered is not valid"
+		if wait := loginLimiter.Fail(limitKeys...); wait > 0 {
+			data.Error = lockoutMessage(wait)
+		}
+		DisplayError(w, r, tmpl.Execute(w, data))
+		return
+	}
+
+	loginLimiter.Reset(limitKeys...)
+	session, _ := store.Get(r, "userData")
+	remember, _ := session.Values["pending2faRemember"].(bool)
+	StartSession(w, r, username, remember)
+	Audit(r, AuditLogin, username, username, "with second factor")
+	http.Redirect(w, r, "/gallery", http.StatusSeeOther)
+}
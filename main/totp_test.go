@@ -0,0 +1,270 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	//SHA-1 test vectors from RFC 6238, cut to six digits
+	key := []byte("12345678901234567890")
+	tests := []struct {
+		time int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, test := range tests {
+		if code := totpCode(key, test.time/totpPeriod); code != test.code {
+			t.Errorf("time %d: got %s, want %s", test.time, code, test.code)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := totpEncoding.DecodeString(secret)
+	now := time.Now().Unix() / totpPeriod
+
+	tests := []struct {
+		name     string
+		secret   string
+		code     string
+		lastStep int64
+		ok       bool
+	}{
+		{"current code", secret, totpCode(key, now), 0, true},
+		{"spaced code", secret, totpCode(key, now)[:3] + " " + totpCode(key, now)[3:], 0, true},
+		{"previous code", secret, totpCode(key, now-1), 0, true},
+		{"next code", secret, totpCode(key, now+1), 0, true},
+		{"old code", secret, totpCode(key, now-2), 0, false},
+		{"reused code", secret, totpCode(key, now), now, false},
+		{"wrong code", secret, "000000" + totpCode(key, now), 0, false},
+		{"empty code", secret, "", 0, false},
+		{"empty secret", "", totpCode(nil, now), 0, false},
+		{"invalid secret", "not base32!", totpCode(nil, now), 0, false},
+	}
+	for _, test := range tests {
+		step, ok := VerifyTOTP(test.secret, test.code, test.lastStep)
+		if ok != test.ok {
+			t.Errorf("%s: got %v, want %v", test.name, ok, test.ok)
+		} else if ok && (step < now-totpSkew || step > now+totpSkew) {
+			t.Errorf("%s: got step %d, now is %d", test.name, step, now)
+		}
+	}
+}
+
+func TestVerifySecondFactor(t *testing.T) {
+	testGallery(t)
+	testUsers(t)
+
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := totpEncoding.DecodeString(secret)
+	codes, hashes, err := NewRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"alice", "bob", "carol"} {
+		if err := users.Add(name, "password1", RoleViewer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	users.Update("alice", func(u *User) error {
+		u.TOTPEnabled = true
+		u.TOTPSecret = secret
+		u.RecoveryCodes = hashes
+		return nil
+	})
+	//Part way through enrollment, with a secret but not yet enabled
+	users.Update("carol", func(u *User) error {
+		u.TOTPSecret = secret
+		u.RecoveryCodes = hashes
+		return nil
+	})
+
+	code := totpCode(key, time.Now().Unix()/totpPeriod)
+	tests := []struct {
+		name     string
+		username string
+		code     string
+		ok       bool
+	}{
+		{"TOTP code", "alice", code, true},
+		{"reused TOTP code", "alice", code, false},
+		{"recovery code", "alice", codes[0], true},
+		{"reused recovery code", "alice", codes[0], false},
+		{"recovery code without dash", "alice", codes[1][:5] + codes[1][6:], true},
+		{"wrong code", "alice", "123456", false},
+		{"not enabled, empty secret", "bob", totpCode(nil, time.Now().Unix()/totpPeriod), false},
+		{"not enabled, recovery code", "carol", codes[2], false},
+		{"not enabled, TOTP code", "carol", totpCode(key, time.Now().Unix()/totpPeriod+1), false},
+		{"unknown user", "dave", code, false},
+	}
+	for _, test := range tests {
+		if err := VerifySecondFactor(test.username, test.code); (err == nil) != test.ok {
+			t.Errorf("%s: got %v", test.name, err)
+		}
+	}
+}
+
+func TestLogin2FALockout(t *testing.T) {
+	dir := testGallery(t)
+	testTemplates(t, dir, "log_in.html", "log_in_2fa.html", "error.html")
+	testUsers(t)
+	testSessions(t)
+	testAuditLog(t)
+
+	oldAuthenticator, oldLimiter := authenticator, loginLimiter
+	t.Cleanup(func() {
+		authenticator, loginLimiter = oldAuthenticator, oldLimiter
+	})
+	authenticator = ChainAuthenticator{&LocalAuthenticator{Users: users}}
+	loginLimiter = &LoginLimiter{attempts: make(map[string]*loginAttempts)}
+	config.LoginAttemptsUser = 3
+
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Add("alice", "right password", RoleViewer); err != nil {
+		t.Fatal(err)
+	}
+	users.Update("alice", func(u *User) error {
+		u.TOTPEnabled = true
+		u.TOTPSecret = secret
+		return nil
+	})
+
+	var cookie *http.Cookie
+	post := func(handler http.HandlerFunc, path string, form url.Values) int {
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != nil {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		handler(w, r)
+		for _, c := range w.Result().Cookies() {
+			if c.Name == "userData" {
+				cookie = c
+			}
+		}
+		return w.Code
+	}
+	password := func() int {
+		return post(getLogin, "/login", url.Values{"username": {"alice"}, "password": {"right password"}})
+	}
+	wrongCode := func() int {
+		return post(getLogin2FA, "/login/2fa", url.Values{"code": {"000000"}})
+	}
+
+	//Entering the password again between wrong codes does not clear the failures
+	for i := 0; i < 2; i++ {
+		if code := password(); code != http.StatusSeeOther {
+			t.Fatalf("password got %d", code)
+		}
+		wrongCode()
+	}
+	if code := password(); code != http.StatusSeeOther {
+		t.Fatalf("password got %d", code)
+	}
+	wrongCode()
+	if wait := loginLimiter.Locked("user:alice"); wait == 0 {
+		t.Fatal("wrong codes were not locked out")
+	}
+	if code := password(); code != http.StatusTooManyRequests {
+		t.Errorf("password during the lockout got %d", code)
+	}
+	if code := wrongCode(); code != http.StatusTooManyRequests {
+		t.Errorf("code during the lockout got %d", code)
+	}
+}
+
+func TestTOTPSetupConfirm(t *testing.T) {
+	dir := testGallery(t)
+	testTemplates(t, dir, "settings.html", "error.html")
+	testUsers(t)
+	testSessions(t)
+	testTokens(t)
+	testAuditLog(t)
+
+	oldAuthenticator := authenticator
+	t.Cleanup(func() {
+		authenticator = oldAuthenticator
+	})
+	authenticator = ChainAuthenticator{&LocalAuthenticator{Users: users}}
+
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"alice", "bob"} {
+		if err := users.Add(name, "password1", RoleViewer); err != nil {
+			t.Fatal(err)
+		}
+	}
+	users.Update("alice", func(u *User) error {
+		u.TOTPEnabled = true
+		u.TOTPSecret = secret
+		return nil
+	})
+
+	settings := func(cookie *http.Cookie, form url.Values) {
+		r := httptest.NewRequest(http.MethodPost, "/settings", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(cookie)
+		getSettings(httptest.NewRecorder(), r)
+	}
+	pending := func(cookie *http.Cookie) string {
+		r := httptest.NewRequest(http.MethodGet, "/settings", nil)
+		r.AddCookie(cookie)
+		session, _ := store.Get(r, "userData")
+		pending, _ := session.Values["totpSetup"].(string)
+		return pending
+	}
+
+	//A stolen session cannot replace the secret of an account that already has one
+	alice := saveTestSession(t, store, map[interface{}]interface{}{"username": "alice"})
+	settings(alice, url.Values{"action": {"totpSetup"}})
+	settings(alice, url.Values{"action": {"totpSetup"}, "current": {"password1"}})
+	if pending(alice) != "" {
+		t.Error("setup was started while two factor authentication is on")
+	}
+
+	//Setting up and turning on both need the password
+	bob := saveTestSession(t, store, map[interface{}]interface{}{"username": "bob"})
+	settings(bob, url.Values{"action": {"totpSetup"}})
+	if pending(bob) != "" {
+		t.Fatal("setup was started without the password")
+	}
+	settings(bob, url.Values{"action": {"totpSetup"}, "current": {"password1"}})
+	newSecret := pending(bob)
+	if newSecret == "" {
+		t.Fatal("setup was not started with the password")
+	}
+	key, _ := totpEncoding.DecodeString(newSecret)
+	code := totpCode(key, time.Now().Unix()/totpPeriod)
+	settings(bob, url.Values{"action": {"totpEnable"}, "code": {code}, "current": {"wrong password"}})
+	if user, _ := users.Get("bob"); user.TOTPEnabled {
+		t.Fatal("two factor authentication was turned on with a wrong password")
+	}
+	settings(bob, url.Values{"action": {"totpEnable"}, "code": {code}, "current": {"password1"}})
+	if user, _ := users.Get("bob"); !user.TOTPEnabled || user.TOTPSecret != newSecret {
+		t.Error("two factor authentication was not turned on with the password")
+	}
+}
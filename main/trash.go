@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//How often the trash is checked for images past the retention
+const trashPurgeInterval = time.Hour
+
+//An image on the trash page
+type TrashItem struct {
+	Filename  string
+	Title     string
+	ThumbName string
+	Owner     string
+	Deleted   string
+	DeletedBy string
+	Purge     string //When the image will be deleted for good, "" if it is kept
+}
+
+type TrashData struct {
+	LoggedIn  bool
+	Username  string
+	CSRFToken string
+	Items     []TrashItem
+	Message   string
+	Error     string
+}
+
+//Checks cookie data to see is user is logged in.
+func (data *TrashData) GetLoginData(r *http.Request) {
+	session, _ := store.Get(r, "userData")
+	data.CSRFToken = CSRFToken(r)
+
+	if IsNil(session.Values["username"]) { //If cookie not found or user logged out
+		data.LoggedIn = false
+	} else {
+		data.Username = session.Values["username"].(string)
+		data.LoggedIn = true
+	}
+}
+
+//Returns how long images stay in the trash, 0 if they are kept
+func trashRetention() time.Duration {
+	return time.Duration(config.TrashRetention) * time.Second
+}
+
+//Deletes an image in the trash for good
+func purgeImage(filename string) error {
+	if err := DeleteImage(filename); err != nil {
+		return err
+	}
+	shares.DeleteImage(filename)
+	return nil
+}
+
+//Generates the trash page and applies the restore and delete actions from its forms.
+//Admins see every deleted image, uploaders the ones they may delete.
+func getTrash(w http.ResponseWriter, r *http.Request) {
+	tmpl := template.Must(template.ParseFiles("assets/trash.html", "assets/Templates.html"))
+	var data TrashData
+	data.GetLoginData(r)
+	user, _ := CurrentUser(r)
+
+	if r.Method == http.MethodPost {
+		fileName := r.FormValue("file")
+		meta, found := imageMeta.Get(fileName)
+
+		if !found || !meta.InTrash() || !CanDeleteImage(user, fileName) {
+			data.Error = fileName + " is not in the trash"
+		} else {
+			switch r.FormValue("action") {
+			case "restore":
+				if err := imageMeta.Restore(fileName); err != nil {
+					data.Error = err.Error()
+				} else {
+					Log(fileName + " restored by " + user.Username)
+					Audit(r, AuditRestore, user.Username, fileName, "")
+					data.Message = meta.DisplayName() + " has been restored"
+				}
+
+			case "delete":
+				if err := purgeImage(fileName); err != nil {
+					data.Error = err.Error()
+				} else {
+					Log(fileName + " deleted for good by " + user.Username)
+					Audit(r, AuditPurge, user.Username, fileName, "")
+					data.Message = meta.DisplayName() + " has been deleted for good"
+				}
+
+			default:
+				data.Error = "Unknown action"
+			}
+		}
+	}
+
+	for _, m := range imageMeta.Trashed() {
+		if !CanDeleteImage(user, m.Filename) {
+			continue
+		}
+
+		item := TrashItem{
+			Filename:  m.Filename,
+			Title:     m.DisplayName(),
+			ThumbName: strings.Replace(m.Filename, filepath.Ext(m.Filename), "_thumb", -1),
+			Owner:     m.Owner,
+			Deleted:   m.Deleted.Format("January 2, 2006 15:04"),
+			DeletedBy: m.DeletedBy,
+		}
+		if retention := trashRetention(); retention > 0 {
+			item.Purge = m.Deleted.Add(retention).Format("January 2, 2006 15:04")
+		}
+		data.Items = append(data.Items, item)
+	}
+
+	DisplayError(w, r, tmpl.Execute(w, data))
+}
+
+//Deletes the images that have been in the trash longer than the retention.
+//Returns the number of images deleted.
+func PurgeTrash() int {
+	retention := trashRetention()
+	if retention <= 0 {
+		return 0
+	}
+
+	purged := 0
+	for _, m := range imageMeta.Trashed() {
+		if time.Since(m.Deleted) < retention {
+			continue
+		}
+		if err := purgeImage(m.Filename); err != nil {
+			Log("could not purge " + m.Filename + " from the trash: " + err.Error())
+			continue
+		}
+
+		Log(m.Filename + " purged from the trash")
+		err := auditLog.Record(AuditEvent{
+			Time:   time.Now(),
+			Action: AuditPurge,
+			Target: m.Filename,
+			Detail: "retention",
+		})
+		if err != nil {
+			Log("could not write audit log: " + err.Error())
+		}
+		purged++
+	}
+	return purged
+}
+
+//Purges the trash now and then every trashPurgeInterval in the background
+func StartTrashPurge() {
+	go func() {
+		for {
+			if purged := PurgeTrash(); purged > 0 {
+				fmt.Printf("Purged %d images from the trash\n", purged)
+			}
+			time.Sleep(trashPurgeInterval)
+		}
+	}()
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPurgeTrash(t *testing.T) {
+	testGallery(t)
+	testAuditLog(t)
+	config.TrashRetention = 3600
+
+	for _, name := range []string{"old.png", "recent.png", "kept.png"} {
+		putTestFile(t, StorageName(ImagesFolder, name), testPNG(t, 1))
+		if err := imageMeta.Add(ImageMeta{Filename: name, Owner: "alice"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := shares.Create("old.png", "alice", time.Hour, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := imageMeta.Trash("recent.png", "alice"); err != nil {
+		t.Fatal(err)
+	}
+	err := imageMeta.Update("old.png", func(m *ImageMeta) {
+		m.Deleted = time.Now().Add(-2 * time.Hour)
+		m.DeletedBy = "alice"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//Nothing is purged while images are kept until deleted by hand
+	config.TrashRetention = 0
+	if purged := PurgeTrash(); purged != 0 {
+		t.Errorf("purged %d images with no retention", purged)
+	}
+
+	config.TrashRetention = 3600
+	if purged := PurgeTrash(); purged != 1 {
+		t.Errorf("purged %d images, want 1", purged)
+	}
+	if _, found := imageMeta.Get("old.png"); found {
+		t.Error("the purged image still has a record")
+	}
+	if StorageExists(StorageName(ImagesFolder, "old.png")) {
+		t.Error("the purged image's file is still stored")
+	}
+	if len(shares.List("old.png")) != 0 {
+		t.Error("the purged image's share links are still there")
+	}
+	for _, name := range []string{"recent.png", "kept.png"} {
+		if _, found := imageMeta.Get(name); !found || !StorageExists(StorageName(ImagesFolder, name)) {
+			t.Errorf("%s was purged", name)
+		}
+	}
+
+	//Restored images leave the trash with their record intact
+	if err := imageMeta.Restore("recent.png"); err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := imageMeta.Get("recent.png"); m.InTrash() || m.DeletedBy != "" || m.Owner != "alice" {
+		t.Errorf("restored record is %+v", m)
+	}
+	if len(imageMeta.Trashed()) != 0 {
+		t.Errorf("trash holds %d images after restoring", len(imageMeta.Trashed()))
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/disintegration/imaging"
+)
+
+//An upload saved in the staging folder with its thumbnail and resized copies.
+//Nothing is added to the gallery until it is committed, and a failed upload
+//is discarded, so an image's files are either all in place or all gone.
+type StagedImage struct {
+	id     string //Random name of the staged files
+	ext    string
+	Meta   ImageMeta //Format, size and dimensions of the upload
+	SHA256 string
+}
+
+//Returns the staging name of the original, or of a derivative if suffix is set
+func (s *StagedImage) file(suffix string) string {
+	if suffix == "" {
+		return StorageName(StagingFolder, s.id+s.ext)
+	}
+	return StorageName(StagingFolder, s.id+"_"+suffix+".jpg")
+}
+
+//Returns the suffixes of the staged files: the thumbnail, the resized copies
+//and "" for the original, which comes last so it is only in place once
+//everything made from it is
+func (s *StagedImage) suffixes() []string {
+	suffixes := []string{"thumb"}
+	for _, size := range imageSizes {
+		suffixes = append(suffixes, fmt.Sprintf("%v", size))
+	}
+	return append(suffixes, "")
+}
+
+//Returns where a staged file goes for the image filename
+func stagedDestination(filename string, suffix string) string {
+	switch suffix {
+	case "":
+		return StorageName(ImagesFolder, filename)
+	case "thumb":
+		return StorageName(ThumbnailsFolder, FormatName(filename, suffix))
+	default:
+		return StorageName(ResizedFolder, FormatName(filename, suffix))
+	}
+}
+
+//Saves an upload to the staging folder, checks the whole image decodes and makes
+//its thumbnail and resized copies. ext is the extension the image will be saved with.
+//Everything written to the staging folder is sent to progress too, if it is set.
+func StageImage(data io.Reader, ext string, progress io.Writer) (*StagedImage, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	s := &StagedImage{id: hex.EncodeToString(id), ext: ext}
+
+	hash := sha256.New()
+	if progress == nil {
+		progress = ioutil.Discard
+	}
+	if err := storage.Put(s.file(""), io.TeeReader(data, io.MultiWriter(progress, hash))); err != nil {
+		s.Discard()
+		return nil, err
+	}
+	s.SHA256 = hex.EncodeToString(hash.Sum(nil))
+
+	meta, err := describeFile(s.file(""))
+	if err != nil {
+		s.Discard()
+		return nil, fmt.Errorf("Cannot upload: The file could not be read as an image: %v", err)
+	}
+	s.Meta = meta
+
+	//Decoding the whole image finds files that are cut short or broken after the header
+	src, err := LoadImage(s.file(""))
+	if err != nil {
+		s.Discard()
+		return nil, fmt.Errorf("Cannot upload: The file could not be read as an image: %v", err)
+	}
+
+	//Thumbnails are 200px high, keeping the aspect ratio
+	if err := SaveImage(s.file("thumb"), imaging.Resize(src, 0, 200, imaging.Lanczos)); err != nil {
+		s.Discard()
+		return nil, err
+	}
+
+	//Make every size at once, never wider than the original
+	var wg sync.WaitGroup
+	errs := make(chan error, len(imageSizes))
+	srcWidth := src.Bounds().Max.X
+	for _, size := range imageSizes {
+		newSize := size
+		if srcWidth <= size {
+			newSize = srcWidth
+		}
+
+		wg.Add(1)
+		go func(size int, newSize int) {
+			defer wg.Done()
+			resized := imaging.Resize(src, newSize, 0, imaging.Lanczos)
+			if err := SaveImage(s.file(fmt.Sprintf("%v", size)), resized); err != nil {
+				errs <- err
+			}
+		}(size, newSize)
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		s.Discard()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+//Returns the bytes used by the staged thumbnail and resized copies
+func (s *StagedImage) DerivedSize() int64 {
+	var size int64
+	for _, suffix := range s.suffixes() {
+		if suffix == "" {
+			continue
+		}
+		if info, err := storage.Stat(s.file(suffix)); err == nil {
+			size += info.Size
+		}
+	}
+	return size
+}
+
+//Moves the staged files into place for the image filename, replacing any files
+//already there. The original is moved last, so an image already at the name keeps
+//its file if a move fails. The files already moved are then deleted along with
+//the staged ones, and the image's thumbnail and resized copies must be made again.
+func (s *StagedImage) Commit(filename string) error {
+	suffixes := s.suffixes()
+	for i, suffix := range suffixes {
+		if err := storage.Move(s.file(suffix), stagedDestination(filename, suffix)); err != nil {
+			for _, done := range suffixes[:i] {
+				storage.Delete(stagedDestination(filename, done))
+			}
+			s.Discard()
+			return err
+		}
+	}
+	return nil
+}
+
+//Deletes the files moved into place by Commit, for an upload
+//that could not be recorded
+func (s *StagedImage) Rollback(filename string) {
+	for _, suffix := range s.suffixes() {
+		storage.Delete(stagedDestination(filename, suffix))
+	}
+}
+
+//Deletes the staged files of an upload that is not kept
+func (s *StagedImage) Discard() {
+	for _, suffix := range s.suffixes() {
+		storage.Delete(s.file(suffix))
+	}
+}
+
+//Makes the thumbnail and resized copies of an image again where they are missing,
+//for when a new file for the image failed part way through being moved into place
+func remakeDerivatives(filename string) {
+	imageMeta.Update(filename, func(m *ImageMeta) {
+		m.Thumbnail, m.Resized = false, nil
+	})
+	GenerateThumnail(filename)
+	GenerateAllSizes(filename)
+}
+
+//Returns the storage names of the thumbnail and resized copies of an image
+func derivativeNames(filename string) []string {
+	names := []string{StorageName(ThumbnailsFolder, FormatName(filename, "thumb"))}
+	for _, size := range imageSizes {
+		names = append(names, StorageName(ResizedFolder, FormatName(filename, fmt.Sprintf("%v", size))))
+	}
+	return names
+}
+
+//Deletes files left in the staging folder by uploads that never finished,
+//such as when the server stopped part way through one
+func CleanStaging() error {
+	files, err := storage.List(StagingFolder)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if err := storage.Delete(StorageName(StagingFolder, f.Name)); err != nil {
+			return err
+		}
+	}
+	if len(files) > 0 {
+		fmt.Printf("Removed %d unfinished uploads from the staging folder\n", len(files))
+	}
+	return nil
+}
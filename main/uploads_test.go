@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+//Storage that fails to move files into one name, to test uploads failing part way
+type failingMoveStorage struct {
+	Storage
+	failTo string
+}
+
+func (s *failingMoveStorage) Move(from string, to string) error {
+	if to == s.failTo {
+		return errors.New("move failed")
+	}
+	return s.Storage.Move(from, to)
+}
+
+func TestReserveFilename(t *testing.T) {
+	testGallery(t)
+	if err := imageMeta.Add(ImageMeta{Filename: "arch.png"}); err != nil {
+		t.Fatal(err)
+	}
+
+	first := ReserveFilename("arch.jpg")
+	second := ReserveFilename("arch.jpg")
+	if first != "arch-2.jpg" || second != "arch-3.jpg" {
+		t.Errorf("got %s and %s, want arch-2.jpg and arch-3.jpg", first, second)
+	}
+	if ReserveReplacement("Arch-2.png") {
+		t.Error("replacing a name an upload is using was allowed")
+	}
+
+	ReleaseFilename(first)
+	ReleaseFilename(second)
+	if name := ReserveFilename("arch.jpg"); name != "arch-2.jpg" {
+		t.Errorf("got %s after releasing, want arch-2.jpg", name)
+	}
+	ReleaseFilename("arch-2.jpg")
+	if !ReserveReplacement("arch.jpg") {
+		t.Error("could not replace a free name")
+	}
+	ReleaseFilename("arch.jpg")
+}
+
+func TestStageImageRejectsBrokenFiles(t *testing.T) {
+	testGallery(t)
+
+	data := testPNG(t, 1)
+	if _, err := StageImage(bytes.NewReader(data[:len(data)/2]), ".png", nil); err == nil {
+		t.Fatal("a cut off image was staged")
+	}
+	files, err := storage.List(StagingFolder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("staging folder holds %d files after a failed upload", len(files))
+	}
+}
+
+func TestCommitFailureKeepsOriginal(t *testing.T) {
+	testGallery(t)
+
+	oldData := testPNG(t, 1)
+	putTestFile(t, StorageName(ImagesFolder, "arch.png"), oldData)
+	if err := imageMeta.Add(ImageMeta{Filename: "arch.png"}); err != nil {
+		t.Fatal(err)
+	}
+	GenerateThumnail("arch.png")
+
+	staged, err := StageImage(bytes.NewReader(testPNG(t, 2)), ".png", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage = &failingMoveStorage{Storage: storage, failTo: StorageName(ImagesFolder, "arch.png")}
+	if err := staged.Commit("arch.png"); err == nil {
+		t.Fatal("commit succeeded")
+	}
+
+	if !bytes.Equal(readTestFile(t, StorageName(ImagesFolder, "arch.png")), oldData) {
+		t.Error("the original was changed by a failed commit")
+	}
+	files, _ := storage.List(StagingFolder)
+	if len(files) != 0 {
+		t.Errorf("staging folder holds %d files after a failed commit", len(files))
+	}
+
+	remakeDerivatives("arch.png")
+	for _, name := range derivativeNames("arch.png") {
+		if !StorageExists(name) {
+			t.Errorf("%s was not made again", name)
+		}
+	}
+}
+
+func TestRecordUploadReplacing(t *testing.T) {
+	testGallery(t)
+
+	putTestFile(t, StorageName(ImagesFolder, "arch.png"), testPNG(t, 1))
+	putTestFile(t, StorageName(VersionsFolder, "arch.v1.png"), testPNG(t, 2))
+	err := imageMeta.Add(ImageMeta{Filename: "arch.png", Version: 2, Versions: []ImageVersion{{Number: 1, File: "arch.v1.png"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	GenerateThumnail("arch.png")
+
+	//A jpeg upload named like the png takes its place, and shares its thumbnail name
+	staged, err := StageImage(bytes.NewReader(testPNG(t, 3)), ".jpg", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := staged.Commit("arch.jpg"); err != nil {
+		t.Fatal(err)
+	}
+	if err := recordUpload(ImageMeta{Filename: "arch.jpg"}, "arch.png"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, found := imageMeta.Get("arch.png"); found {
+		t.Error("the replaced image is still recorded")
+	}
+	if _, found := imageMeta.Get("arch.jpg"); !found {
+		t.Error("the upload was not recorded")
+	}
+	if StorageExists(StorageName(ImagesFolder, "arch.png")) || StorageExists(StorageName(VersionsFolder, "arch.v1.png")) {
+		t.Error("the replaced image's files were kept")
+	}
+	for _, name := range append(derivativeNames("arch.jpg"), StorageName(ImagesFolder, "arch.jpg")) {
+		if !StorageExists(name) {
+			t.Errorf("%s of the upload was deleted", name)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const usersPath = "./data/users.json"
+
+var (
+	ErrUserNotFound   = errors.New("user not found")
+	ErrUserExists     = errors.New("user already exists")
+	ErrBadCredentials = errors.New("invalid username or password")
+)
+
+//Hash compared against when a username does not exist,
+//so failed logins take the same amount of time either way
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy-password"), bcrypt.DefaultCost)
+
+//A single account stored in the user store
+type User struct {
+	Username     string
+	DisplayName  string
+	PasswordHash string
+	Role         string
+	Backend      string //Authenticator the account comes from, "" for local accounts
+	Subject      string //Issuer and subject of accounts from OpenID Connect, which never change
+	Created      time.Time
+
+	//Two factor authentication
+	TOTPEnabled   bool
+	TOTPSecret    string
+	TOTPLastStep  int64    //Time step of the last accepted code, so codes cannot be reused
+	RecoveryCodes []string //sha256 hashes of the unused recovery codes
+}
+
+//Returns the name of the authenticator the account comes from
+func (u User) BackendName() string {
+	if u.Backend == "" {
+		return localBackend
+	}
+	return u.Backend
+}
+
+//Returns the display name, falling back to the username
+func (u User) Name() string {
+	if u.DisplayName != "" {
+		return u.DisplayName
+	}
+	return u.Username
+}
+
+//File backed collection of user accounts.
+//Every change is written back to disk immediately.
+type UserStore struct {
+	mu    sync.RWMutex
+	path  string
+	users map[string]*User
+}
+
+//Global user store, loaded in main
+var users *UserStore
+
+//Loads the user store from the given json file.
+//A missing file is treated as an empty store.
+func LoadUserStore(path string) (*UserStore, error) {
+	s := &UserStore{
+		path:  path,
+		users: make(map[string]*User),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var list []*User
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("reading %s: %v", path, err)
+	}
+	for _, u := range list {
+		//Accounts created before roles existed
+		if u.Role == "" {
+			u.Role = RoleViewer
+		}
+		s.users[u.Username] = u
+	}
+
+	return s, nil
+}
+
+//Writes the store to a temp file and renames it over the old one,
+//so a crash never leaves a half written user file behind.
+//Caller must hold the write lock.
+func (s *UserStore) save() error {
+	list := make([]*User, 0, len(s.users))
+	for _, u := range s.users {
+		list = append(list, u)
+	}
+
+	data, err := json.MarshalIndent(list, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+//Creates a user whose password is checked by an external authenticator.
+//The account has no local password.
+func (s *UserStore) AddExternal(ident Identity, role string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[ident.Username]; ok {
+		return ErrUserExists
+	}
+
+	s.users[ident.Username] = &User{
+		Username:    ident.Username,
+		DisplayName: ident.DisplayName,
+		Role:        role,
+		Backend:     ident.Backend,
+		Subject:     ident.Subject,
+		Created:     time.Now(),
+	}
+	return s.save()
+}
+
+//Returns a copy of the user with the given external subject
+func (s *UserStore) FindSubject(subject string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, u := range s.users {
+		if subject != "" && u.Subject == subject {
+			return *u, nil
+		}
+	}
+	return User{}, ErrUserNotFound
+}
+
+//Returns the number of stored users
+func (s *UserStore) Count() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.users)
+}
+
+//Returns a copy of the named user
+func (s *UserStore) Get(username string) (User, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, ok := s.users[username]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	return *u, nil
+}
+
+//Creates a new user with a bcrypt hash of the given password
+func (s *UserStore) Add(username string, password string, role string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[username]; ok {
+		return ErrUserExists
+	}
+
+	s.users[username] = &User{
+		Username:     username,
+		PasswordHash: string(hash),
+		Role:         role,
+		Created:      time.Now(),
+	}
+	return s.save()
+}
+
+//Returns copies of all users sorted by username
+func (s *UserStore) List() []User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]User, 0, len(s.users))
+	for _, u := range s.users {
+		list = append(list, *u)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Username < list[j].Username
+	})
+	return list
+}
+
+//Applies fn to the named user and saves the store if it succeeds
+func (s *UserStore) Update(username string, fn func(u *User) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, ok := s.users[username]
+	if !ok {
+		return ErrUserNotFound
+	}
+
+	updated := *u
+	if err := fn(&updated); err != nil {
+		return err
+	}
+	s.users[username] = &updated
+	return s.save()
+}
+
+//Replaces the user's password hash
+func (s *UserStore) SetPassword(username string, password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	return s.Update(username, func(u *User) error {
+		u.PasswordHash = string(hash)
+		return nil
+	})
+}
+
+//Removes the named user from the store
+func (s *UserStore) Delete(username string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.users[username]; !ok {
+		return ErrUserNotFound
+	}
+	delete(s.users, username)
+	return s.save()
+}
+
+//Checks the password against the stored hash.
+//Returns ErrBadCredentials for both unknown users and wrong passwords.
+func (s *UserStore) Verify(username string, password string) (User, error) {
+	u, err := s.Get(username)
+	if err != nil {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return User{}, ErrBadCredentials
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(password)) != nil {
+		return User{}, ErrBadCredentials
+	}
+	return u, nil
+}
+
+//Returns true if any stored user has the admin role
+func (s *UserStore) HasAdmin() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, u := range s.users {
+		if u.Role == RoleAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+//Creates an admin account when the store has no admins.
+//The password is read from GALLERY_ADMIN_PASSWORD, or generated and printed once.
+//The account is named "admin", or numbered if another account has that name, since
+//that account may be anyone's. Setting GALLERY_PROMOTE_ADMIN to a username promotes
+//that account instead.
+func (s *UserStore) Bootstrap() error {
+	if s.HasAdmin() {
+		return nil
+	}
+	if username := os.Getenv("GALLERY_PROMOTE_ADMIN"); username != "" {
+		err := s.Update(username, func(u *User) error {
+			u.Role = RoleAdmin
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("promoting %s from GALLERY_PROMOTE_ADMIN: %v", username, err)
+		}
+		fmt.Printf("Gave user %q the admin role from GALLERY_PROMOTE_ADMIN\n", username)
+		Log(username + " promoted to the admin role from GALLERY_PROMOTE_ADMIN")
+		return nil
+	}
+
+	username := "admin"
+	for i := 2; ; i++ {
+		if _, err := s.Get(username); err == ErrUserNotFound {
+			break
+		}
+		username = fmt.Sprintf("admin-%d", i)
+	}
+
+	password := os.Getenv("GALLERY_ADMIN_PASSWORD")
+	generated := password == ""
+	if generated {
+		buff := make([]byte, 12)
+		if _, err := rand.Read(buff); err != nil {
+			return err
+		}
+		password = base64.RawURLEncoding.EncodeToString(buff)
+	}
+
+	if err := s.Add(username, password, RoleAdmin); err != nil {
+		return err
+	}
+
+	if generated {
+		fmt.Printf("Created user %q with password: %s\n", username, password)
+	} else {
+		fmt.Printf("Created user %q from GALLERY_ADMIN_PASSWORD\n", username)
+	}
+	Log(username + " account created as the admin")
+	return nil
+}
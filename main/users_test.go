@@ -0,0 +1,148 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+//Sets an environment variable for the rest of the test
+func setTestEnv(t *testing.T, name string, value string) {
+	t.Helper()
+	old, had := os.LookupEnv(name)
+	os.Setenv(name, value)
+	t.Cleanup(func() {
+		if had {
+			os.Setenv(name, old)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+}
+
+//Points the global user store at an empty store in a temporary folder
+func testUsers(t *testing.T) {
+	t.Helper()
+	oldUsers := users
+	var err error
+	users, err = LoadUserStore(filepath.Join(t.TempDir(), "users.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		users = oldUsers
+	})
+}
+
+func TestUserStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.json")
+	s, err := LoadUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add("alice", "first password", RoleUploader); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add("alice", "other password", RoleAdmin); err != ErrUserExists {
+		t.Errorf("adding alice again got %v, want %v", err, ErrUserExists)
+	}
+
+	tests := []struct {
+		username string
+		password string
+		err      error
+	}{
+		{"alice", "first password", nil},
+		{"alice", "First password", ErrBadCredentials},
+		{"alice", "", ErrBadCredentials},
+		{"Alice", "first password", ErrBadCredentials},
+		{"bob", "first password", ErrBadCredentials},
+	}
+	for _, test := range tests {
+		if _, err := s.Verify(test.username, test.password); err != test.err {
+			t.Errorf("%s/%q: got %v, want %v", test.username, test.password, err, test.err)
+		}
+	}
+
+	//The store holds only a bcrypt hash, and is read back the same
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "first password") {
+		t.Error("the password was saved in plain text")
+	}
+	if err := s.SetPassword("alice", "second password"); err != nil {
+		t.Fatal(err)
+	}
+	s, err = LoadUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u, err := s.Verify("alice", "second password"); err != nil || u.Role != RoleUploader {
+		t.Errorf("reloaded store got %+v, %v", u, err)
+	}
+	if _, err := s.Verify("alice", "first password"); err != ErrBadCredentials {
+		t.Errorf("old password got %v", err)
+	}
+
+	if err := s.Delete("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("alice"); err != ErrUserNotFound {
+		t.Errorf("deleted user got %v, want %v", err, ErrUserNotFound)
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	setTestEnv(t, "GALLERY_ADMIN_PASSWORD", "admin password")
+
+	tests := []struct {
+		name    string
+		users   map[string]string //Existing accounts and their roles
+		promote string
+		admin   string //Account expected to be an admin afterwards
+	}{
+		{"empty store", nil, "", "admin"},
+		{"admin name taken", map[string]string{"admin": RoleViewer}, "", "admin-2"},
+		{"numbered names taken", map[string]string{"admin": RoleViewer, "admin-2": RoleUploader}, "", "admin-3"},
+		{"promoted", map[string]string{"admin": RoleViewer, "alice": RoleViewer}, "alice", "alice"},
+		{"admin exists", map[string]string{"alice": RoleAdmin, "admin": RoleViewer}, "", "alice"},
+	}
+	for _, test := range tests {
+		testUsers(t)
+		setTestEnv(t, "GALLERY_PROMOTE_ADMIN", test.promote)
+		for username, role := range test.users {
+			if err := users.Add(username, "some password", role); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if err := users.Bootstrap(); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		var admins []string
+		for _, u := range users.List() {
+			if u.Role == RoleAdmin {
+				admins = append(admins, u.Username)
+			}
+		}
+		if len(admins) != 1 || admins[0] != test.admin {
+			t.Errorf("%s: admins are %v, want %s", test.name, admins, test.admin)
+		}
+		if test.promote == "" && test.users[test.admin] == "" {
+			if _, err := users.Verify(test.admin, "admin password"); err != nil {
+				t.Errorf("%s: the new admin does not have the password: %v", test.name, err)
+			}
+		}
+	}
+
+	testUsers(t)
+	setTestEnv(t, "GALLERY_PROMOTE_ADMIN", "nobody")
+	if err := users.Bootstrap(); err == nil {
+		t.Error("promoting a missing account succeeded")
+	}
+}
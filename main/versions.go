@@ -0,0 +1,323 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//An earlier version of an image, kept in the versions folder
+type ImageVersion struct {
+	Number       int
+	File         string //Name in the versions folder, such as "arch.v1.jpg"
+	OriginalName string
+	Format       string
+	Width        int
+	Height       int
+	Size         int64
+	SHA256       string
+	By           string //Who uploaded the version
+	Uploaded     time.Time
+}
+
+//A row of the version list on the image page
+type VersionInfo struct {
+	Number     int
+	Current    bool
+	By         string
+	Uploaded   string
+	Size       string
+	Dimensions string
+}
+
+//Stops two new versions of an image being saved at once
+var versionMu sync.Mutex
+
+//Returns the name an earlier version of an image is kept under, such as "arch.v1.jpg"
+func versionFile(filename string, number int) string {
+	ext := filepath.Ext(filename)
+	return fmt.Sprintf("%s.v%d%s", strings.TrimSuffix(filename, ext), number, ext)
+}
+
+//Returns an earlier version of an image.
+//Returns false if there is no such version.
+func (m ImageMeta) FindVersion(number int) (ImageVersion, bool) {
+	for _, v := range m.Versions {
+		if v.Number == number {
+			return v, true
+		}
+	}
+	return ImageVersion{}, false
+}
+
+//Returns the versions of an image for the image page, current version first
+func VersionInfos(m ImageMeta) []VersionInfo {
+	formatSize := func(size int64) string {
+		return fmt.Sprintf("%.1f KB", float64(size)/1024)
+	}
+
+	by, uploaded := m.VersionBy, m.VersionUploaded
+	if m.CurrentVersion() == 1 {
+		by, uploaded = m.Owner, m.Uploaded
+	}
+	infos := []VersionInfo{{
+		Number:     m.CurrentVersion(),
+		Current:    true,
+		By:         by,
+		Uploaded:   uploaded.Format("January 2, 2006 15:04"),
+		Size:       formatSize(m.Size),
+		Dimensions: fmt.Sprintf("%vx%v", m.Width, m.Height),
+	}}
+
+	for i := len(m.Versions) - 1; i >= 0; i-- {
+		v := m.Versions[i]
+		infos = append(infos, VersionInfo{
+			Number:     v.Number,
+			By:         v.By,
+			Uploaded:   v.Uploaded.Format("January 2, 2006 15:04"),
+			Size:       formatSize(v.Size),
+			Dimensions: fmt.Sprintf("%vx%v", v.Width, v.Height),
+		})
+	}
+	return infos
+}
+
+//Makes data the new file of an image, keeping the current file as an earlier version.
+//Thumbnails and resized copies are made again for the new file before it replaces the current one.
+func AddVersion(filename string, data io.Reader, by string, originalName string) error {
+	versionMu.Lock()
+	defer versionMu.Unlock()
+
+	meta, found := imageMeta.Get(filename)
+	if !found {
+		return ErrImageNotFound
+	}
+
+	//The new file is staged and checked before the current one is touched
+	staged, err := StageImage(data, filepath.Ext(filename), nil)
+	if err != nil {
+		return err
+	}
+
+	current := meta.CurrentVersion()
+	old := ImageVersion{
+		Number:       current,
+		File:         versionFile(filename, current),
+		OriginalName: meta.OriginalName,
+		Format:       meta.Format,
+		Width:        meta.Width,
+		Height:       meta.Height,
+		Size:         meta.Size,
+		SHA256:       meta.SHA256,
+		By:           meta.VersionBy,
+		Uploaded:     meta.VersionUploaded,
+	}
+	if current == 1 {
+		old.By, old.Uploaded = meta.Owner, meta.Uploaded
+	}
+
+	//The new file's thumbnail and resized copies count towards the quota too, so the
+	//check is made now they are staged. The lock is held until the version is recorded.
+	updated := meta
+	updated.Blob = ""
+	updated.Versions = append(append([]ImageVersion(nil), meta.Versions...), old)
+	updated.Size, updated.DerivedSize = staged.Meta.Size, staged.DerivedSize()
+	quotaMu.Lock()
+	defer quotaMu.Unlock()
+	if err := CheckQuota(meta.Owner, updated.StorageUsed()-meta.StorageUsed()); err != nil {
+		staged.Discard()
+		return err
+	}
+
+	if err := copyStorageFile(StorageName(ImagesFolder, meta.BlobName()), StorageName(VersionsFolder, old.File)); err != nil {
+		staged.Discard()
+		return err
+	}
+
+	//Images sharing this image's files keep the current version
+	if err := detachLinks(filename); err != nil {
+		storage.Delete(StorageName(VersionsFolder, old.File))
+		staged.Discard()
+		return err
+	}
+
+	//Every size is staged, so the old file's thumbnail and resized copies are all replaced
+	if err := staged.Commit(filename); err != nil {
+		storage.Delete(StorageName(VersionsFolder, old.File))
+		go remakeDerivatives(filename)
+		return err
+	}
+
+	return imageMeta.Update(filename, func(m *ImageMeta) {
+		m.Versions = append(m.Versions, old)
+		m.Version = current + 1
+		m.VersionBy = by
+		m.VersionUploaded = time.Now()
+		if originalName != "" {
+			m.OriginalName = originalName
+		}
+		m.Format, m.Width, m.Height, m.Size = staged.Meta.Format, staged.Meta.Width, staged.Meta.Height, staged.Meta.Size
+		m.SHA256 = staged.SHA256
+		m.Blob = ""
+		m.Thumbnail, m.Resized = true, append([]int(nil), imageSizes...)
+		m.DerivedSize = updated.DerivedSize
+	})
+}
+
+//Makes an earlier version of an image the current one.
+//The current file is kept as a version, so reverting can be undone.
+func RevertVersion(filename string, number int, by string) error {
+	meta, _ := imageMeta.Get(filename)
+	v, found := meta.FindVersion(number)
+	if !found {
+		return fmt.Errorf("%s has no version %v", filename, number)
+	}
+
+	file, err := storage.Get(StorageName(VersionsFolder, v.File))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return AddVersion(filename, file, by, v.OriginalName)
+}
+
+//Deletes the earlier versions of an image
+func deleteVersions(m ImageMeta) {
+	for _, v := range m.Versions {
+		storage.Delete(StorageName(VersionsFolder, v.File))
+	}
+}
+
+//Finds the image named in the request, if the user may change it.
+//Writes an error page and returns false otherwise.
+func versionTarget(w http.ResponseWriter, r *http.Request) (ImageMeta, User, bool) {
+	fileName := mux.Vars(r)["file"]
+
+	user, ok := CurrentUser(r)
+	if !ok || !CanDeleteImage(user, fileName) {
+		forbidden(w, r)
+		return ImageMeta{}, User{}, false
+	}
+
+	meta, found := imageMeta.Get(fileName)
+	if !found || meta.InTrash() {
+		notFound(w, r)
+		return ImageMeta{}, User{}, false
+	}
+	return meta, user, true
+}
+
+//Returns the address of an image's page
+func imagePageURL(filename string) string {
+	return "/image/" + url.PathEscape(strings.TrimSuffix(filename, filepath.Ext(filename)))
+}
+
+//Accepts a new version of an image.
+//Only users who may delete the image may upload new versions of it.
+func versionUploadHandler(w http.ResponseWriter, r *http.Request) {
+	meta, user, ok := versionTarget(w, r)
+	if !ok {
+		return
+	}
+
+	file, fileHeader, filetype, err := openUpload(r)
+	if err != nil {
+		DisplayError(w, r, err, "file")
+		return
+	}
+	defer file.Close()
+
+	//The new version counts towards the storage of the image's uploader
+	if err := CheckQuota(meta.Owner, fileHeader.Size); err != nil {
+		DisplayError(w, r, err, "file")
+		return
+	}
+
+	//The file keeps its name, so the new version must have the same format
+	if uploadExtensions[filetype] != strings.ToLower(filepath.Ext(meta.Filename)) {
+		DisplayError(w, r, errors.New(fmt.Sprintf("Cannot upload: A new version of %s must be a %s image", meta.DisplayName(), meta.Format)), "file")
+		return
+	}
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		DisplayError(w, r, err, "file")
+		return
+	}
+	if hex.EncodeToString(hash.Sum(nil)) == meta.SHA256 {
+		DisplayError(w, r, errors.New("Cannot upload: The file is the same as the current version"), "file")
+		return
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		DisplayError(w, r, err, "file")
+		return
+	}
+
+	if err := AddVersion(meta.Filename, file, user.Username, CleanOriginalName(fileHeader.Filename)); err != nil {
+		DisplayError(w, r, err, "file")
+		return
+	}
+
+	version := strconv.Itoa(meta.CurrentVersion() + 1)
+	Log(meta.Filename + " version " + version + " uploaded by " + user.Username)
+	Audit(r, AuditVersion, user.Username, meta.Filename, "version "+version)
+	http.Redirect(w, r, imagePageURL(meta.Filename), http.StatusSeeOther)
+}
+
+//Makes an earlier version of an image the current one
+func versionRevertHandler(w http.ResponseWriter, r *http.Request) {
+	meta, user, ok := versionTarget(w, r)
+	if !ok {
+		return
+	}
+
+	number, _ := strconv.Atoi(mux.Vars(r)["number"])
+	//The reverted file is stored again as the current version
+	if v, found := meta.FindVersion(number); found {
+		if err := CheckQuota(meta.Owner, v.Size); err != nil {
+			DisplayError(w, r, err, "file")
+			return
+		}
+	}
+	if err := RevertVersion(meta.Filename, number, user.Username); err != nil {
+		DisplayError(w, r, err)
+		return
+	}
+
+	Log(meta.Filename + " reverted to version " + strconv.Itoa(number) + " by " + user.Username)
+	Audit(r, AuditVersion, user.Username, meta.Filename, "reverted to version "+strconv.Itoa(number))
+	http.Redirect(w, r, imagePageURL(meta.Filename), http.StatusSeeOther)
+}
+
+//Downloads an earlier version of an image
+func versionDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	fileName := vars["file"]
+
+	meta, found := imageMeta.Get(fileName)
+	if !found || meta.InTrash() || !CanViewImage(r, fileName) {
+		http.NotFound(w, r)
+		return
+	}
+
+	number, _ := strconv.Atoi(vars["number"])
+	v, found := meta.FindVersion(number)
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+
+	ServeStorageFile(w, r, StorageName(VersionsFolder, v.File))
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestVersionFile(t *testing.T) {
+	tests := []struct {
+		filename string
+		number   int
+		want     string
+	}{
+		{"arch.jpg", 1, "arch.v1.jpg"},
+		{"arch-2.png", 12, "arch-2.v12.png"},
+		{"arch.v1.jpg", 2, "arch.v1.v2.jpg"},
+	}
+	for _, test := range tests {
+		if got := versionFile(test.filename, test.number); got != test.want {
+			t.Errorf("versionFile(%q, %d) = %q, want %q", test.filename, test.number, got, test.want)
+		}
+	}
+}
+
+func TestAddAndRevertVersion(t *testing.T) {
+	testGallery(t)
+
+	first, second := testPNG(t, 1), testPNG(t, 2)
+	putTestFile(t, StorageName(ImagesFolder, "arch.png"), first)
+	meta, err := DescribeImage("arch.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta.Owner = "alice"
+	if err := imageMeta.Add(meta); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := AddVersion("arch.png", bytes.NewReader(second), "bob", "Arch 2.png"); err != nil {
+		t.Fatal(err)
+	}
+	m, _ := imageMeta.Get("arch.png")
+	if m.CurrentVersion() != 2 || m.VersionBy != "bob" || m.OriginalName != "Arch 2.png" || len(m.Versions) != 1 {
+		t.Fatalf("record after a new version is %+v", m)
+	}
+	if v := m.Versions[0]; v.Number != 1 || v.By != "alice" || v.File != "arch.v1.png" {
+		t.Errorf("earlier version is %+v", v)
+	}
+	if !bytes.Equal(readTestFile(t, StorageName(ImagesFolder, "arch.png")), second) {
+		t.Error("the image file is not the new version")
+	}
+	if !bytes.Equal(readTestFile(t, StorageName(VersionsFolder, "arch.v1.png")), first) {
+		t.Error("the earlier version's file is not the old image")
+	}
+
+	//A broken file changes nothing
+	if err := AddVersion("arch.png", bytes.NewReader(first[:len(first)/2]), "bob", ""); err == nil {
+		t.Error("a broken file was made a version")
+	}
+	if m, _ := imageMeta.Get("arch.png"); m.CurrentVersion() != 2 || len(m.Versions) != 1 {
+		t.Errorf("a failed version changed the record: %+v", m)
+	}
+
+	if err := RevertVersion("arch.png", 1, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	m, _ = imageMeta.Get("arch.png")
+	if m.CurrentVersion() != 3 || len(m.Versions) != 2 || m.Versions[1].Number != 2 {
+		t.Errorf("record after reverting is %+v", m)
+	}
+	if !bytes.Equal(readTestFile(t, StorageName(ImagesFolder, "arch.png")), first) {
+		t.Error("reverting did not bring back the first file")
+	}
+	if !bytes.Equal(readTestFile(t, StorageName(VersionsFolder, "arch.v2.png")), second) {
+		t.Error("the reverted file was not kept as a version")
+	}
+
+	if err := RevertVersion("arch.png", 5, "alice"); err == nil {
+		t.Error("reverted to a version that does not exist")
+	}
+	if err := AddVersion("missing.png", bytes.NewReader(second), "bob", ""); err != ErrImageNotFound {
+		t.Errorf("new version of a missing image got %v", err)
+	}
+}